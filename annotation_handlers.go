@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var errEmptyAnnotation = errors.New("Annotation makes no changes")
+
+// annotationRequest is the body of POST /objects/{oid}/annotations
+type annotationRequest struct {
+	FileName   string               `json:"filename"`
+	Set        map[string]Attribute `json:"set"`
+	Unset      []string             `json:"unset"`
+	AddTags    []string             `json:"add-tags"`
+	RemoveTags []string             `json:"remove-tags"`
+}
+
+// AnnotateHandler records a change to an object's filename, attributes and
+// tags. The object's MetaData is left as it was uploaded; the change is
+// appended to its annotation history as a new revision, along with who made
+// it.
+func (a *App) AnnotateHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+
+	an := &Annotation{
+		Author:   requestIdentity(r).Name,
+		Created:  time.Now().Unix(),
+		FileName: strings.TrimSpace(req.FileName),
+	}
+	var err error
+	if an.Set, err = normalizeAttributes(req.Set); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	for _, name := range req.Unset {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			writeError(w, r, 400, errInvalidAttributes)
+			return
+		}
+		an.Unset = addTag(an.Unset, name)
+	}
+	if an.AddTags, err = normalizeTags(req.AddTags); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if an.RemoveTags, err = normalizeTags(req.RemoveTags); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if an.FileName == "" && len(an.Set)+len(an.Unset)+len(an.AddTags)+len(an.RemoveTags) == 0 {
+		writeError(w, r, 400, errEmptyAnnotation)
+		return
+	}
+
+	err = a.metaStoreFor(r).Annotate(oid, an)
+	if err == errObjectNotFound {
+		writeError(w, r, 404, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 201, Status: "Created", Oid: oid, Annotation: an})
+}
+
+// ListAnnotationsHandler returns an object's annotation history, oldest
+// first.
+func (a *App) ListAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	ms := a.metaStoreFor(r)
+	if _, err := ms.Get(oid); err != nil {
+		writeError(w, r, 404, err)
+		return
+	}
+
+	annotations, err := ms.Annotations(oid)
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: oid, Annotations: annotations})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errInvalidArchiveFormat = errors.New("Archive format must be tar, tar.gz or zip")
+
+// Archive formats, as given in the "format" query parameter.
+const (
+	formatTar   = "tar"
+	formatTarGz = "tar.gz"
+	formatZip   = "zip"
+)
+
+// archiveEntry is one object to be written to an archive, under name.
+type archiveEntry struct {
+	name string
+	oid  string
+	meta *MetaData
+}
+
+// archiveWriter writes objects into an archive as they are streamed from the
+// ObjectStore, so nothing is staged on disk.
+type archiveWriter interface {
+	add(e archiveEntry, r io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter returns an archiveWriter for format writing to w, along
+// with the archive's media type. "tgz" is accepted for tar.gz.
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, string, error) {
+	switch format {
+	case formatTar:
+		return &tarArchive{tw: tar.NewWriter(w)}, "application/x-tar", nil
+	case formatTarGz, "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarArchive{tw: tar.NewWriter(gz), gz: gz}, "application/gzip", nil
+	case formatZip:
+		return &zipArchive{zw: zip.NewWriter(w)}, "application/zip", nil
+	}
+	return nil, "", errInvalidArchiveFormat
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchive) add(e archiveEntry, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:     e.name,
+		Mode:     0644,
+		Size:     e.meta.Length,
+		ModTime:  time.Unix(e.meta.Created, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.tw, r, e.meta.Length)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(e archiveEntry, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: time.Unix(e.meta.Created, 0)}
+	hdr.SetMode(0644)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, r, e.meta.Length)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+// archiveReader iterates over the regular files in an uploaded archive.
+// next returns io.EOF after the last one; directories, links and other
+// special entries are skipped.
+type archiveReader interface {
+	next() (name string, r io.Reader, err error)
+	Close() error
+}
+
+// openArchive returns an archiveReader for an archive in format read from
+// r. If format is empty it is detected from the first bytes of r. Tar
+// archives are read as they stream in, but zip archives keep their directory
+// at the end so have to be spooled to a temporary file in spoolDir first.
+func openArchive(format string, r io.Reader, spoolDir string) (archiveReader, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		format = sniffArchive(br)
+	}
+	switch format {
+	case formatTar:
+		return &tarReader{tr: tar.NewReader(br)}, nil
+	case formatTarGz, "tgz":
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &tarReader{tr: tar.NewReader(gz)}, nil
+	case formatZip:
+		return openZip(br, spoolDir)
+	}
+	return nil, errInvalidArchiveFormat
+}
+
+// sniffArchive guesses an archive's format from its first bytes, defaulting
+// to tar, which has no magic number at the start.
+func sniffArchive(br *bufio.Reader) string {
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return formatZip
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return formatTarGz
+	}
+	return formatTar
+}
+
+type tarReader struct {
+	tr *tar.Reader
+}
+
+func (a *tarReader) next() (string, io.Reader, error) {
+	for {
+		hdr, err := a.tr.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if hdr.FileInfo().Mode().IsRegular() {
+			return hdr.Name, a.tr, nil
+		}
+	}
+}
+
+func (a *tarReader) Close() error {
+	return nil
+}
+
+type zipReader struct {
+	tmp   *os.File
+	files []*zip.File
+	cur   io.ReadCloser
+}
+
+func openZip(r io.Reader, spoolDir string) (*zipReader, error) {
+	tmp, err := ioutil.TempFile(spoolDir, "nd-import-")
+	if err != nil {
+		return nil, err
+	}
+	a := &zipReader{tmp: tmp}
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	a.files = zr.File
+	return a, nil
+}
+
+func (a *zipReader) next() (string, io.Reader, error) {
+	if a.cur != nil {
+		a.cur.Close()
+		a.cur = nil
+	}
+	for len(a.files) > 0 {
+		f := a.files[0]
+		a.files = a.files[1:]
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		a.cur = rc
+		return f.Name, rc, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (a *zipReader) Close() error {
+	if a.cur != nil {
+		a.cur.Close()
+	}
+	a.tmp.Close()
+	return os.Remove(a.tmp.Name())
+}
+
+// archiveName returns the name an object is given in an archive of an
+// object set: the base of its filename, or its OID if it has none. Client
+// supplied filenames can't place entries outside the archive's directory.
+func archiveName(fileName, oid string) string {
+	name := path.Base(strings.Replace(fileName, "\\", "/", -1))
+	switch name {
+	case "", ".", "..", "/":
+		return oid
+	}
+	return name
+}
+
+// uniqueNames renames entries so that no two distinct objects share a name.
+// Of the entries with the same name, the one with the lowest OID keeps it and
+// the others have the start of their OID added before the extension, e.g.
+// "front.png" and "front-6ae8a755.png". The result only depends on the set of
+// entries, not the order they were asked for in. Entries that are the same
+// object under the same name are dropped.
+func uniqueNames(entries []archiveEntry) []archiveEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].name != entries[j].name {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].oid < entries[j].oid
+	})
+
+	taken := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		taken[e.name] = true
+	}
+	var result []archiveEntry
+	for i, e := range entries {
+		if i > 0 && e.name == entries[i-1].name {
+			if e.oid == entries[i-1].oid {
+				continue
+			}
+			e.name = collisionName(e.name, e.oid, taken)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// collisionName adds the start of oid to name, plus a counter in the
+// unlikely case that is taken too.
+func collisionName(name, oid string, taken map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := base + "-" + oid[:8] + ext
+	for n := 2; taken[candidate]; n++ {
+		candidate = fmt.Sprintf("%s-%s-%d%s", base, oid[:8], n, ext)
+	}
+	taken[candidate] = true
+	return candidate
+}
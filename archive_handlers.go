@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNoArchiveObjects = errors.New("No objects to archive")
+	errTooManyObjects   = errors.New("Too many objects to archive")
+	errManifestTooDeep  = errors.New("Manifests are nested too deeply")
+)
+
+// maxArchiveObjects limits the number of OIDs that can be asked for in one
+// archive of an object set, and the number of members, counting those of
+// nested manifests each time they are listed, expanded into the archive of
+// a manifest.
+const maxArchiveObjects = 10000
+
+// maxManifestDepth limits how deeply manifests listed in a manifest are
+// expanded into an archive.
+const maxManifestDepth = 32
+
+// archiveRequest is the body of POST /archive
+type archiveRequest struct {
+	Oids []string `json:"oids"`
+}
+
+// ArchiveHandler streams an archive of a set of objects, named by their
+// filenames. The OIDs are given as repeated "oid" query parameters or, for
+// larger sets, as {"oids": [...]} in the body of a POST. The format is chosen
+// with "?format=" and defaults to zip.
+func (a *App) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	oids := r.URL.Query()["oid"]
+	if r.Method == "POST" {
+		var req archiveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, 400, err)
+			return
+		}
+		oids = append(oids, req.Oids...)
+	}
+	if len(oids) == 0 {
+		writeError(w, r, 400, errNoArchiveObjects)
+		return
+	}
+	if len(oids) > maxArchiveObjects {
+		writeError(w, r, 400, errTooManyObjects)
+		return
+	}
+
+	ms := a.metaStoreFor(r)
+	var entries []archiveEntry
+	var missing []string
+	for _, oid := range oids {
+		if !validOid(oid) {
+			writeError(w, r, 400, errInvalidOid)
+			return
+		}
+		oid = strings.ToLower(oid)
+		meta, _, err := latestMeta(ms, oid)
+		if err != nil || !a.objectStore.Exists(oid) {
+			missing = addTag(missing, oid)
+			continue
+		}
+		entries = append(entries, archiveEntry{name: archiveName(meta.FileName, oid), oid: oid, meta: meta})
+	}
+	if len(missing) > 0 {
+		writeResponseData(w, r, &ResponseData{code: 404, Status: errObjectNotFound.Error(), Missing: missing})
+		return
+	}
+	a.writeArchive(w, r, "objects", uniqueNames(entries))
+}
+
+// ManifestArchiveHandler streams an archive of a manifest's members, named
+// by their paths in the manifest. Manifests listed in the manifest are
+// expanded into directories.
+func (a *App) ManifestArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	ms := a.metaStoreFor(r)
+	var entries []archiveEntry
+	count := 0
+	err := a.manifestEntries(ms, oid, "", 0, &count, &entries)
+	if err == errObjectNotFound || err == errNotManifest {
+		writeError(w, r, 404, err)
+		return
+	}
+	if err == errManifestTooDeep || err == errTooManyObjects {
+		writeError(w, r, 400, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+
+	name := oid
+	if meta, _, err := latestMeta(ms, oid); err == nil && meta.FileName != "" {
+		name = archiveName(meta.FileName, oid)
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	a.writeArchive(w, r, name, uniqueNames(entries))
+}
+
+// manifestEntries appends the members of a manifest to entries, with their
+// paths under prefix. count is the number of members expanded so far. A
+// manifest listed many times is expanded each time, so it is the count, not
+// the depth, that bounds the work done.
+func (a *App) manifestEntries(ms MetaStore, oid, prefix string, depth int, count *int, entries *[]archiveEntry) error {
+	if depth > maxManifestDepth {
+		return errManifestTooDeep
+	}
+	members, err := a.readManifest(ms, oid)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		*count++
+		if *count > maxArchiveObjects {
+			return errTooManyObjects
+		}
+		meta, _, err := latestMeta(ms, m.Oid)
+		if err != nil || !a.objectStore.Exists(m.Oid) {
+			return errObjectNotFound
+		}
+		if meta.ContentType == manifestMediaType {
+			if err := a.manifestEntries(ms, m.Oid, prefix+m.Path+"/", depth+1, count, entries); err != nil {
+				return err
+			}
+			continue
+		}
+		*entries = append(*entries, archiveEntry{name: prefix + m.Path, oid: m.Oid, meta: meta})
+	}
+	return nil
+}
+
+// writeArchive streams entries as an archive in the requested format. Once
+// the first entry has been sent the status can't be changed, so errors after
+// that are only logged, and the archive is left truncated.
+func (a *App) writeArchive(w http.ResponseWriter, r *http.Request, name string, entries []archiveEntry) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatZip
+	}
+	aw, contentType, err := newArchiveWriter(format, w)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if format == "tgz" {
+		format = formatTarGz
+	}
+
+	logRequest(r, 200)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name+"."+format))
+	w.WriteHeader(200)
+	for _, e := range entries {
+		content, err := a.objectStore.Get(e.oid, 0)
+		if err != nil {
+			logger.Log(kv{"fn": "writeArchive", "oid": e.oid, "err": err})
+			return
+		}
+		err = aw.add(e, content)
+		content.Close()
+		if err != nil {
+			logger.Log(kv{"fn": "writeArchive", "oid": e.oid, "err": err})
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		logger.Log(kv{"fn": "writeArchive", "err": err})
+	}
+}
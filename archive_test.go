@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArchiveName(t *testing.T) {
+	for fileName, want := range map[string]string{
+		"front.png":           "front.png",
+		"../../etc/passwd":    "passwd",
+		`C:\Users\me\cad.stp`: "cad.stp",
+		"":                    contentOid,
+		"..":                  contentOid,
+	} {
+		if name := archiveName(fileName, contentOid); name != want {
+			t.Errorf("expected %q to be archived as %q, got: %q", fileName, want, name)
+		}
+	}
+}
+
+func TestUniqueNames(t *testing.T) {
+	a := archiveEntry{name: "front.png", oid: contentOid}
+	b := archiveEntry{name: "front.png", oid: nonExistingOid}
+	c := archiveEntry{name: "back.png", oid: contentOid}
+
+	for _, entries := range [][]archiveEntry{{a, b, c}, {b, c, a, a}} {
+		result := uniqueNames(entries)
+		if len(result) != 3 {
+			t.Fatalf("expected duplicates to be dropped, got: %+v", result)
+		}
+		for i, want := range []string{"back.png", "front.png", "front-f97e1b29.png"} {
+			if result[i].name != want {
+				t.Errorf("expected entry %d to be named %q, got: %+v", i, want, result[i])
+			}
+		}
+	}
+
+	// A renamed entry can't take a name already in use
+	d := archiveEntry{name: "front-f97e1b29.png", oid: nonExistingOid}
+	result := uniqueNames([]archiveEntry{a, b, d})
+	if result[2].name != "front-f97e1b29-2.png" {
+		t.Errorf("expected a counter to be added, got: %+v", result)
+	}
+}
+
+func TestImportPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"images/front.png":   "images/front.png",
+		"./images/front.png": "images/front.png",
+		"/abs/file.txt":      "abs/file.txt",
+		`docs\manual.pdf`:    "docs/manual.pdf",
+		"a//b":               "a/b",
+		"../evil.sh":         "",
+		"a/../../evil.sh":    "",
+	} {
+		p, ok := importPath(name)
+		if ok != (want != "") || p != want && ok {
+			t.Errorf("expected %q to import as %q, got: %q, %v", name, want, p, ok)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	errInvalidAttributes = errors.New("Attributes must be a JSON object of strings, numbers and booleans")
+	errInvalidTag        = errors.New("Invalid tag")
+)
+
+// Attribute types
+const (
+	attrString = "string"
+	attrNumber = "number"
+	attrBool   = "bool"
+)
+
+// maxAttributeName limits the length of attribute names and tags.
+const maxAttributeName = 128
+
+// Attribute is a typed metadata value. In JSON it is written as a plain
+// string, number or boolean, which also gives its Type.
+type Attribute struct {
+	Type   string
+	String string
+	Number float64
+	Bool   bool
+}
+
+func (a Attribute) MarshalJSON() ([]byte, error) {
+	switch a.Type {
+	case attrNumber:
+		return json.Marshal(a.Number)
+	case attrBool:
+		return json.Marshal(a.Bool)
+	}
+	return json.Marshal(a.String)
+}
+
+func (a *Attribute) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*a = Attribute{Type: attrString, String: v}
+	case float64:
+		*a = Attribute{Type: attrNumber, Number: v}
+	case bool:
+		*a = Attribute{Type: attrBool, Bool: v}
+	default:
+		return errInvalidAttributes
+	}
+	return nil
+}
+
+// parseAttributes decodes a JSON object of attributes. Names are case
+// insensitive, like Fields, so they are lower cased.
+func parseAttributes(s string) (map[string]Attribute, error) {
+	var attrs map[string]Attribute
+	if err := json.Unmarshal([]byte(s), &attrs); err != nil {
+		return nil, errInvalidAttributes
+	}
+	return normalizeAttributes(attrs)
+}
+
+func normalizeAttributes(attrs map[string]Attribute) (map[string]Attribute, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]Attribute, len(attrs))
+	for name, a := range attrs {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || len(name) > maxAttributeName {
+			return nil, errInvalidAttributes
+		}
+		result[name] = a
+	}
+	return result, nil
+}
+
+// parseTags splits a comma separated list of tags.
+func parseTags(s string) ([]string, error) {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// normalizeTags trims tags and drops duplicates, keeping the first of each.
+// Empty entries are skipped, but tags may not contain commas.
+func normalizeTags(tags []string) ([]string, error) {
+	var result []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if len(tag) > maxAttributeName || strings.Contains(tag, ",") {
+			return nil, errInvalidTag
+		}
+		result = addTag(result, tag)
+	}
+	return result, nil
+}
+
+// addTag appends tag to tags if it isn't already there.
+func addTag(tags []string, tag string) []string {
+	for _, t := range tags {
+		if t == tag {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAttributeJSON(t *testing.T) {
+	attrs, err := parseAttributes(`{"SKU": "A-1", "Weight": 2.5, "active": true}`)
+	if err != nil {
+		t.Fatalf("expected attributes to parse, got: %s", err)
+	}
+	if attrs["sku"].Type != attrString || attrs["weight"].Type != attrNumber || attrs["active"].Type != attrBool {
+		t.Fatalf("expected attribute types from the JSON values, got: %+v", attrs)
+	}
+
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		t.Fatalf("expected attributes to marshal, got: %s", err)
+	}
+	if string(b) != `{"active":true,"sku":"A-1","weight":2.5}` {
+		t.Fatalf("expected attributes as plain JSON values, got: %s", b)
+	}
+
+	for _, s := range []string{`[]`, `{"a": null}`, `{"a": [1]}`, `{"": 1}`, `not json`} {
+		if _, err := parseAttributes(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" a, b,,a ,c")
+	if err != nil {
+		t.Fatalf("expected tags to parse, got: %s", err)
+	}
+	if len(tags) != 3 || tags[0] != "a" || tags[1] != "b" || tags[2] != "c" {
+		t.Fatalf("expected trimmed, unique tags, got: %v", tags)
+	}
+	if _, err := normalizeTags([]string{"a,b"}); err != errInvalidTag {
+		t.Fatalf("expected a tag with a comma to be rejected, got: %v", err)
+	}
+}
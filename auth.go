@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Token scopes. A token may hold any combination; admin implies the others.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+var (
+	errNoCredentials    = errors.New("No credentials supplied")
+	errBadCredentials   = errors.New("Invalid credentials")
+	errForbidden        = errors.New("Credentials do not allow this request")
+	errInvalidScope     = errors.New("Invalid token scope")
+	errInvalidNamespace = errors.New("Invalid namespace")
+)
+
+// namespacePattern is what a namespace name may look like, both in a URL and
+// in a token's namespace list.
+const namespacePattern = `[a-z0-9][a-z0-9._-]{0,63}`
+
+var namespaceRegexp = regexp.MustCompile(`^` + namespacePattern + `$`)
+
+// Identity is who a request was authenticated as, and what they may do.
+// If Namespaces is set the identity is confined to those namespaces and can't
+// reach the default namespace or anything outside a namespace.
+type Identity struct {
+	Name       string
+	Scopes     []string
+	Namespaces []string
+}
+
+// Can reports whether the identity holds scope.
+func (id *Identity) Can(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// InNamespace reports whether the identity may use namespace ns, where ""
+// is the default namespace.
+func (id *Identity) InNamespace(ns string) bool {
+	if len(id.Namespaces) == 0 {
+		return true
+	}
+	for _, n := range id.Namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator checks the credentials on a request. It returns
+// errNoCredentials if the request carries none of the kind it understands,
+// so that the next Authenticator can be tried, or errBadCredentials if they
+// are present but wrong.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// BasicAuthenticator accepts the admin user over HTTP Basic auth.
+type BasicAuthenticator struct {
+	user string
+	pass string
+}
+
+// NewBasicAuthenticator creates a BasicAuthenticator for the given admin
+// credentials.
+func NewBasicAuthenticator(user, pass string) *BasicAuthenticator {
+	return &BasicAuthenticator{user: user, pass: pass}
+}
+
+func (b *BasicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(b.user)) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(b.pass)) == 1
+	if !userOk || !passOk {
+		return nil, errBadCredentials
+	}
+	return &Identity{Name: user, Scopes: []string{scopeAdmin}}, nil
+}
+
+// TokenAuthenticator accepts API tokens sent as "Authorization: Bearer".
+type TokenAuthenticator struct {
+	tokens TokenStore
+}
+
+// NewTokenAuthenticator creates a TokenAuthenticator that looks tokens up in
+// the given TokenStore.
+func NewTokenAuthenticator(tokens TokenStore) *TokenAuthenticator {
+	return &TokenAuthenticator{tokens: tokens}
+}
+
+func (t *TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return nil, errNoCredentials
+	}
+	token, err := t.tokens.LookupToken(strings.TrimSpace(h[len(prefix):]))
+	if err != nil {
+		return nil, errBadCredentials
+	}
+	return &Identity{Name: "token:" + token.ID, Scopes: token.Scopes, Namespaces: token.Namespaces}, nil
+}
+
+// anonymous is the identity used for every request when no Authenticators
+// are configured.
+var anonymous = &Identity{Name: "anonymous", Scopes: []string{scopeAdmin}}
+
+// authenticate runs the request through each Authenticator in turn.
+func (a *App) authenticate(r *http.Request) (*Identity, error) {
+	if len(a.auth) == 0 {
+		return anonymous, nil
+	}
+	for _, au := range a.auth {
+		id, err := au.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		return id, err
+	}
+	return nil, errNoCredentials
+}
+
+// requireScope wraps a handler so that it only runs for requests that
+// authenticate with the given scope, in the namespace named by the route.
+// The identity is made available to the handler through requestIdentity.
+func (a *App) requireScope(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="nd", Bearer realm="nd"`)
+			writeError(w, r, 401, err)
+			return
+		}
+		if !id.Can(scope) || !id.InNamespace(mux.Vars(r)["namespace"]) {
+			writeError(w, r, 403, errForbidden)
+			return
+		}
+		context.Set(r, "Identity", id)
+		h(w, r)
+	}
+}
+
+// requestIdentity returns the identity the request was authenticated as,
+// or nil if it didn't pass through requireScope.
+func requestIdentity(r *http.Request) *Identity {
+	id, _ := context.Get(r, "Identity").(*Identity)
+	return id
+}
+
+// validScopes reports whether every scope is one the server knows about.
+func validScopes(scopes []string) bool {
+	for _, s := range scopes {
+		switch s {
+		case scopeRead, scopeWrite, scopeAdmin:
+		default:
+			return false
+		}
+	}
+	return len(scopes) > 0
+}
+
+// validNamespaces reports whether every name is a valid namespace.
+func validNamespaces(namespaces []string) bool {
+	for _, ns := range namespaces {
+		if !namespaceRegexp.MatchString(ns) {
+			return false
+		}
+	}
+	return true
+}
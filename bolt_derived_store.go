@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errDerivedNotFound = errors.New("Derived metadata not found")
+	// derivedBucket holds what the extractors learned from each object's
+	// content, keyed by OID. Content is the same in every namespace, so
+	// unlike object meta it isn't kept per namespace.
+	derivedBucket = []byte("derived")
+)
+
+// Derived returns the extractor results recorded for oid.
+func (s *BoltMetaStore) Derived(oid string) (Derived, error) {
+	var d Derived
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(derivedBucket)
+		if bucket == nil {
+			return errDerivedNotFound
+		}
+		v := bucket.Get([]byte(oid))
+		if v == nil {
+			return errDerivedNotFound
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&d)
+	})
+	return d, err
+}
+
+// PutDerived records the results of the extractors in d for oid, replacing
+// any earlier results of the same extractors and keeping those of others.
+func (s *BoltMetaStore) PutDerived(oid string, d Derived) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(derivedBucket)
+		if err != nil {
+			return err
+		}
+		merged := make(Derived)
+		if v := bucket.Get([]byte(oid)); v != nil {
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&merged); err != nil {
+				return err
+			}
+		}
+		for name, fields := range d {
+			merged[name] = fields
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(merged); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(oid), buf.Bytes())
+	})
+}
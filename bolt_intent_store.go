@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// intentsBucket holds the pending write intents, keyed by OID, with the
+// time each was begun. Like derivedBucket it is shared by every namespace.
+var intentsBucket = []byte("intents")
+
+// BeginIntent records that oid is about to be added to the object store.
+// Bolt syncs the database as the transaction commits, so the intent is
+// durable before the object can appear.
+func (s *BoltMetaStore) BeginIntent(oid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(intentsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(oid), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+}
+
+// EndIntent removes the intent for oid, if there is one.
+func (s *BoltMetaStore) EndIntent(oid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return endIntent(tx, oid)
+	})
+}
+
+// Intents returns the OIDs of the pending intents.
+func (s *BoltMetaStore) Intents() ([]string, error) {
+	var oids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(intentsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			oids = append(oids, string(k))
+			return nil
+		})
+	})
+	return oids, err
+}
+
+// endIntent is called by every transaction that commits an object's meta.
+func endIntent(tx *bolt.Tx, oid string) error {
+	bucket := tx.Bucket(intentsBucket)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(oid))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errLockExists = errors.New("Path is already locked")
+	errNotOwner   = errors.New("Attempt to delete other user's lock")
+	// locksBucket holds the Git LFS locks, one nested bucket per namespace
+	// (named as in indexesBucket), keyed by path.
+	locksBucket = []byte("locks")
+)
+
+// AddLocks records locks in the store's namespace. Either all of them are
+// added or, if any of their paths are already locked, none are.
+func (s *BoltMetaStore) AddLocks(locks ...Lock) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := createNestedBucket(tx, locksBucket, s.indexKey())
+		if err != nil {
+			return err
+		}
+		for _, l := range locks {
+			if bucket.Get([]byte(l.Path)) != nil {
+				return errLockExists
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(l); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(l.Path), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Locks returns every lock in the store's namespace, ordered by path.
+func (s *BoltMetaStore) Locks() ([]Lock, error) {
+	locks, _, err := s.FilteredLocks("", "", 0)
+	return locks, err
+}
+
+// FilteredLocks returns the locks in the store's namespace a page at a time,
+// ordered by path, or just the lock on path if it is given. The cursor is the
+// path of the first lock on the next page.
+func (s *BoltMetaStore) FilteredLocks(path, cursor string, limit int) ([]Lock, string, error) {
+	locks := []Lock{}
+	var next string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := nestedBucket(tx, locksBucket, s.indexKey())
+		if bucket == nil {
+			return nil
+		}
+		if path != "" {
+			l, err := decodeLock(bucket.Get([]byte(path)))
+			if l != nil {
+				locks = append(locks, *l)
+			}
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(cursor)); k != nil; k, v = c.Next() {
+			if limit > 0 && len(locks) == limit {
+				next = string(k)
+				break
+			}
+			l, err := decodeLock(v)
+			if err != nil {
+				return err
+			}
+			locks = append(locks, *l)
+		}
+		return nil
+	})
+	return locks, next, err
+}
+
+// DeleteLock removes the lock with the given id, if user owns it or force is
+// set.
+func (s *BoltMetaStore) DeleteLock(user, id string, force bool) (*Lock, error) {
+	var deleted *Lock
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := nestedBucket(tx, locksBucket, s.indexKey())
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			l, err := decodeLock(v)
+			if err != nil {
+				return err
+			}
+			if l.Id != id {
+				continue
+			}
+			if l.Owner.Name != user && !force {
+				return errNotOwner
+			}
+			deleted = l
+			return bucket.Delete(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func decodeLock(v []byte) (*Lock, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	var l Lock
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
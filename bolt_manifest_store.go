@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// manifestAuthor is the author of the annotation that makes an object
+// uploaded as a plain object a manifest.
+const manifestAuthor = "nd"
+
+// manifestsBucket indexes manifests by the objects they list, with one
+// nested bucket per namespace (named as in indexesBucket). Keys are the
+// member's OID followed by the manifest's, so the manifests listing an
+// object are found with a prefix scan.
+var manifestsBucket = []byte("manifests")
+
+// PutManifest records the meta for a manifest, along with the objects it
+// lists, which must all be in the store's namespace. As with Put, a manifest
+// that is already recorded is left alone. An object already recorded with
+// another content type, its bytes having been uploaded as a plain object, is
+// made a manifest by an annotation setting its content type, so its upload
+// record is left as it was.
+func (s *BoltMetaStore) PutManifest(oid string, d *MetaData, entries []ManifestEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(d); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := s.createBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := endIntent(tx, oid); err != nil {
+			return err
+		}
+		var existing *MetaData
+		if v := bucket.Get([]byte(oid)); v != nil {
+			existing = &MetaData{}
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(existing); err != nil {
+				return err
+			}
+			merged, err := s.merged(tx, oid, existing)
+			if err != nil {
+				return err
+			}
+			if merged.ContentType == manifestMediaType {
+				return nil
+			}
+		}
+		for _, e := range entries {
+			if bucket.Get([]byte(e.Oid)) == nil {
+				return errManifestIncomplete
+			}
+		}
+
+		members, err := createNestedBucket(tx, manifestsBucket, s.indexKey())
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := members.Put([]byte(e.Oid+oid), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		if existing != nil {
+			return s.annotate(tx, oid, existing, &Annotation{Author: manifestAuthor, Created: time.Now().Unix(), ContentType: manifestMediaType})
+		}
+		if err := bucket.Put([]byte(oid), buf.Bytes()); err != nil {
+			return err
+		}
+		return s.addToIndexes(tx, oid, d)
+	})
+}
+
+// ReferencedBy returns the OIDs of the manifests in the store's namespace
+// that list oid, in OID order. Only direct members are found: an object in a
+// manifest that is itself listed by another manifest is only referenced by
+// the first.
+func (s *BoltMetaStore) ReferencedBy(oid string) ([]string, error) {
+	var result []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		members := nestedBucket(tx, manifestsBucket, s.indexKey())
+		if members == nil {
+			return nil
+		}
+		prefix := []byte(oid)
+		c := members.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			result = append(result, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return result, err
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"time"
 	
@@ -13,14 +18,32 @@ import (
 // for objects. The storage is handled by boltdb.
 type BoltMetaStore struct {
 	db *bolt.DB
+	ns string
 }
 
 var (
 	errNoBucket       = errors.New("Bucket not found")
 	errObjectNotFound = errors.New("Object not found")
+	errTokenNotFound  = errors.New("Token not found")
 	objectsBucket = []byte("objects")
+	tokensBucket  = []byte("tokens")
+	// namespacesBucket holds one nested bucket of object meta per namespace.
+	// The default namespace keeps using objectsBucket.
+	namespacesBucket = []byte("namespaces")
+	// indexesBucket holds the secondary indexes, one nested bucket per
+	// namespace (see indexKey) and within that one per indexed field.
+	indexesBucket   = []byte("indexes")
+	indexVersionKey = []byte("version")
+	// annotationsBucket holds the annotation history, one nested bucket
+	// per namespace (named as in indexesBucket) and within that one per
+	// object, keyed by sequence number.
+	annotationsBucket = []byte("annotations")
 )
 
+// indexVersion changes whenever the way indexes are kept does, so that
+// databases with older indexes have them rebuilt when opened.
+const indexVersion = "2"
+
 // NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
 func NewBoltMetaStore(dbFile string) (*BoltMetaStore, error) {
 	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
@@ -28,22 +51,221 @@ func NewBoltMetaStore(dbFile string) (*BoltMetaStore, error) {
 		return nil, err
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket(indexesBucket)
+		if indexes == nil || string(indexes.Get(indexVersionKey)) != indexVersion {
+			if err := rebuildIndexes(tx); err != nil {
+				return err
+			}
+		}
 		if _, err := tx.CreateBucketIfNotExists(objectsBucket); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(namespacesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(annotationsBucket); err != nil {
+			return err
+		}
 		return nil
 	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &BoltMetaStore{db: db}, nil
 }
 
+// Namespace returns a view of the store holding only the object meta of the
+// named namespace. The view shares the underlying database, so it must not be
+// closed separately. An empty name is the default namespace.
+func (s *BoltMetaStore) Namespace(name string) MetaStore {
+	return &BoltMetaStore{db: s.db, ns: name}
+}
+
+// bucket returns the objects bucket for the store's namespace, or nil if
+// nothing has been stored in the namespace yet.
+func (s *BoltMetaStore) bucket(tx *bolt.Tx) *bolt.Bucket {
+	if s.ns == "" {
+		return tx.Bucket(objectsBucket)
+	}
+	namespaces := tx.Bucket(namespacesBucket)
+	if namespaces == nil {
+		return nil
+	}
+	return namespaces.Bucket([]byte(s.ns))
+}
+
+// createBucket is bucket for writable transactions, creating the namespace's
+// bucket on first use.
+func (s *BoltMetaStore) createBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if s.ns == "" {
+		return tx.CreateBucketIfNotExists(objectsBucket)
+	}
+	namespaces, err := tx.CreateBucketIfNotExists(namespacesBucket)
+	if err != nil {
+		return nil, err
+	}
+	return namespaces.CreateBucketIfNotExists([]byte(s.ns))
+}
+
+// indexKey names the store's namespace within indexesBucket and
+// annotationsBucket. Bolt bucket names can't be empty, so the default
+// namespace is "/".
+func (s *BoltMetaStore) indexKey() []byte {
+	return []byte("/" + s.ns)
+}
+
+// index returns the named index bucket for the store's namespace, or nil if
+// it hasn't been created yet.
+func (s *BoltMetaStore) index(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	indexes := tx.Bucket(indexesBucket)
+	if indexes == nil {
+		return nil
+	}
+	ns := indexes.Bucket(s.indexKey())
+	if ns == nil {
+		return nil
+	}
+	return ns.Bucket(name)
+}
+
+func (s *BoltMetaStore) createIndex(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	indexes, err := tx.CreateBucketIfNotExists(indexesBucket)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := indexes.CreateBucketIfNotExists(s.indexKey())
+	if err != nil {
+		return nil, err
+	}
+	return ns.CreateBucketIfNotExists(name)
+}
+
+// addToIndexes records an object in each of the namespace's indexes.
+func (s *BoltMetaStore) addToIndexes(tx *bolt.Tx, oid string, d *MetaData) error {
+	for _, field := range indexedFields {
+		index, err := s.createIndex(tx, []byte(field))
+		if err != nil {
+			return err
+		}
+		if err := index.Put(indexEntry(field, oid, d), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndexes moves an object's index entries when its merged meta
+// changes from before to after.
+func (s *BoltMetaStore) updateIndexes(tx *bolt.Tx, oid string, before, after *MetaData) error {
+	for _, field := range indexedFields {
+		old, entry := indexEntry(field, oid, before), indexEntry(field, oid, after)
+		if bytes.Equal(old, entry) {
+			continue
+		}
+		index, err := s.createIndex(tx, []byte(field))
+		if err != nil {
+			return err
+		}
+		if err := index.Delete(old); err != nil {
+			return err
+		}
+		if err := index.Put(entry, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexEntry is the key of an object in the index for field: the encoded
+// field value followed by the OID, with a zero byte between them for the
+// text fields, so objects with the same value are ordered by OID.
+func indexEntry(field, oid string, d *MetaData) []byte {
+	k := fieldValue(field, oid, d)
+	if field == fieldFileName || field == fieldContentType {
+		k = append(k, 0)
+	}
+	return append(k, oid...)
+}
+
+// splitIndexKey returns the encoded field value and OID held in a key of
+// the index for field, or in a key of the objects bucket for fieldOid.
+func splitIndexKey(field string, k []byte) (value []byte, oid string) {
+	switch field {
+	case fieldOid:
+		return k, string(k)
+	case fieldSize, fieldCreated:
+		return k[:8], string(k[8:])
+	}
+	i := bytes.LastIndexByte(k, 0)
+	return k[:i], string(k[i+1:])
+}
+
+// RebuildIndexes discards and rebuilds every secondary index.
+func (s *BoltMetaStore) RebuildIndexes() error {
+	return s.db.Update(rebuildIndexes)
+}
+
+func rebuildIndexes(tx *bolt.Tx) error {
+	if tx.Bucket(indexesBucket) != nil {
+		if err := tx.DeleteBucket(indexesBucket); err != nil {
+			return err
+		}
+	}
+	indexes, err := tx.CreateBucket(indexesBucket)
+	if err != nil {
+		return err
+	}
+	if err := indexes.Put(indexVersionKey, []byte(indexVersion)); err != nil {
+		return err
+	}
+	return indexAll(tx)
+}
+
+// indexAll adds every object in every namespace to the indexes, as of its
+// latest revision.
+func indexAll(tx *bolt.Tx) error {
+	views := []*BoltMetaStore{{}}
+	if namespaces := tx.Bucket(namespacesBucket); namespaces != nil {
+		namespaces.ForEach(func(k, v []byte) error {
+			views = append(views, &BoltMetaStore{ns: string(k)})
+			return nil
+		})
+	}
+	for _, s := range views {
+		bucket := s.bucket(tx)
+		if bucket == nil {
+			continue
+		}
+		err := bucket.ForEach(func(k, v []byte) error {
+			var d MetaData
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&d); err != nil {
+				return err
+			}
+			merged, err := s.merged(tx, string(k), &d)
+			if err != nil {
+				return err
+			}
+			return s.addToIndexes(tx, string(k), merged)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *BoltMetaStore) Get(oid string) (*MetaData, error) {
 	var d MetaData
 	
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
+		bucket := s.bucket(tx)
 		if bucket == nil {
-			return errNoBucket
+			return errObjectNotFound
 		}
 		
 		value := bucket.Get([]byte(oid))
@@ -62,13 +284,10 @@ func (s *BoltMetaStore) Get(oid string) (*MetaData, error) {
 	return &d, nil
 }
 
-// Put writes meta information to the store, keyed by the object oid.
-func (s *BoltMetaStore) Put(oid string, d *MetaData) error {	// Check if it exists first
-	// Check if it exists first
-	if _, err := s.Get(oid); err == nil {
-		return nil
-	}
-	
+// Put writes meta information to the store, keyed by the object oid. Meta
+// that is already stored is left as it is; the check is made in the same
+// transaction as the write, so concurrent Puts of an OID store it once.
+func (s *BoltMetaStore) Put(oid string, d *MetaData) error {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(d)
@@ -77,17 +296,25 @@ func (s *BoltMetaStore) Put(oid string, d *MetaData) error {	// Check if it exis
 	}
 	
 	err = s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
-		if bucket == nil {
-			return errNoBucket
+		bucket, err := s.createBucket(tx)
+		if err != nil {
+			return err
+		}
+		
+		// Check if it exists first
+		if bucket.Get([]byte(oid)) != nil {
+			return endIntent(tx, oid)
 		}
 		
 		err = bucket.Put([]byte(oid), buf.Bytes())
 		if err != nil {
 			return err
 		}
+		if err := endIntent(tx, oid); err != nil {
+			return err
+		}
 	
-		return nil
+		return s.addToIndexes(tx, oid, d)
 	})
 	
 	if err != nil {
@@ -97,7 +324,28 @@ func (s *BoltMetaStore) Put(oid string, d *MetaData) error {	// Check if it exis
 	return nil
 }
 
-// Close closes the underlying boltdb.
+// Namespaces returns the names of the namespaces objects have been stored
+// in, not counting the default namespace.
+func (s *BoltMetaStore) Namespaces() ([]string, error) {
+	var names []string
+	
+	err := s.db.View(func(tx *bolt.Tx) error {
+		namespaces := tx.Bucket(namespacesBucket)
+		if namespaces == nil {
+			return nil
+		}
+		return namespaces.ForEach(func(k, v []byte) error {
+			if v == nil {
+				names = append(names, string(k))
+			}
+			return nil
+		})
+	})
+	
+	return names, err
+}
+
+// Close closes the underlying boltdb, including for any Namespace views.
 func (s *BoltMetaStore) Close() {
 	s.db.Close()
 }
@@ -107,9 +355,9 @@ func (s *BoltMetaStore) Keys() ([]string, error) {
 	var keys []string
 	
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
+		bucket := s.bucket(tx)
 		if bucket == nil {
-			return errNoBucket
+			return nil
 		}
 		bucket.ForEach(func(k, v []byte) error {
 			keys = append(keys, string(k))
@@ -120,3 +368,330 @@ func (s *BoltMetaStore) Keys() ([]string, error) {
 	
 	return keys, err
 }
+
+// Iterate calls fn with each object in the store's namespace, in the order
+// of the given field, until fn returns false. See Query.
+func (s *BoltMetaStore) Iterate(order, after string, fn func(cursor, oid string, d *MetaData) bool) error {
+	return s.Query(order, nil, after, fn)
+}
+
+// Query calls fn with the latest revision of the meta of each object in the
+// store's namespace that passes every filter, in the order of the given
+// field, until fn returns false. Only one
+// object is held in memory at a time. Iteration starts after the object the
+// cursor was given for, or at the beginning if after is empty. fn is called
+// within a read transaction so it must not write to the store.
+//
+// The objects are read through the index of the order field, so filters on
+// that field only scan the matching range. Other filters are checked against
+// each object in turn.
+func (s *BoltMetaStore) Query(order string, filters []MetaFilter, after string, fn func(cursor, oid string, d *MetaData) bool) error {
+	from, err := base64.RawURLEncoding.DecodeString(after)
+	if err != nil {
+		return errInvalidCursor
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		objects := s.bucket(tx)
+		if objects == nil {
+			return nil
+		}
+
+		var c *bolt.Cursor
+		switch order {
+		case fieldOid:
+			c = objects.Cursor()
+		case fieldFileName, fieldContentType, fieldSize, fieldCreated:
+			index := s.index(tx, []byte(order))
+			if index == nil {
+				return nil
+			}
+			c = index.Cursor()
+		default:
+			return errInvalidOrder
+		}
+
+		// Seek to the lowest value the filters on the order field allow
+		var start []byte
+		for _, f := range filters {
+			if f.Field == order && f.Op != opLt && f.Op != opLe && bytes.Compare(f.Value, start) > 0 {
+				start = f.Value
+			}
+		}
+		if bytes.Compare(from, start) > 0 {
+			start = from
+		}
+
+		k, v := c.First()
+		if len(start) > 0 {
+			k, v = c.Seek(start)
+		}
+		if len(from) > 0 && bytes.Equal(k, from) {
+			k, v = c.Next()
+		}
+
+	scan:
+		for ; k != nil; k, v = c.Next() {
+			value, oid := splitIndexKey(order, k)
+			for _, f := range filters {
+				if f.Field != order {
+					continue
+				}
+				ok, more := f.match(value)
+				if !more {
+					break scan
+				}
+				if !ok {
+					continue scan
+				}
+			}
+
+			if order != fieldOid {
+				v = objects.Get([]byte(oid))
+			}
+			var d MetaData
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&d); err != nil {
+				return err
+			}
+			merged, err := s.merged(tx, oid, &d)
+			if err != nil {
+				return err
+			}
+			for _, f := range filters {
+				if f.Field == order {
+					continue
+				}
+				if ok, _ := f.match(fieldValue(f.Field, oid, merged)); !ok {
+					continue scan
+				}
+			}
+
+			if !fn(base64.RawURLEncoding.EncodeToString(k), oid, merged) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Annotate appends an annotation to the history of an object in the store's
+// namespace, numbering it as the next revision. Existing annotations, and
+// the object's uploaded meta, are never changed.
+func (s *BoltMetaStore) Annotate(oid string, a *Annotation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		objects := s.bucket(tx)
+		if objects == nil {
+			return errObjectNotFound
+		}
+		value := objects.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+		var d MetaData
+		if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&d); err != nil {
+			return err
+		}
+		return s.annotate(tx, oid, &d, a)
+	})
+}
+
+// annotate appends a to the history of oid, whose uploaded meta is d, and
+// updates the indexes.
+func (s *BoltMetaStore) annotate(tx *bolt.Tx, oid string, d *MetaData, a *Annotation) error {
+	before, err := s.merged(tx, oid, d)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := tx.CreateBucketIfNotExists(annotationsBucket)
+	if err != nil {
+		return err
+	}
+	ns, err := annotations.CreateBucketIfNotExists(s.indexKey())
+	if err != nil {
+		return err
+	}
+	history, err := ns.CreateBucketIfNotExists([]byte(oid))
+	if err != nil {
+		return err
+	}
+
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	a.Revision = int(seq)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(a); err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := history.Put(key, buf.Bytes()); err != nil {
+		return err
+	}
+
+	return s.updateIndexes(tx, oid, before, a.apply(before))
+}
+
+// Annotations returns the annotation history of an object in the store's
+// namespace, oldest first.
+func (s *BoltMetaStore) Annotations(oid string) ([]*Annotation, error) {
+	var result []*Annotation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = s.history(tx, oid)
+		return err
+	})
+	return result, err
+}
+
+func (s *BoltMetaStore) history(tx *bolt.Tx, oid string) ([]*Annotation, error) {
+	annotations := tx.Bucket(annotationsBucket)
+	if annotations == nil {
+		return nil, nil
+	}
+	ns := annotations.Bucket(s.indexKey())
+	if ns == nil {
+		return nil, nil
+	}
+	history := ns.Bucket([]byte(oid))
+	if history == nil {
+		return nil, nil
+	}
+
+	var result []*Annotation
+	err := history.ForEach(func(k, v []byte) error {
+		var a Annotation
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&a); err != nil {
+			return err
+		}
+		result = append(result, &a)
+		return nil
+	})
+	return result, err
+}
+
+// merged returns the latest revision of an object's meta.
+func (s *BoltMetaStore) merged(tx *bolt.Tx, oid string, d *MetaData) (*MetaData, error) {
+	history, err := s.history(tx, oid)
+	if err != nil {
+		return nil, err
+	}
+	return mergeRevisions(d, history, len(history)), nil
+}
+
+// CreateToken generates a new API token with the given scopes, restricted to
+// the given namespaces if there are any. The secret is returned to the caller
+// once; only its SHA-256 is kept, as the key in the tokens bucket. The ID is
+// drawn separately, as it is shown to anyone listing tokens.
+func (s *BoltMetaStore) CreateToken(name, createdBy string, scopes, namespaces []string) (*Token, string, error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	t := &Token{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		Scopes:     scopes,
+		Namespaces: namespaces,
+		CreatedBy:  createdBy,
+		Created:    time.Now().Unix(),
+	}
+	secret := "nd_" + hex.EncodeToString(b)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+		return nil, "", err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.Put(tokenKey(secret), buf.Bytes())
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return t, secret, nil
+}
+
+// LookupToken returns the token for a secret.
+func (s *BoltMetaStore) LookupToken(secret string) (*Token, error) {
+	var t Token
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get(tokenKey(secret))
+		if len(value) == 0 {
+			return errTokenNotFound
+		}
+		return gob.NewDecoder(bytes.NewBuffer(value)).Decode(&t)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Tokens returns every token in the store.
+func (s *BoltMetaStore) Tokens() ([]*Token, error) {
+	var tokens []*Token
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var t Token
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&t); err != nil {
+				return err
+			}
+			tokens = append(tokens, &t)
+			return nil
+		})
+	})
+
+	return tokens, err
+}
+
+// RevokeToken deletes the token with the given ID.
+func (s *BoltMetaStore) RevokeToken(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		// Tokens are keyed by secret hash, so finding one by ID means a
+		// scan. There are only ever a handful of them.
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var t Token
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&t); err != nil {
+				return err
+			}
+			if t.ID == id {
+				return c.Delete()
+			}
+		}
+		return errTokenNotFound
+	})
+}
+
+func tokenKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return []byte(hex.EncodeToString(sum[:]))
+}
@@ -1,31 +1,36 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var (
-	metaStoreTest *MetaStore
+	metaStoreTest *BoltMetaStore
 )
 
 func TestGetMeta(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	meta, err := metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	meta, err := metaStoreTest.Get(contentOid)
 	if err != nil {
 		t.Fatalf("Error retreiving meta: %s", err)
 	}
 
-	if meta.Oid != contentOid {
-		t.Errorf("expected to get content oid, got: %s", meta.Oid)
+	if meta.FileName != "content.txt" {
+		t.Errorf("expected to get content filename, got: %s", meta.FileName)
 	}
 
-	if meta.Size != contentSize {
-		t.Errorf("expected to get content size, got: %d", meta.Size)
+	if meta.Length != contentSize {
+		t.Errorf("expected to get content size, got: %d", meta.Length)
 	}
 }
 
@@ -33,35 +38,421 @@ func TestPutMeta(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	meta, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42})
+	err := metaStoreTest.Put(nonExistingOid, &MetaData{FileName: "new.bin", Length: 42})
 	if err != nil {
 		t.Errorf("expected put to succeed, got : %s", err)
 	}
 
-	if meta.Existing {
-		t.Errorf("expected meta to not have existed")
+	meta, err := metaStoreTest.Get(nonExistingOid)
+	if err != nil {
+		t.Errorf("expected to be able to retreive new put, got : %s", err)
+	}
+
+	if meta.FileName != "new.bin" {
+		t.Errorf("expected filenames to match, got: %s", meta.FileName)
+	}
+
+	if meta.Length != 42 {
+		t.Errorf("expected sizes to match, got: %d", meta.Length)
+	}
+
+	// Objects are immutable, a second put must not replace the first
+	err = metaStoreTest.Put(nonExistingOid, &MetaData{FileName: "other.bin", Length: 43})
+	if err != nil {
+		t.Errorf("expected put to succeed, got : %s", err)
 	}
 
-	meta, err = metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	meta, err = metaStoreTest.Get(nonExistingOid)
 	if err != nil {
 		t.Errorf("expected to be able to retreive new put, got : %s", err)
 	}
 
-	if meta.Oid != nonExistingOid {
-		t.Errorf("expected oids to match, got: %s", meta.Oid)
+	if meta.Length != 42 {
+		t.Errorf("expected original meta to be kept, got size: %d", meta.Length)
+	}
+}
+
+func TestNamespaceMeta(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	alpha := metaStoreTest.Namespace("alpha")
+	if _, err := alpha.Get(contentOid); err != errObjectNotFound {
+		t.Errorf("expected default namespace meta to be hidden, got : %v", err)
+	}
+	if keys, err := alpha.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("expected an unused namespace to be empty, got : %v, %v", keys, err)
+	}
+
+	if err := alpha.Put(nonExistingOid, &MetaData{FileName: "alpha.bin", Length: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	meta, err := metaStoreTest.Namespace("alpha").Get(nonExistingOid)
+	if err != nil || meta.FileName != "alpha.bin" {
+		t.Errorf("expected to retreive meta from the namespace, got : %+v, %v", meta, err)
+	}
+
+	if _, err := metaStoreTest.Get(nonExistingOid); err != errObjectNotFound {
+		t.Errorf("expected namespace meta to be hidden from the default namespace, got : %v", err)
+	}
+	if _, err := metaStoreTest.Namespace("beta").Get(nonExistingOid); err != errObjectNotFound {
+		t.Errorf("expected namespace meta to be hidden from other namespaces, got : %v", err)
+	}
+	if keys, _ := metaStoreTest.Keys(); len(keys) != 1 || keys[0] != contentOid {
+		t.Errorf("expected default listing to be unchanged, got : %v", keys)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			metaStoreTest.Put(nonExistingOid, &MetaData{FileName: "racy.txt", Length: 1, Created: int64(1000 + i)})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, order := range []string{fieldFileName, fieldCreated} {
+		n := 0
+		metaStoreTest.Iterate(order, "", func(cursor, oid string, d *MetaData) bool {
+			if oid == nonExistingOid {
+				n++
+			}
+			return true
+		})
+		if n != 1 {
+			t.Errorf("order %q: expected the object to be listed once, got %d", order, n)
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	ms := metaStoreTest.Namespace("iterate")
+	oids := []string{
+		"3333333333333333333333333333333333333333333333333333333333333333",
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	for i, oid := range oids {
+		if err := ms.Put(oid, &MetaData{FileName: oid[:1], Created: int64(100 + i)}); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+	}
+
+	for order, want := range map[string][]string{
+		fieldOid:     {oids[1], oids[2], oids[0]},
+		fieldCreated: oids,
+	} {
+		var got []string
+		after := ""
+		// One at a time, resuming from the cursor each time
+		for {
+			n := 0
+			err := ms.Iterate(order, after, func(cursor, oid string, d *MetaData) bool {
+				if d.FileName != oid[:1] {
+					t.Errorf("expected meta for %s, got : %+v", oid, d)
+				}
+				got = append(got, oid)
+				after = cursor
+				n++
+				return false
+			})
+			if err != nil {
+				t.Fatalf("expected iterate to succeed, got : %s", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expected %s order %v, got : %v", order, want, got)
+		}
+	}
+
+	if err := ms.Iterate("colour", "", func(string, string, *MetaData) bool { return true }); err != errInvalidOrder {
+		t.Errorf("expected errInvalidOrder, got : %v", err)
+	}
+	if err := ms.Iterate(fieldOid, "!", func(string, string, *MetaData) bool { return true }); err != errInvalidCursor {
+		t.Errorf("expected errInvalidCursor, got : %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	ms := metaStoreTest.Namespace("query")
+	objects := map[string]*MetaData{
+		"1111111111111111111111111111111111111111111111111111111111111111": {FileName: "report-2018.pdf", ContentType: "application/pdf", Length: 300, Created: 200},
+		"2222222222222222222222222222222222222222222222222222222222222222": {FileName: "report-2017.pdf", ContentType: "application/pdf", Length: 100, Created: 100},
+		"3333333333333333333333333333333333333333333333333333333333333333": {FileName: "report.txt", ContentType: "text/plain", Length: 200, Created: 300},
+		"4444444444444444444444444444444444444444444444444444444444444444": {FileName: "notes.txt", ContentType: "text/plain", Length: 100, Created: 400},
+	}
+	for oid, d := range objects {
+		if err := ms.Put(oid, d); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
 	}
 
-	if meta.Size != 42 {
-		t.Errorf("expected sizes to match, got: %d", meta.Size)
+	filter := func(field, op, value string) MetaFilter {
+		f, err := newMetaFilter(field, op, value)
+		if err != nil {
+			t.Fatalf("expected filter %s%s%s to be valid, got : %s", field, op, value, err)
+		}
+		return f
+	}
+
+	for _, c := range []struct {
+		order   string
+		filters []MetaFilter
+		want    string
+	}{
+		{fieldFileName, nil, "4213"},
+		{fieldFileName, []MetaFilter{filter(fieldFileName, opPrefix, "report-")}, "21"},
+		{fieldFileName, []MetaFilter{filter(fieldFileName, opEq, "report.txt")}, "3"},
+		{fieldFileName, []MetaFilter{filter(fieldFileName, opGt, "report-2017.pdf")}, "13"},
+		{fieldContentType, []MetaFilter{filter(fieldContentType, opEq, "text/plain")}, "34"},
+		{fieldSize, []MetaFilter{filter(fieldSize, opLe, "200")}, "243"},
+		{fieldSize, []MetaFilter{filter(fieldSize, opGe, "150"), filter(fieldSize, opLt, "300")}, "3"},
+		{fieldCreated, []MetaFilter{filter(fieldCreated, opGe, "200")}, "134"},
+		{fieldCreated, []MetaFilter{filter(fieldContentType, opEq, "application/pdf")}, "21"},
+		{fieldOid, []MetaFilter{filter(fieldContentType, opEq, "text/plain"), filter(fieldSize, opEq, "100")}, "4"},
+		{fieldSize, []MetaFilter{filter(fieldFileName, opPrefix, "nothing")}, ""},
+	} {
+		got := ""
+		err := ms.Query(c.order, c.filters, "", func(cursor, oid string, d *MetaData) bool {
+			got += oid[:1]
+			return true
+		})
+		if err != nil {
+			t.Fatalf("expected query to succeed, got : %s", err)
+		}
+		if got != c.want {
+			t.Errorf("expected %s ordered query %+v to return %s, got : %s", c.order, c.filters, c.want, got)
+		}
 	}
+}
 
-	meta, err = metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42})
+func TestIndexUpgrade(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// Simulate a database with indexes in an older format
+	metaStoreTest.db.Update(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket(indexesBucket)
+		indexes.Put(indexVersionKey, []byte("1"))
+		return indexes.DeleteBucket(metaStoreTest.indexKey())
+	})
+	metaStoreTest.Close()
+
+	store, err := NewBoltMetaStore("test-meta-store.db")
 	if err != nil {
-		t.Errorf("expected put to succeed, got : %s", err)
+		t.Fatalf("expected reopening to succeed, got : %s", err)
 	}
+	metaStoreTest = store
+
+	f, _ := newMetaFilter(fieldFileName, opEq, "content.txt")
+	var got []string
+	metaStoreTest.Query(fieldFileName, []MetaFilter{f}, "", func(cursor, oid string, d *MetaData) bool {
+		got = append(got, oid)
+		return true
+	})
+	if len(got) != 1 || got[0] != contentOid {
+		t.Errorf("expected existing objects to be indexed, got : %v", got)
+	}
+}
 
-	if !meta.Existing {
-		t.Errorf("expected meta to now exist")
+func TestAnnotate(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.Annotate(nonExistingOid, &Annotation{AddTags: []string{"a"}}); err != errObjectNotFound {
+		t.Errorf("expected annotating a missing object to fail, got : %v", err)
+	}
+
+	for _, tag := range []string{"first", "second"} {
+		if err := metaStoreTest.Annotate(contentOid, &Annotation{Author: testUser, AddTags: []string{tag}}); err != nil {
+			t.Fatalf("expected annotate to succeed, got : %s", err)
+		}
+	}
+
+	history, err := metaStoreTest.Annotations(contentOid)
+	if err != nil {
+		t.Fatalf("expected annotations to be read, got : %s", err)
+	}
+	if len(history) != 2 || history[0].AddTags[0] != "first" || history[1].AddTags[0] != "second" {
+		t.Errorf("expected annotations in the order they were made, got : %+v", history)
+	}
+
+	if history, _ := metaStoreTest.Namespace("other").Annotations(contentOid); len(history) != 0 {
+		t.Errorf("expected annotations to be kept per namespace, got : %+v", history)
+	}
+
+	// A corrected filename moves the object in the filename index
+	if err := metaStoreTest.Annotate(contentOid, &Annotation{FileName: "renamed.txt"}); err != nil {
+		t.Fatalf("expected annotate to succeed, got : %s", err)
+	}
+	for name, want := range map[string]int{"content.txt": 0, "renamed.txt": 1} {
+		f, _ := newMetaFilter(fieldFileName, opEq, name)
+		n := 0
+		metaStoreTest.Query(fieldFileName, []MetaFilter{f}, "", func(cursor, oid string, d *MetaData) bool {
+			if d.FileName != "renamed.txt" {
+				t.Errorf("expected query to return the latest revision, got : %+v", d)
+			}
+			n++
+			return true
+		})
+		if n != want {
+			t.Errorf("expected %d objects named %s, got : %d", want, name, n)
+		}
+	}
+	if meta, _ := metaStoreTest.Get(contentOid); meta.FileName != "content.txt" {
+		t.Errorf("expected uploaded meta to be unchanged, got : %+v", meta)
+	}
+}
+
+func TestRefStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	none := func(*Ref) error { return nil }
+	if _, err := metaStoreTest.UpdateRef("latest", nonExistingOid, testUser, none); err != errObjectNotFound {
+		t.Errorf("expected a ref to a missing object to fail, got : %v", err)
+	}
+
+	ref, err := metaStoreTest.UpdateRef("release/latest", contentOid, testUser, none)
+	if err != nil {
+		t.Fatalf("expected update to succeed, got : %s", err)
+	}
+	if ref.Oid != contentOid || ref.Revision != 1 || ref.UpdatedBy != testUser {
+		t.Errorf("expected the new ref, got : %+v", ref)
+	}
+
+	// Setting the same target again doesn't add to the reflog
+	if ref, err = metaStoreTest.UpdateRef("release/latest", contentOid, testUser, none); err != nil || ref.Revision != 1 {
+		t.Errorf("expected a no-op update, got : %+v, %v", ref, err)
+	}
+
+	conflict := func(*Ref) error { return errRefChanged }
+	if _, err := metaStoreTest.UpdateRef("release/latest", "", testUser, conflict); err != errRefChanged {
+		t.Errorf("expected a failed check to stop the update, got : %v", err)
+	}
+	if _, err := metaStoreTest.UpdateRef("release/latest", "", testUser, none); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.Ref("release/latest"); err != errRefNotFound {
+		t.Errorf("expected the ref to be gone, got : %v", err)
+	}
+	if _, err := metaStoreTest.UpdateRef("release/latest", "", testUser, none); err != errRefNotFound {
+		t.Errorf("expected a second delete to fail, got : %v", err)
+	}
+
+	reflog, err := metaStoreTest.RefLog("release/latest")
+	if err != nil {
+		t.Fatalf("expected the reflog to outlive the ref, got : %s", err)
+	}
+	if len(reflog) != 2 || reflog[0].New != contentOid || reflog[1].Old != contentOid || reflog[1].New != "" {
+		t.Errorf("expected a create and a delete in the reflog, got : %+v", reflog)
+	}
+
+	if refs, _ := metaStoreTest.Namespace("other").Refs(); len(refs) != 0 {
+		t.Errorf("expected refs to be kept per namespace, got : %+v", refs)
+	}
+	if _, err := metaStoreTest.Namespace("other").UpdateRef("latest", contentOid, testUser, none); err != errObjectNotFound {
+		t.Errorf("expected refs to only point within their namespace, got : %v", err)
+	}
+}
+
+func TestManifestStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	const manifestOid = "b0a2e81e4c0a0b2bd7e3e6b3d3f4ee1a7e2f1b3c4d5e6f708192a3b4c5d6e7f8"
+	meta := &MetaData{ContentType: manifestMediaType, Length: 100}
+	entries := []ManifestEntry{{Path: "a.txt", Oid: contentOid}, {Path: "b.txt", Oid: nonExistingOid}}
+	if err := metaStoreTest.PutManifest(manifestOid, meta, entries); err != errManifestIncomplete {
+		t.Fatalf("expected a manifest of missing objects to be refused, got : %v", err)
+	}
+	if _, err := metaStoreTest.Get(manifestOid); err == nil {
+		t.Fatalf("expected the refused manifest not to be recorded")
+	}
+
+	if err := metaStoreTest.PutManifest(manifestOid, meta, entries[:1]); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if d, err := metaStoreTest.Get(manifestOid); err != nil || d.ContentType != manifestMediaType {
+		t.Errorf("expected the manifest's meta to be recorded, got : %+v, %v", d, err)
+	}
+	manifests, err := metaStoreTest.ReferencedBy(contentOid)
+	if err != nil || len(manifests) != 1 || manifests[0] != manifestOid {
+		t.Errorf("expected the object to be referenced by the manifest, got : %v, %v", manifests, err)
+	}
+	if manifests, _ := metaStoreTest.ReferencedBy(nonExistingOid); len(manifests) != 0 {
+		t.Errorf("expected no manifests for another object, got : %v", manifests)
+	}
+	if manifests, _ := metaStoreTest.Namespace("other").ReferencedBy(contentOid); len(manifests) != 0 {
+		t.Errorf("expected manifests to be kept per namespace, got : %v", manifests)
+	}
+}
+
+func TestRenditionStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	const renditionOid = "c1a2e81e4c0a0b2bd7e3e6b3d3f4ee1a7e2f1b3c4d5e6f708192a3b4c5d6e7f8"
+	const spec = "w=256,fmt=jpeg,q=85"
+	meta := &MetaData{ContentType: "image/jpeg", Length: 100}
+	if err := metaStoreTest.PutRendition(nonExistingOid, spec, renditionOid, meta); err != errObjectNotFound {
+		t.Fatalf("expected a rendition of a missing object to be refused, got : %v", err)
+	}
+
+	if _, err := metaStoreTest.Rendition(contentOid, spec); err != errRenditionNotFound {
+		t.Fatalf("expected errRenditionNotFound, got : %v", err)
+	}
+	if err := metaStoreTest.PutRendition(contentOid, spec, renditionOid, meta); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if rid, err := metaStoreTest.Rendition(contentOid, spec); err != nil || rid != renditionOid {
+		t.Errorf("expected the rendition to be linked, got : %s, %v", rid, err)
+	}
+	if d, err := metaStoreTest.Get(renditionOid); err != nil || d.ContentType != "image/jpeg" {
+		t.Errorf("expected the rendition's meta to be recorded, got : %+v, %v", d, err)
+	}
+	if _, err := metaStoreTest.Rendition(contentOid, "w=128,fmt=jpeg,q=85"); err != errRenditionNotFound {
+		t.Errorf("expected renditions to be kept per spec, got : %v", err)
+	}
+	if _, err := metaStoreTest.Namespace("other").Rendition(contentOid, spec); err != errRenditionNotFound {
+		t.Errorf("expected renditions to be kept per namespace, got : %v", err)
+	}
+}
+
+func TestDerivedStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.Derived(contentOid); err != errDerivedNotFound {
+		t.Fatalf("expected errDerivedNotFound, got : %v", err)
+	}
+	if err := metaStoreTest.PutDerived(contentOid, Derived{"text": {"encoding": "utf-8"}, "zip": {"error": "not a zip"}}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if err := metaStoreTest.PutDerived(contentOid, Derived{"zip": {"files": "0"}}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	d, err := metaStoreTest.Derived(contentOid)
+	if err != nil || d["text"]["encoding"] != "utf-8" || d["zip"]["files"] != "0" || d["zip"]["error"] != "" {
+		t.Errorf("expected results to be merged by extractor, got : %v, %v", d, err)
 	}
 }
 
@@ -69,36 +460,41 @@ func TestLocks(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	for i := 0; i < 5; i++ {
 		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
-		if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		if err := repo.AddLocks(lock); err != nil {
 			t.Errorf("expected AddLocks to succeed, got : %s", err)
 		}
 	}
 
-	locks, err := metaStoreTest.Locks(testRepo)
+	locks, err := repo.Locks()
 	if err != nil {
 		t.Errorf("expected Locks to succeed, got : %s", err)
 	}
 	if len(locks) != 5 {
 		t.Errorf("expected returned lock count to match, got: %d", len(locks))
 	}
+	if locks, _ := metaStoreTest.Locks(); len(locks) != 0 {
+		t.Errorf("expected locks to be kept per namespace, got: %d", len(locks))
+	}
 }
 
 func TestFilteredLocks(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	testLocks := make([]Lock, 0, 5)
 	for i := 0; i < 5; i++ {
 		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
 		testLocks = append(testLocks, lock)
 	}
-	if err := metaStoreTest.AddLocks(testRepo, testLocks...); err != nil {
+	if err := repo.AddLocks(testLocks...); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	locks, next, err := metaStoreTest.FilteredLocks(testRepo, "", "", "3")
+	locks, next, err := repo.FilteredLocks("", "", 3)
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
@@ -109,7 +505,7 @@ func TestFilteredLocks(t *testing.T) {
 		t.Errorf("expected next to exist")
 	}
 
-	locks, next, err = metaStoreTest.FilteredLocks(testRepo, "", next, "2")
+	locks, next, err = repo.FilteredLocks("", next, 2)
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
@@ -125,20 +521,25 @@ func TestAddLocks(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+	if err := repo.AddLocks(lock); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	locks, _, err := metaStoreTest.FilteredLocks(testRepo, lock.Path, "", "1")
+	locks, _, err := repo.FilteredLocks(lock.Path, "", 1)
 	if err != nil {
 		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
 	}
 	if len(locks) != 1 {
-		t.Errorf("expected lock to be existed")
+		t.Fatalf("expected lock to be existed")
 	}
 	if locks[0].Id != lockId {
-		t.Errorf("expected lockId to match, got: %s", locks[0])
+		t.Errorf("expected lockId to match, got: %v", locks[0])
+	}
+
+	if err := repo.AddLocks(NewTestLock(randomLockId(), lockPath, testUser1)); err != errLockExists {
+		t.Errorf("expected a second lock on the path to fail, got : %v", err)
 	}
 }
 
@@ -146,17 +547,18 @@ func TestDeleteLock(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+	if err := repo.AddLocks(lock); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, lock.Id, false)
+	deleted, err := repo.DeleteLock(testUser, lock.Id, false)
 	if err != nil {
 		t.Errorf("expected DeleteLock to succeed, got : %s", err)
 	}
 	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
 	}
 }
 
@@ -164,12 +566,13 @@ func TestDeleteLockNotOwner(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+	if err := repo.AddLocks(lock); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, false)
+	deleted, err := repo.DeleteLock(testUser1, lock.Id, false)
 	if err == nil || deleted != nil {
 		t.Errorf("expected DeleteLock to failed")
 	}
@@ -183,17 +586,18 @@ func TestDeleteLockNotOwnerForce(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+	if err := repo.AddLocks(lock); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, true)
+	deleted, err := repo.DeleteLock(testUser1, lock.Id, true)
 	if err != nil {
 		t.Errorf("expected DeleteLock(force) to succeed, got : %s", err)
 	}
 	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
 	}
 }
 
@@ -201,17 +605,18 @@ func TestDeleteLockNonExisting(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
+	repo := metaStoreTest.Namespace(testRepo)
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+	if err := repo.AddLocks(lock); err != nil {
 		t.Errorf("expected AddLocks to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, nonExistingLockId, false)
+	deleted, err := repo.DeleteLock(testUser, nonExistingLockId, false)
 	if err != nil {
 		t.Errorf("expected DeleteLock to succeed, got : %s", err)
 	}
 	if deleted != nil {
-		t.Errorf("expected nil returned, got : %s", deleted)
+		t.Errorf("expected nil returned, got : %v", deleted)
 	}
 }
 
@@ -226,22 +631,59 @@ func NewTestLock(id, path, user string) Lock {
 	}
 }
 
+func randomLockId() string {
+	var id [20]byte
+	rand.Read(id[:])
+	return fmt.Sprintf("%x", id[:])
+}
+
+func TestTokenStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	token, secret, err := metaStoreTest.CreateToken("ci", testUser, []string{scopeRead, scopeWrite}, nil)
+	if err != nil {
+		t.Fatalf("expected create to succeed, got : %s", err)
+	}
+	// The ID is listed openly, so it must give away nothing of the secret
+	if strings.Contains(secret, token.ID) {
+		t.Errorf("expected the token ID not to be part of the secret, got %s in %s", token.ID, secret)
+	}
+
+	found, err := metaStoreTest.LookupToken(secret)
+	if err != nil {
+		t.Fatalf("expected lookup to succeed, got : %s", err)
+	}
+	if found.ID != token.ID || len(found.Scopes) != 2 {
+		t.Errorf("expected to find the new token, got: %+v", found)
+	}
+
+	if _, err := metaStoreTest.LookupToken(secret + "x"); err != errTokenNotFound {
+		t.Errorf("expected errTokenNotFound for a bad secret, got : %v", err)
+	}
+
+	if err := metaStoreTest.RevokeToken(token.ID); err != nil {
+		t.Fatalf("expected revoke to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.LookupToken(secret); err != errTokenNotFound {
+		t.Errorf("expected revoked token to be gone, got : %v", err)
+	}
+	if err := metaStoreTest.RevokeToken(token.ID); err != errTokenNotFound {
+		t.Errorf("expected second revoke to fail, got : %v", err)
+	}
+}
+
 func setupMeta() {
-	store, err := NewMetaStore("test-meta-store.db")
+	store, err := NewBoltMetaStore("test-meta-store.db")
 	if err != nil {
 		fmt.Printf("error initializing test meta store: %s\n", err)
 		os.Exit(1)
 	}
 
 	metaStoreTest = store
-	if err := metaStoreTest.AddUser(testUser, testPass); err != nil {
-		teardownMeta()
-		fmt.Printf("error adding test user to meta store: %s\n", err)
-		os.Exit(1)
-	}
 
-	rv := &RequestVars{Oid: contentOid, Size: contentSize}
-	if _, err := metaStoreTest.Put(rv); err != nil {
+	meta := &MetaData{FileName: "content.txt", Length: contentSize}
+	if err := metaStoreTest.Put(contentOid, meta); err != nil {
 		teardownMeta()
 		fmt.Printf("error seeding test meta store: %s\n", err)
 		os.Exit(1)
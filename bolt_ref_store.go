@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errRefNotFound = errors.New("Ref not found")
+	// refsBucket holds the current state of each ref, and reflogBucket
+	// every update made to them. Both have one nested bucket per namespace,
+	// named as in indexesBucket; reflogBucket then has one per ref, keyed
+	// by revision.
+	refsBucket   = []byte("refs")
+	reflogBucket = []byte("reflog")
+)
+
+// Ref returns the named ref in the store's namespace.
+func (s *BoltMetaStore) Ref(name string) (*Ref, error) {
+	var ref *Ref
+	err := s.db.View(func(tx *bolt.Tx) error {
+		refs := nestedBucket(tx, refsBucket, s.indexKey())
+		if refs == nil {
+			return errRefNotFound
+		}
+		var err error
+		ref, err = decodeRef(refs.Get([]byte(name)))
+		if err == nil && ref == nil {
+			err = errRefNotFound
+		}
+		return err
+	})
+	return ref, err
+}
+
+// Refs returns every ref in the store's namespace, ordered by name.
+func (s *BoltMetaStore) Refs() ([]*Ref, error) {
+	var result []*Ref
+	err := s.db.View(func(tx *bolt.Tx) error {
+		refs := nestedBucket(tx, refsBucket, s.indexKey())
+		if refs == nil {
+			return nil
+		}
+		return refs.ForEach(func(k, v []byte) error {
+			ref, err := decodeRef(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, ref)
+			return nil
+		})
+	})
+	return result, err
+}
+
+// UpdateRef points a ref at oid, or deletes it if oid is empty, and records
+// the change in its reflog. Setting a ref to the object it already points at
+// changes nothing.
+func (s *BoltMetaStore) UpdateRef(name, oid, author string, check func(current *Ref) error) (*Ref, error) {
+	var result *Ref
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		refs, err := createNestedBucket(tx, refsBucket, s.indexKey())
+		if err != nil {
+			return err
+		}
+		current, err := decodeRef(refs.Get([]byte(name)))
+		if err != nil {
+			return err
+		}
+		if err := check(current); err != nil {
+			return err
+		}
+
+		entry := &RefLogEntry{New: oid, Author: author, Time: time.Now().Unix()}
+		if current != nil {
+			entry.Old = current.Oid
+		}
+		switch {
+		case oid == "" && current == nil:
+			return errRefNotFound
+		case oid != "" && entry.Old == oid:
+			result = current
+			return nil
+		case oid != "":
+			objects := s.bucket(tx)
+			if objects == nil || objects.Get([]byte(oid)) == nil {
+				return errObjectNotFound
+			}
+		}
+
+		reflog, err := createNestedBucket(tx, reflogBucket, s.indexKey(), []byte(name))
+		if err != nil {
+			return err
+		}
+		seq, err := reflog.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.Revision = int(seq)
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := reflog.Put(key, buf.Bytes()); err != nil {
+			return err
+		}
+
+		result = &Ref{Name: name, Oid: oid, Revision: entry.Revision, Updated: entry.Time, UpdatedBy: author}
+		if oid == "" {
+			return refs.Delete([]byte(name))
+		}
+		// Bolt holds on to values until the transaction commits, so the
+		// ref can't reuse the reflog entry's buffer.
+		var refBuf bytes.Buffer
+		if err := gob.NewEncoder(&refBuf).Encode(result); err != nil {
+			return err
+		}
+		return refs.Put([]byte(name), refBuf.Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RefLog returns every update made to the named ref, oldest first. The log
+// outlives the ref, so it can still be read after the ref is deleted.
+func (s *BoltMetaStore) RefLog(name string) ([]*RefLogEntry, error) {
+	var result []*RefLogEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		reflog := nestedBucket(tx, reflogBucket, s.indexKey(), []byte(name))
+		if reflog == nil {
+			return errRefNotFound
+		}
+		return reflog.ForEach(func(k, v []byte) error {
+			var e RefLogEntry
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&e); err != nil {
+				return err
+			}
+			result = append(result, &e)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func decodeRef(v []byte) (*Ref, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	var ref Ref
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&ref); err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// nestedBucket follows a path of bucket names from the root, returning nil
+// if any of them doesn't exist.
+func nestedBucket(tx *bolt.Tx, names ...[]byte) *bolt.Bucket {
+	b := tx.Bucket(names[0])
+	for _, name := range names[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// createNestedBucket is nestedBucket for writable transactions, creating
+// the buckets as needed.
+func createNestedBucket(tx *bolt.Tx, names ...[]byte) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(names[0])
+	for _, name := range names[1:] {
+		if err != nil {
+			return nil, err
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	return b, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errRenditionNotFound = errors.New("Rendition not found")
+	// renditionsBucket links objects to their renditions, with one nested
+	// bucket per namespace (named as in indexesBucket). Keys are the
+	// source's OID followed by the canonical spec, and values the OID of
+	// the rendition.
+	renditionsBucket = []byte("renditions")
+)
+
+// Rendition returns the OID of the rendition of oid made to spec.
+func (s *BoltMetaStore) Rendition(oid, spec string) (string, error) {
+	var result string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		renditions := nestedBucket(tx, renditionsBucket, s.indexKey())
+		if renditions == nil {
+			return errRenditionNotFound
+		}
+		v := renditions.Get([]byte(oid + spec))
+		if v == nil {
+			return errRenditionNotFound
+		}
+		result = string(v)
+		return nil
+	})
+	return result, err
+}
+
+// PutRendition records the meta for a rendition, as Put, and links it to
+// the object it was made of, which must be in the store's namespace. The
+// same image can be the rendition of several specs.
+func (s *BoltMetaStore) PutRendition(oid, spec, renditionOid string, d *MetaData) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(d); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := s.createBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(oid)) == nil {
+			return errObjectNotFound
+		}
+
+		renditions, err := createNestedBucket(tx, renditionsBucket, s.indexKey())
+		if err != nil {
+			return err
+		}
+		if err := renditions.Put([]byte(oid+spec), []byte(renditionOid)); err != nil {
+			return err
+		}
+
+		if err := endIntent(tx, renditionOid); err != nil {
+			return err
+		}
+		if bucket.Get([]byte(renditionOid)) != nil {
+			return nil
+		}
+		if err := bucket.Put([]byte(renditionOid), buf.Bytes()); err != nil {
+			return err
+		}
+		return s.addToIndexes(tx, renditionOid, d)
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// scrubBucket holds the last ScrubRecord of each object, keyed by OID.
+	// Like derivedBucket it is shared by every namespace.
+	scrubBucket = []byte("scrub")
+	// scrubStateBucket holds the scrubber's ScrubState, under scrubStateKey.
+	scrubStateBucket = []byte("scrub-state")
+	scrubStateKey    = []byte("state")
+)
+
+// ScrubState returns how far the scrubber has got, which is the zero state
+// if it has never run.
+func (s *BoltMetaStore) ScrubState() (*ScrubState, error) {
+	state := &ScrubState{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubStateBucket)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get(scrubStateKey)
+		if v == nil {
+			return nil
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(state)
+	})
+	return state, err
+}
+
+// RecordScrub stores the result of checking an object along with the
+// scrubber's state, in one transaction, so the state never claims an object
+// was checked when its result was lost.
+func (s *BoltMetaStore) RecordScrub(rec *ScrubRecord, state *ScrubState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := putScrubRecord(tx, rec); err != nil {
+			return err
+		}
+		return putScrubState(tx, state)
+	})
+}
+
+// FinishScrubPass saves the state of a finished pass, after marking every
+// object last checked by an earlier pass as missing, as the pass didn't
+// find it, and counting them in state. It returns the objects marked.
+// Objects the pass didn't find that have no meta in any namespace were
+// removed on purpose, e.g. by recoverWrites, so their records are dropped
+// instead.
+func (s *BoltMetaStore) FinishScrubPass(state *ScrubState) ([]*ScrubRecord, error) {
+	var gone []*ScrubRecord
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(scrubBucket)
+		if err != nil {
+			return err
+		}
+		var removed [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var rec ScrubRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&rec); err != nil {
+				return err
+			}
+			if rec.Pass >= state.Pass {
+				continue
+			}
+			if !hasMeta(tx, k) {
+				removed = append(removed, append([]byte{}, k...))
+				continue
+			}
+			// Missing objects are reported again by each pass that
+			// doesn't find them.
+			rec.Pass, rec.Verified = state.Pass, state.Finished
+			rec.Status, rec.Error = scrubMissing, errObjectNotFound.Error()
+			gone = append(gone, &rec)
+		}
+		for _, rec := range gone {
+			if err := putScrubRecord(tx, rec); err != nil {
+				return err
+			}
+		}
+		for _, oid := range removed {
+			if err := bucket.Delete(oid); err != nil {
+				return err
+			}
+		}
+		state.Missing += len(gone)
+		return putScrubState(tx, state)
+	})
+	return gone, err
+}
+
+// ScrubRecord returns the result of the last check of oid, or
+// errScrubNotFound if it has never been checked.
+func (s *BoltMetaStore) ScrubRecord(oid string) (*ScrubRecord, error) {
+	var rec ScrubRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return errScrubNotFound
+		}
+		v := bucket.Get([]byte(oid))
+		if v == nil {
+			return errScrubNotFound
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// ScrubProblems returns the objects whose last check found them corrupt or
+// missing.
+func (s *BoltMetaStore) ScrubProblems() ([]*ScrubRecord, error) {
+	var problems []*ScrubRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scrubBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var rec ScrubRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&rec); err != nil {
+				return err
+			}
+			if rec.Status != scrubOK {
+				problems = append(problems, &rec)
+			}
+			return nil
+		})
+	})
+	return problems, err
+}
+
+func putScrubRecord(tx *bolt.Tx, rec *ScrubRecord) error {
+	bucket, err := tx.CreateBucketIfNotExists(scrubBucket)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(rec.Oid), buf.Bytes())
+}
+
+func putScrubState(tx *bolt.Tx, state *ScrubState) error {
+	bucket, err := tx.CreateBucketIfNotExists(scrubStateBucket)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+	return bucket.Put(scrubStateKey, buf.Bytes())
+}
+
+// hasMeta reports whether oid has meta in any namespace.
+func hasMeta(tx *bolt.Tx, oid []byte) bool {
+	if bucket := tx.Bucket(objectsBucket); bucket != nil && bucket.Get(oid) != nil {
+		return true
+	}
+	namespaces := tx.Bucket(namespacesBucket)
+	if namespaces == nil {
+		return false
+	}
+	c := namespaces.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil && namespaces.Bucket(k).Get(oid) != nil {
+			return true
+		}
+	}
+	return false
+}
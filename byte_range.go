@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidRange       = errors.New("Invalid Range header")
+	errUnsatisfiableRange = errors.New("Requested range not satisfiable")
+)
+
+// byteRange is a single range from a Range header, resolved against the size
+// of the object it applies to.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header value of the form "bytes=0-99,200-,-50"
+// for an object of the given size. Ranges that start past the end of the
+// object are dropped; if none are left errUnsatisfiableRange is returned.
+// A malformed header gives errInvalidRange, and should be ignored.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var r byteRange
+		if first == "" {
+			// Suffix range, e.g. "-500" is the final 500 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				continue
+			}
+			r.start = start
+			if last == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// objectETag returns the strong entity tag for an object. Objects are
+// immutable and named by their content hash, so the OID is all that's needed.
+func objectETag(oid string) string {
+	return `"` + oid + `"`
+}
+
+// checkIfRange reports whether a Range header should be honoured given the
+// request's If-Range header, which may hold either the object's ETag or its
+// creation date.
+func checkIfRange(r *http.Request, oid string, meta *MetaData) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// Weak validators can never match for a byte range
+		return ir == objectETag(oid)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return t.Equal(time.Unix(meta.Created, 0))
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errChunkMissing = errors.New("Object references a missing chunk")
+)
+
+const (
+	chunkMinSize = 256 * 1024
+	chunkAvgSize = 1024 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+)
+
+// gearTable holds the 256 random values used by the rolling gear hash. It is
+// generated from a fixed seed so that chunk boundaries are stable between
+// runs. Changing the seed (or the generator) would stop new uploads from
+// deduplicating against anything already in the store.
+var gearTable [256]uint64
+
+func init() {
+	seed := uint64(0x6e646368756e6b73) // "ndchunks"
+	for i := range gearTable {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream into content-defined chunks using FastCDC style
+// normalised chunking over a gear hash. Boundaries depend only on the bytes
+// near them, so an insertion or deletion in a large file only changes the
+// chunks around the edit.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+
+	min   int
+	avg   int
+	max   int
+	maskS uint64
+	maskL uint64
+}
+
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	bits := uint(0)
+	for (1 << (bits + 1)) <= avg {
+		bits++
+	}
+	return &chunker{
+		r:     r,
+		buf:   make([]byte, 2*max),
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: highBits(bits + 2),
+		maskL: highBits(bits - 2),
+	}
+}
+
+// highBits returns a mask with the n most significant bits set. The gear hash
+// mixes the most into its high bits, so those are the ones tested.
+func highBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk from the stream, or io.EOF once the stream is
+// exhausted. The returned slice is only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunkRef is one entry in an object's chunk manifest.
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// chunkManifest lists, in order, the chunks that make up an object.
+type chunkManifest struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+// ChunkObjectStore implements deduplicating binary storage within a
+// filesystem folder. Uploads are split into content-defined chunks, each
+// chunk is stored once under its own SHA-256 in <path>/chunks and every
+// object gets a manifest in <path>/manifests listing its chunks.
+type ChunkObjectStore struct {
+	path string
+	min  int
+	avg  int
+	max  int
+}
+
+// NewChunkObjectStore creates a ChunkObjectStore at the base directory.
+func NewChunkObjectStore(path string) (*ChunkObjectStore, error) {
+	for _, dir := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0750); err != nil {
+			return nil, err
+		}
+	}
+	return &ChunkObjectStore{path: path, min: chunkMinSize, avg: chunkAvgSize, max: chunkMaxSize}, nil
+}
+
+func (s *ChunkObjectStore) manifestPath(hash string) string {
+	return filepath.Join(s.path, "manifests", hash)
+}
+
+func (s *ChunkObjectStore) chunkPath(hash string) string {
+	return filepath.Join(s.path, "chunks", hash)
+}
+
+func (s *ChunkObjectStore) readManifest(hash string) (*chunkManifest, error) {
+	b, err := ioutil.ReadFile(s.manifestPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	var m chunkManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// List returns an array of hash strings for every object in the store.
+func (s *ChunkObjectStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.path, "manifests"))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".tmp") {
+			continue
+		}
+		result = append(result, f.Name())
+	}
+	return result, nil
+}
+
+// Exists returns true if the object has a manifest in the store.
+func (s *ChunkObjectStore) Exists(hash string) bool {
+	if _, err := os.Stat(s.manifestPath(hash)); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// Get reassembles the object's chunks into a single stream. If fromByte > 0,
+// whole chunks before that offset are skipped without being read.
+func (s *ChunkObjectStore) Get(hash string, fromByte int64) (io.ReadCloser, error) {
+	m, err := s.readManifest(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := m.Chunks
+	for len(chunks) > 0 && fromByte >= chunks[0].Size {
+		fromByte -= chunks[0].Size
+		chunks = chunks[1:]
+	}
+	return &chunkReader{store: s, chunks: chunks, skip: fromByte}, nil
+}
+
+/*
+ * Put splits the stream into chunks, writing any chunk not already in the
+ * store, while calculating the sha256 of the whole stream. The manifest is
+ * written to a uniquely named <hash>.tmp* file and, upon completion:
+ * 1) If the calculated hash matches the expected, the manifest is renamed
+ *    to <hash> and the error is nil.
+ * 2) If the hash doesn't match, the manifest is deleted and the returned
+ *    error is errHashMismatch. Chunks written along the way are left in
+ *    place because a concurrent upload may already be referencing them.
+ */
+func (s *ChunkObjectStore) Put(hash string, r io.Reader) (int64, error) {
+	_, written, err := s.put(hash, r)
+	return written, err
+}
+
+// Ingest stores the content from r under its calculated hash, for when the
+// client doesn't know the hash up front. It returns the hash (the new OID).
+func (s *ChunkObjectStore) Ingest(r io.Reader) (string, int64, error) {
+	return s.put("", r)
+}
+
+// put does the work for Put and Ingest. If hash is empty, the calculated
+// hash is used to name the object.
+func (s *ChunkObjectStore) put(hash string, r io.Reader) (string, int64, error) {
+	prefix := hash
+	if prefix == "" {
+		prefix = "ingest"
+	}
+	file, err := ioutil.TempFile(filepath.Join(s.path, "manifests"), prefix+".tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	h := sha256.New()
+	c := newChunker(io.TeeReader(r, h), s.min, s.avg, s.max)
+	m := chunkManifest{}
+	stored := 0
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return "", 0, err
+		}
+
+		sum := sha256.Sum256(chunk)
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+		created, err := s.putChunk(ref.Hash, chunk)
+		if err != nil {
+			file.Close()
+			return "", 0, err
+		}
+		if created {
+			stored++
+		}
+		m.Chunks = append(m.Chunks, ref)
+		m.Size += ref.Size
+	}
+	logger.Log(kv{"method": "ChunkObjectStore.Put()", "hash": hash, "length": m.Size, "chunks": len(m.Chunks), "new_chunks": stored})
+
+	hash_chk := hex.EncodeToString(h.Sum(nil))
+	if hash == "" {
+		hash = hash_chk
+		if s.Exists(hash) {
+			file.Close()
+			return hash, m.Size, nil
+		}
+	} else if hash_chk != hash {
+		file.Close()
+		logger.Log(kv{"method": "ChunkObjectStore.Put()", "hash": hash, "calulated_hash": hash_chk})
+		return "", 0, errHashMismatch
+	}
+
+	err = json.NewEncoder(file).Encode(&m)
+	file.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmpPath, s.manifestPath(hash)); err != nil {
+		return "", 0, err
+	}
+
+	return hash, m.Size, nil
+}
+
+// putChunk stores a chunk under its hash unless it is already present. It
+// returns true if the chunk was newly written.
+func (s *ChunkObjectStore) putChunk(hash string, chunk []byte) (bool, error) {
+	path := s.chunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+
+	// Chunks can be shared by concurrent uploads, so each writer gets its
+	// own temp file and the rename decides who wins. Both have the same
+	// content, so either result is fine.
+	file, err := ioutil.TempFile(filepath.Dir(path), hash+".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(chunk)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// chunkReader streams an object's chunks in order, opening each chunk file
+// only when the previous one has been consumed.
+type chunkReader struct {
+	store  *ChunkObjectStore
+	chunks []chunkRef
+	skip   int64
+	cur    *os.File
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.store.chunkPath(r.chunks[0].Hash))
+			if os.IsNotExist(err) {
+				return 0, errChunkMissing
+			}
+			if err != nil {
+				return 0, err
+			}
+			if r.skip > 0 {
+				if _, err := f.Seek(r.skip, io.SeekStart); err != nil {
+					f.Close()
+					return 0, err
+				}
+				r.skip = 0
+			}
+			r.cur = f
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		err := r.cur.Close()
+		r.cur = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var chunkStore *ChunkObjectStore
+
+func TestChunkStorePutGet(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	data := randomData(1, 200*1024)
+	oid := sha256Hex(data)
+
+	n, err := chunkStore.Put(oid, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("expected %d bytes written, got: %d", len(data), n)
+	}
+
+	m, err := chunkStore.readManifest(oid)
+	if err != nil {
+		t.Fatalf("expected manifest to exist after putting, got: %s", err)
+	}
+	if len(m.Chunks) < 2 {
+		t.Fatalf("expected content to be split into several chunks, got: %d", len(m.Chunks))
+	}
+	for _, c := range m.Chunks[:len(m.Chunks)-1] {
+		if c.Size < int64(chunkStore.min) || c.Size > int64(chunkStore.max) {
+			t.Fatalf("expected chunk size within [%d, %d], got: %d", chunkStore.min, chunkStore.max, c.Size)
+		}
+	}
+
+	r, err := chunkStore.Get(oid, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(by, data) {
+		t.Fatalf("expected to read back the original content")
+	}
+}
+
+func TestChunkStorePutHashMismatch(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	b := bytes.NewBuffer([]byte("bogus content"))
+
+	if _, err := chunkStore.Put(oid, b); err != errHashMismatch {
+		t.Fatalf("expected put with bogus content to fail with errHashMismatch, got: %v", err)
+	}
+
+	if chunkStore.Exists(oid) {
+		t.Fatalf("expected content to not exist after putting bogus content")
+	}
+	if tmps, _ := filepath.Glob(chunkStore.manifestPath(oid) + ".tmp*"); len(tmps) > 0 {
+		t.Fatalf("expected temporary manifest to be removed, found: %v", tmps)
+	}
+}
+
+func TestChunkStoreDedup(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	a := randomData(2, 200*1024)
+	// Same content with a few bytes inserted near the middle
+	b := append(append(append([]byte{}, a[:100*1024]...), []byte("edit")...), a[100*1024:]...)
+
+	if _, err := chunkStore.Put(sha256Hex(a), bytes.NewReader(a)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	before := countChunks(t)
+
+	if _, err := chunkStore.Put(sha256Hex(b), bytes.NewReader(b)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	added := countChunks(t) - before
+
+	if added >= before {
+		t.Fatalf("expected an edited upload to reuse most chunks, %d of %d were new", added, before)
+	}
+
+	r, err := chunkStore.Get(sha256Hex(b), 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+	by, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(by, b) {
+		t.Fatalf("expected to read back the edited content")
+	}
+}
+
+func TestChunkStoreGetWithRange(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	data := randomData(3, 100*1024)
+	oid := sha256Hex(data)
+	if _, err := chunkStore.Put(oid, bytes.NewReader(data)); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	for _, from := range []int64{5, 4096, 50000, int64(len(data)) - 1} {
+		r, err := chunkStore.Get(oid, from)
+		if err != nil {
+			t.Fatalf("expected get to succeed, got: %s", err)
+		}
+		by, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(by, data[from:]) {
+			t.Fatalf("expected to read content from byte %d", from)
+		}
+	}
+}
+
+func TestChunkStoreGetNonExisting(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	_, err := chunkStore.Get("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", 0)
+	if err == nil {
+		t.Fatalf("expected to get an error, but content existed")
+	}
+}
+
+func TestChunkStoreExists(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	b := bytes.NewBuffer([]byte("test content"))
+
+	if chunkStore.Exists(oid) {
+		t.Fatalf("expected content to not exist yet")
+	}
+
+	if _, err := chunkStore.Put(oid, b); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if !chunkStore.Exists(oid) {
+		t.Fatalf("expected content to exist")
+	}
+
+	if ct, _ := NewSniffer().DetectObject(chunkStore, oid, ""); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("expected text content type, got: %s", ct)
+	}
+}
+
+func TestChunkStoreIngest(t *testing.T) {
+	setupChunkStore()
+	defer teardownChunkStore()
+
+	data := randomData(4, 50*1024)
+
+	oid, n, err := chunkStore.Ingest(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+	if oid != sha256Hex(data) {
+		t.Fatalf("expected oid to be the content hash, got: %s", oid)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("expected %d bytes written, got: %d", len(data), n)
+	}
+
+	r, err := chunkStore.Get(oid, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+	by, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(by, data) {
+		t.Fatalf("expected to read back the ingested content")
+	}
+}
+
+func randomData(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func countChunks(t *testing.T) int {
+	files, err := ioutil.ReadDir(filepath.Join("chunk-store-test", "chunks"))
+	if err != nil {
+		t.Fatalf("error reading chunk directory: %s", err)
+	}
+	return len(files)
+}
+
+func setupChunkStore() {
+	store, err := NewChunkObjectStore("chunk-store-test")
+	if err != nil {
+		fmt.Printf("error initializing chunk store: %s\n", err)
+		os.Exit(1)
+	}
+	// Small chunks so that tests exercise multi-chunk objects
+	store.min, store.avg, store.max = 2*1024, 8*1024, 32*1024
+	chunkStore = store
+}
+
+func teardownChunkStore() {
+	os.RemoveAll("chunk-store-test")
+}
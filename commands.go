@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// usage lists the commands nd takes. Without one it runs the server.
+const usage = "usage: nd [version | reindex | extract | fsck [--repair] | migrate]"
+
+// runCommand runs the command given in args, the program's arguments after
+// its name, and returns the status to exit with. Unknown commands print the
+// usage line.
+func runCommand(args []string) int {
+	switch {
+	case len(args) == 1 && (args[0] == "version" || args[0] == "--version" || args[0] == "-v"):
+		fmt.Println(version)
+		return 0
+	case len(args) == 1 && args[0] == "reindex":
+		return reindexCommand()
+	case len(args) == 1 && args[0] == "extract":
+		return extractCommand()
+	case len(args) == 1 && args[0] == "fsck":
+		return fsckCommand(false)
+	case len(args) == 2 && args[0] == "fsck" && args[1] == "--repair":
+		return fsckCommand(true)
+	case len(args) == 1 && args[0] == "migrate":
+		return migrateCommand()
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
+
+// reindexCommand rebuilds the meta store's indexes. They are rebuilt
+// automatically when their format changes, but can also be rebuilt by hand,
+// with the server stopped.
+func reindexCommand() int {
+	metaStore, err := NewBoltMetaStore(Config.DataPath + "meta.db")
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
+	}
+	if err := metaStore.RebuildIndexes(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not rebuild indexes: " + err.Error()})
+	}
+	metaStore.Close()
+	logger.Log(kv{"fn": "main", "msg": "indexes rebuilt"})
+	return 0
+}
+
+// extractCommand runs the extractors over every object they haven't
+// inspected. Extractors added since objects were stored only run over them
+// when they are next asked about, unless backfilled, with the server
+// stopped.
+func extractCommand() int {
+	metaStore, err := NewBoltMetaStore(Config.DataPath + "meta.db")
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
+	}
+	contentStore, err := newObjectStore()
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
+	}
+	n, err := backfillDerived(contentStore, metaStore, NewSniffer(), extractors)
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not run the extractors: " + err.Error()})
+	}
+	metaStore.Close()
+	logger.Log(kv{"fn": "main", "msg": "extractors run", "objects": n})
+	return 0
+}
+
+// fsckCommand checks the object and meta stores agree, with the server
+// stopped. It only reports what it finds unless told to repair. It fails if
+// any problems are left.
+func fsckCommand(repair bool) int {
+	metaStore, err := NewBoltMetaStore(Config.DataPath + "meta.db")
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
+	}
+	contentStore, err := newObjectStore()
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
+	}
+	report, err := Fsck(contentStore, metaStore, NewSniffer(), repair)
+	metaStore.Close()
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not check the stores: " + err.Error()})
+	}
+	logger.Log(kv{"fn": "main", "msg": "fsck finished", "objects": report.Objects, "orphans": len(report.Orphans), "interrupted": len(report.Interrupted), "dangling": len(report.Dangling), "temp-files": len(report.TempFiles), "size-mismatches": len(report.SizeMismatches), "hash-mismatches": len(report.HashMismatches), "unreadable": len(report.Unreadable), "repaired": report.Repaired})
+	if report.Problems() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateCommand moves the objects of a filesystem store into the layout
+// set by ND_STORELAYOUT. Objects can be read from either layout throughout,
+// so it can be run while the server is running.
+func migrateCommand() int {
+	contentStore, err := newObjectStore()
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
+	}
+	fs, ok := contentStore.(*FsObjectStore)
+	if !ok {
+		logger.Fatal(kv{"fn": "main", "err": "Only the fs store can be migrated"})
+	}
+	n, err := fs.Migrate()
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not migrate the content store: " + err.Error(), "moved": n})
+	}
+	logger.Log(kv{"fn": "main", "msg": "content store migrated", "layout": Config.StoreLayout, "moved": n})
+	return 0
+}
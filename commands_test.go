@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+func TestRunCommandUsage(t *testing.T) {
+	for _, args := range [][]string{{"--reindex"}, {"--extract"}, {"serve"}, {"fsck", "--force"}, {"migrate", "now"}} {
+		if status := runCommand(args); status != 2 {
+			t.Errorf("%q: expected the usage and status 2, got %d", args, status)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// immutableCacheControl returns the Cache-Control header sent with object
+// content, which can never change for a given OID, so caches may keep it as
+// long as they like. Only when auth is disabled may shared caches keep it, as
+// otherwise they would hand it to clients without credentials.
+func immutableCacheControl(r *http.Request) string {
+	if requestIdentity(r) == anonymous {
+		return "public, max-age=31536000, immutable"
+	}
+	return "private, max-age=31536000, immutable"
+}
+
+// metaETag returns the entity tag for revision n of an object's meta. It
+// differs from the object's own ETag, as both are served at the same URL.
+func metaETag(oid string, n int) string {
+	return `"` + oid + ".meta." + strconv.Itoa(n) + `"`
+}
+
+// setValidators sets the ETag and Last-Modified headers of a response, and
+// Vary, as /objects/{oid} serves either content or meta by Accept header.
+func setValidators(w http.ResponseWriter, etag string, modified int64) {
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", time.Unix(modified, 0).UTC().Format(http.TimeFormat))
+	h.Set("Vary", "Accept")
+}
+
+// notModified reports whether a GET or HEAD request can be answered with 304
+// Not Modified. As in RFC 7232, If-Modified-Since is only checked when there
+// is no If-None-Match.
+func notModified(r *http.Request, etag string, modified int64) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, etag)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	return err == nil && !time.Unix(modified, 0).After(t)
+}
+
+// etagListMatches reports whether a comma separated list of entity tags, as
+// sent in If-None-Match, holds etag or is "*". If-None-Match uses the weak
+// comparison, so a W/ prefix is ignored.
+func etagListMatches(list, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified responds with 304 Not Modified. The validators and cache
+// headers set so far are sent with it.
+func writeNotModified(w http.ResponseWriter, r *http.Request) {
+	logRequest(r, 304)
+	w.WriteHeader(304)
+}
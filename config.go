@@ -15,11 +15,21 @@ type Configuration struct {
 	Listen		string `config:"tcp://:8080"`
 	Host		string `config:"localhost:8080"`
 	DataPath	string `config:"/var/opt/ndel/"`
+	Store		string `config:"fs"`
+	StoreLayout	string `config:"2/2"`
+	UploadExpiry	string `config:"24h"`
 	AdminUser	string `config:""`
 	AdminPass	string `config:""`
 	Cert		string `config:""`
 	Key		string `config:""`
 	Proto		string `config:"http"`
+	S3Listen	string `config:""`
+	S3Bucket	string `config:"nd"`
+	S3AccessKey	string `config:""`
+	S3SecretKey	string `config:""`
+	ScrubRate	string `config:""`
+	ScrubInterval	string `config:"168h"`
+	ImportMaxSize	string `config:"1G"`
 }
 
 func (c *Configuration) IsHTTPS() bool {
@@ -44,7 +54,9 @@ func init() {
 		env := os.Getenv(envVar)
 		tag := sf.Tag.Get("config")
 		
-		if env != "" {
+		if env != "" && (name == "AdminPass" || name == "S3SecretKey") {
+			log.Printf("CONFIG:%s: %s set from env", envVar, name)
+		} else if env != "" {
 			log.Printf("CONFIG:%s: %s set to %s from env", envVar, name, env)
 		} else if tag != "" {
 			log.Printf("CONFIG:%s: %s set to %s from tag", envVar, name, tag)
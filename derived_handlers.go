@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// DerivedHandler returns what the extractors learned from an object's
+// content. Any extractor that hasn't inspected the object yet, e.g. one
+// added since it was stored or one still queued, is run first, sharing the
+// extract workers' limit on how many objects are inspected at once.
+//
+// This is a read, but it records what those extractors find. That is
+// allowed under the read scope because the results are derived by the
+// server from the content alone: a reader can't choose what is written, and
+// each extractor inspects an object only once.
+func (a *App) DerivedHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	meta, err := a.metaStoreFor(r).Get(oid)
+	if err != nil || !a.objectStore.Exists(oid) {
+		writeError(w, r, 404, errObjectNotFound)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: oid, Derived: a.extract(oid, meta.ContentType)})
+}
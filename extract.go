@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Extractor learns something from an object's content, such as the
+// dimensions of an image or the page count of a PDF, once it is stored.
+// Extractors are kept in a registry (see RegisterExtractor) and their
+// results are recorded under their name as Derived metadata.
+type Extractor interface {
+	// Name keys the extractor's results. It must be unique.
+	Name() string
+	// Accepts reports whether the extractor inspects content of a type,
+	// given without parameters, e.g. "text/plain".
+	Accepts(contentType string) bool
+	// Extract inspects content of size bytes. It returns the fields to
+	// record, which may be none.
+	Extract(content io.ReaderAt, size int64) (map[string]string, error)
+}
+
+// Derived is what the extractors learned from an object's content, the
+// fields of each keyed by extractor name. Unlike MetaData it is derived by
+// the server, so is the same for the object in every namespace. An
+// extractor that has inspected the object always has an entry, so it is
+// not run again, and one that failed has its error as the "error" field.
+type Derived map[string]map[string]string
+
+// extractors is the registry of Extractors run over new objects.
+var extractors = []Extractor{
+	imageExtractor{},
+	exifExtractor{},
+	pdfExtractor{},
+	zipExtractor{},
+	textExtractor{},
+}
+
+// RegisterExtractor adds an Extractor to those run over new objects. It
+// must be called before the App is created, e.g. from an init function.
+func RegisterExtractor(e Extractor) {
+	extractors = append(extractors, e)
+}
+
+// Extraction of new objects runs off the request path, in a few workers
+// fed by a bounded queue. Whether queued or asked for by a request, at most
+// maxExtracts objects are inspected at once; that is one more than the
+// workers, so a request needn't always wait for the queue.
+const (
+	extractWorkers   = 2
+	extractQueueSize = 256
+	maxExtracts      = extractWorkers + 1
+)
+
+// extractJob is a newly stored object waiting for the extractors.
+type extractJob struct {
+	oid         string
+	contentType string
+}
+
+// queueExtract queues a newly stored object for the extractors. If the
+// queue is full the object is skipped, and is inspected instead when its
+// derived metadata is first asked for, or by nd extract.
+func (a *App) queueExtract(oid, contentType string) {
+	select {
+	case a.extractQueue <- extractJob{oid, contentType}:
+	default:
+		logger.Log(kv{"fn": "queueExtract", "oid": oid, "msg": "extract queue full, skipped"})
+	}
+}
+
+// extractWorker runs the extractors over queued objects.
+func (a *App) extractWorker() {
+	for job := range a.extractQueue {
+		a.extract(job.oid, job.contentType)
+	}
+}
+
+// extract runs the registered extractors over a newly stored object and
+// returns everything known about it, once a slot is free. The object is
+// stored either way, so failures are logged rather than returned.
+func (a *App) extract(oid, contentType string) Derived {
+	a.extractSlots <- struct{}{}
+	defer func() { <-a.extractSlots }()
+	d, err := runExtractors(a.objectStore, a.metaStore, extractors, oid, contentType)
+	if err != nil {
+		logger.Log(kv{"fn": "extract", "oid": oid, "err": err.Error()})
+	}
+	return d
+}
+
+// runExtractors runs those of es that accept contentType and haven't
+// inspected oid yet, records their results in ds, and returns all the
+// results for oid.
+func runExtractors(st ObjectStore, ds DerivedStore, es []Extractor, oid, contentType string) (Derived, error) {
+	d, err := ds.Derived(oid)
+	if err == errDerivedNotFound {
+		d, err = make(Derived), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	var todo []Extractor
+	for _, e := range es {
+		if _, done := d[e.Name()]; !done && e.Accepts(mediaType) {
+			todo = append(todo, e)
+		}
+	}
+	if len(todo) == 0 {
+		return d, nil
+	}
+
+	content, size, err := openReaderAt(st, oid)
+	if err != nil {
+		return d, err
+	}
+	defer content.Close()
+
+	found := make(Derived)
+	for _, e := range todo {
+		fields, err := e.Extract(content, size)
+		if err != nil {
+			fields = map[string]string{"error": err.Error()}
+		}
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		found[e.Name()] = fields
+		d[e.Name()] = fields
+	}
+	return d, ds.PutDerived(oid, found)
+}
+
+// backfillDerived runs the extractors es over every object in st that they
+// haven't inspected yet, e.g. objects stored before an extractor was added,
+// with content types detected by sn. It returns the number of objects
+// inspected.
+func backfillDerived(st ObjectStore, ds DerivedStore, sn *Sniffer, es []Extractor) (int, error) {
+	oids, err := st.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, oid := range oids {
+		if !validOid(oid) {
+			continue
+		}
+		ct, _ := sn.DetectObject(st, oid, "")
+		if _, err := runExtractors(st, ds, es, oid, ct); err != nil {
+			logger.Log(kv{"fn": "backfillDerived", "oid": oid, "err": err.Error()})
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// readerAtCloser is the content of an object, open for random access.
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openReaderAt opens an object for random access, returning its size.
+// Objects in an FsObjectStore are files and are read directly; others are
+// read through objectReaderAt.
+func openReaderAt(st ObjectStore, oid string) (readerAtCloser, int64, error) {
+	r, err := st.Get(oid, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if f, ok := r.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	}
+	size, err := io.Copy(ioutil.Discard, r)
+	r.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &objectReaderAt{st: st, oid: oid}, size, nil
+}
+
+// objectReaderAt reads an object at an offset by opening it there, which
+// suits the few, mostly small reads extractors make.
+type objectReaderAt struct {
+	st  ObjectStore
+	oid string
+}
+
+func (o *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r, err := o.st.Get(o.oid, off)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *objectReaderAt) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingExtractor records the size of text, counting its runs.
+type countingExtractor struct {
+	runs *int
+}
+
+func (countingExtractor) Name() string { return "counting" }
+
+func (countingExtractor) Accepts(contentType string) bool { return contentType == "text/plain" }
+
+func (e countingExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	*e.runs++
+	return map[string]string{"size": strconv.FormatInt(size, 10)}, nil
+}
+
+func TestBackfillDerived(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+
+	text := strings.Repeat("a line of text\n", 50)
+	textOid, _, err := contentStore.Ingest(bytes.NewBufferString(text))
+	if err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+	pdf := []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n")
+	pdfOid, _, err := contentStore.Ingest(bytes.NewReader(pdf))
+	if err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+
+	runs := 0
+	es := []Extractor{countingExtractor{&runs}, pdfExtractor{}}
+	if n, err := backfillDerived(contentStore, metaStoreTest, NewSniffer(), es); err != nil || n != 2 {
+		t.Fatalf("expected both objects to be inspected, got: %d, %v", n, err)
+	}
+	if d, err := metaStoreTest.Derived(textOid); err != nil || d["counting"]["size"] != "750" || d["pdf"] != nil {
+		t.Errorf("expected only the accepting extractor's results, got: %v, %v", d, err)
+	}
+	if d, err := metaStoreTest.Namespace("other").Derived(pdfOid); err != nil || d["pdf"]["pages"] != "1" {
+		t.Errorf("expected the PDF's results in every namespace, got: %v, %v", d, err)
+	}
+
+	backfillDerived(contentStore, metaStoreTest, NewSniffer(), es)
+	if runs != 1 {
+		t.Errorf("expected an extractor to run once per object, got: %d runs", runs)
+	}
+}
+
+func TestExtractSlots(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+
+	oid, _, err := contentStore.Ingest(bytes.NewBufferString("text waiting for a slot"))
+	if err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+	a := &App{objectStore: contentStore, metaStore: metaStoreTest, extractSlots: make(chan struct{}, 1)}
+
+	// With every slot taken, extraction waits for one to be freed
+	a.extractSlots <- struct{}{}
+	done := make(chan Derived)
+	go func() { done <- a.extract(oid, "text/plain; charset=utf-8") }()
+	select {
+	case <-done:
+		t.Fatalf("expected extraction to wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-a.extractSlots
+	if d := <-done; d["text"] == nil {
+		t.Errorf("expected the text extractor to run once a slot was free, got: %v", d)
+	}
+}
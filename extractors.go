@@ -0,0 +1,420 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	errInvalidExif = errors.New("Invalid EXIF data")
+	errInvalidPDF  = errors.New("Not a PDF document")
+)
+
+// Limits on how much of an object the built in extractors read.
+const (
+	maxExifScan    = 256 * 1024
+	maxPDFScan     = 32 * 1024 * 1024
+	maxTextScan    = 64 * 1024
+	maxZipListing  = 1000
+	pdfCountWindow = 512
+)
+
+// imageExtractor records the format and dimensions of the images that can
+// be decoded, which are those renditions can be made of.
+type imageExtractor struct{}
+
+func (imageExtractor) Name() string { return "image" }
+
+func (imageExtractor) Accepts(contentType string) bool {
+	_, ok := renditionSources[contentType]
+	return ok
+}
+
+func (imageExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	cfg, format, err := image.DecodeConfig(io.NewSectionReader(content, 0, size))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	return map[string]string{
+		"format": format,
+		"width":  strconv.Itoa(cfg.Width),
+		"height": strconv.Itoa(cfg.Height),
+	}, nil
+}
+
+// exifExtractor records the camera and exposure details kept in the EXIF
+// block of a JPEG. GPS positions are deliberately left out.
+type exifExtractor struct{}
+
+func (exifExtractor) Name() string { return "exif" }
+
+func (exifExtractor) Accepts(contentType string) bool {
+	return contentType == "image/jpeg"
+}
+
+// exifTags names the EXIF tags that are recorded, from either IFD0 or the
+// Exif sub-IFD.
+var exifTags = map[uint16]string{
+	0x010f: "make",
+	0x0110: "model",
+	0x0112: "orientation",
+	0x0131: "software",
+	0x0132: "date-time",
+	0x829a: "exposure-time",
+	0x829d: "f-number",
+	0x8827: "iso",
+	0x9003: "date-time-original",
+	0x920a: "focal-length",
+}
+
+const exifIFDPointer = 0x8769
+
+func (exifExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	if size > maxExifScan {
+		size = maxExifScan
+	}
+	b := make([]byte, size)
+	n, err := content.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	tiff := findExif(b[:n])
+	if tiff == nil {
+		return nil, nil
+	}
+	return parseExif(tiff)
+}
+
+// findExif returns the TIFF structure held in a JPEG's EXIF APP1 segment, or
+// nil if it has none.
+func findExif(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		// Start of scan: the image data follows, with no more metadata.
+		if marker == 0xda {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(b) {
+			return nil
+		}
+		segment := b[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// parseExif reads the tags named in exifTags from a TIFF structure.
+func parseExif(tiff []byte) (map[string]string, error) {
+	if len(tiff) < 8 {
+		return nil, errInvalidExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errInvalidExif
+	}
+
+	fields := make(map[string]string)
+	ifd := order.Uint32(tiff[4:])
+	// IFD0 may point at the Exif sub-IFD; nothing else is followed.
+	for depth := 0; depth < 2 && ifd != 0; depth++ {
+		next, err := readIFD(tiff, order, ifd, fields)
+		if err != nil {
+			return nil, err
+		}
+		ifd = next
+	}
+	return fields, nil
+}
+
+// readIFD adds the values of known tags in the IFD at offset to fields, and
+// returns the offset of the Exif sub-IFD if it points at one.
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32, fields map[string]string) (uint32, error) {
+	if int64(offset)+2 > int64(len(tiff)) {
+		return 0, errInvalidExif
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	var sub uint32
+	for i := 0; i < count; i++ {
+		e := int(offset) + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0, errInvalidExif
+		}
+		tag, typ, n := order.Uint16(tiff[e:]), order.Uint16(tiff[e+2:]), order.Uint32(tiff[e+4:])
+		if tag == exifIFDPointer && n == 1 {
+			sub = order.Uint32(tiff[e+8:])
+			continue
+		}
+		name, ok := exifTags[tag]
+		if !ok {
+			continue
+		}
+		if v, ok := exifValue(tiff, order, typ, n, tiff[e+8:e+12]); ok {
+			fields[name] = v
+		}
+	}
+	return sub, nil
+}
+
+// exifValue formats the first value of an IFD entry of type typ with n
+// values, which are held in inline if they fit and at the offset it gives
+// otherwise. Only ASCII, SHORT, LONG and RATIONAL values are read.
+func exifValue(tiff []byte, order binary.ByteOrder, typ uint16, n uint32, inline []byte) (string, bool) {
+	sizes := map[uint16]uint32{2: 1, 3: 2, 4: 4, 5: 8}
+	size, ok := sizes[typ]
+	if !ok || n == 0 || n > uint32(len(tiff)) {
+		return "", false
+	}
+	data := inline
+	if size*n > 4 {
+		off := order.Uint32(inline)
+		if int64(off)+int64(size*n) > int64(len(tiff)) {
+			return "", false
+		}
+		data = tiff[off : off+size*n]
+	}
+
+	switch typ {
+	case 2:
+		s := string(data[:n])
+		return strings.TrimSpace(strings.TrimRight(s, "\x00")), true
+	case 3:
+		return strconv.Itoa(int(order.Uint16(data))), true
+	case 4:
+		return strconv.FormatUint(uint64(order.Uint32(data)), 10), true
+	default:
+		num, den := order.Uint32(data), order.Uint32(data[4:])
+		if den == 0 {
+			return "", false
+		}
+		if num%den == 0 {
+			return strconv.FormatUint(uint64(num/den), 10), true
+		}
+		return strconv.FormatUint(uint64(num), 10) + "/" + strconv.FormatUint(uint64(den), 10), true
+	}
+}
+
+// pdfExtractor records a PDF's version, page count and title. It scans the
+// raw file rather than parsing it, so it finds the page count held in the
+// root page tree and a title given as a plain string in the document
+// information dictionary, but nothing kept in compressed object streams.
+type pdfExtractor struct{}
+
+func (pdfExtractor) Name() string { return "pdf" }
+
+func (pdfExtractor) Accepts(contentType string) bool {
+	return contentType == "application/pdf"
+}
+
+var (
+	pdfVersion  = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+	pdfPages    = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfPage     = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfCount    = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfTitle    = regexp.MustCompile(`/Title\s*\(((?:\\.|[^\\)])*)\)`)
+	pdfTitleHex = regexp.MustCompile(`/Title\s*<([0-9A-Fa-f\s]*)>`)
+	pdfEscapes  = strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\(`, "(", `\)`, ")", `\\`, `\`)
+	pdfUTF16BOM = []byte{0xfe, 0xff}
+)
+
+func (pdfExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	if size > maxPDFScan {
+		size = maxPDFScan
+	}
+	b := make([]byte, size)
+	n, err := content.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b = b[:n]
+	m := pdfVersion.FindSubmatch(b)
+	if m == nil {
+		return nil, errInvalidPDF
+	}
+	fields := map[string]string{"version": string(m[1])}
+
+	// Every node of the page tree has a /Count of the pages beneath it, so
+	// the root's is the largest.
+	pages := 0
+	for _, loc := range pdfPages.FindAllIndex(b, -1) {
+		start, end := loc[0]-pdfCountWindow, loc[1]+pdfCountWindow
+		if start < 0 {
+			start = 0
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		for _, c := range pdfCount.FindAllSubmatch(b[start:end], -1) {
+			if v, err := strconv.Atoi(string(c[1])); err == nil && v > pages {
+				pages = v
+			}
+		}
+	}
+	if pages == 0 {
+		pages = len(pdfPage.FindAllIndex(b, -1))
+	}
+	if pages > 0 {
+		fields["pages"] = strconv.Itoa(pages)
+	}
+
+	if m := pdfTitle.FindSubmatch(b); m != nil {
+		fields["title"] = pdfText([]byte(pdfEscapes.Replace(string(m[1]))))
+	} else if m := pdfTitleHex.FindSubmatch(b); m != nil {
+		hex := strings.Join(strings.Fields(string(m[1])), "")
+		var raw []byte
+		for i := 0; i+2 <= len(hex); i += 2 {
+			v, _ := strconv.ParseUint(hex[i:i+2], 16, 8)
+			raw = append(raw, byte(v))
+		}
+		fields["title"] = pdfText(raw)
+	}
+	if fields["title"] == "" {
+		delete(fields, "title")
+	}
+	return fields, nil
+}
+
+// pdfText decodes a PDF text string, which is UTF-16BE if it starts with a
+// byte order mark and otherwise taken as Latin-1, close enough to
+// PDFDocEncoding for titles.
+func pdfText(b []byte) string {
+	if bytes.HasPrefix(b, pdfUTF16BOM) {
+		b = b[2:]
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+// zipExtractor lists the files in a zip archive, or a format that is one
+// underneath such as OOXML, from its central directory, along with their
+// number and total uncompressed size. Listings of more than maxZipListing
+// files are cut short and marked "truncated".
+type zipExtractor struct{}
+
+func (zipExtractor) Name() string { return "zip" }
+
+func (zipExtractor) Accepts(contentType string) bool {
+	return isZip(contentType)
+}
+
+func (zipExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	zr, err := zip.NewReader(content, size)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var total uint64
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		total += f.UncompressedSize64
+		names = append(names, f.Name)
+	}
+	fields := map[string]string{
+		"files":             strconv.Itoa(len(names)),
+		"uncompressed-size": strconv.FormatUint(total, 10),
+	}
+	if len(names) > maxZipListing {
+		names = names[:maxZipListing]
+		fields["truncated"] = "true"
+	}
+	fields["listing"] = strings.Join(names, "\n")
+	return fields, nil
+}
+
+// textExtractor records the character encoding of text, judged from a byte
+// order mark or else from its first maxTextScan bytes: "us-ascii" if they
+// are all 7-bit, "utf-8" if they are valid UTF-8 and "unknown" otherwise.
+type textExtractor struct{}
+
+func (textExtractor) Name() string { return "text" }
+
+func (textExtractor) Accepts(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/")
+}
+
+var textBOMs = []struct {
+	bom      []byte
+	encoding string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+	{[]byte{0xfe, 0xff}, "utf-16be"},
+	{[]byte{0xff, 0xfe}, "utf-16le"},
+}
+
+func (textExtractor) Extract(content io.ReaderAt, size int64) (map[string]string, error) {
+	if size > maxTextScan {
+		size = maxTextScan
+	}
+	b := make([]byte, size)
+	n, err := content.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b = b[:n]
+
+	for _, t := range textBOMs {
+		if bytes.HasPrefix(b, t.bom) {
+			return map[string]string{"encoding": t.encoding, "bom": "true"}, nil
+		}
+	}
+
+	ascii := true
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return map[string]string{"encoding": "us-ascii"}, nil
+	}
+	// The scan may have cut the last character short.
+	if i := lastRuneStart(b); len(b) == maxTextScan && !utf8.FullRune(b[i:]) {
+		b = b[:i]
+	}
+	if utf8.Valid(b) {
+		return map[string]string{"encoding": "utf-8"}, nil
+	}
+	return map[string]string{"encoding": "unknown"}, nil
+}
+
+// lastRuneStart returns the index of the byte the last, possibly
+// incomplete, UTF-8 character in b starts at.
+func lastRuneStart(b []byte) int {
+	i := len(b) - 1
+	for i > 0 && len(b)-i < utf8.UTFMax && !utf8.RuneStart(b[i]) {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func TestImageExtractor(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 30, 20)), nil)
+	fields := extractBytes(t, imageExtractor{}, buf.Bytes())
+	if fields["format"] != "jpeg" || fields["width"] != "30" || fields["height"] != "20" {
+		t.Errorf("expected a 30x20 jpeg, got: %v", fields)
+	}
+}
+
+func TestExifExtractor(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	b := buf.Bytes()
+
+	// A little endian TIFF structure: IFD0 with Make, Orientation and a
+	// pointer to the Exif IFD, which holds ISO and FocalLength.
+	tiff := []byte("II*\x00")
+	le := binary.LittleEndian
+	tiff = le.AppendUint32(tiff, 8)
+	entry := func(b []byte, tag, typ uint16, n, value uint32) []byte {
+		b = le.AppendUint16(b, tag)
+		b = le.AppendUint16(b, typ)
+		b = le.AppendUint32(b, n)
+		return le.AppendUint32(b, value)
+	}
+	const exifIFD, data = 8 + 2 + 3*12 + 4, 8 + 2 + 3*12 + 4 + 2 + 2*12 + 4
+	tiff = le.AppendUint16(tiff, 3)
+	tiff = entry(tiff, 0x010f, 2, 6, data)
+	tiff = entry(tiff, 0x0112, 3, 1, 6)
+	tiff = entry(tiff, exifIFDPointer, 4, 1, exifIFD)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = entry(tiff, 0x8827, 3, 1, 200)
+	tiff = entry(tiff, 0x920a, 5, 1, data+6)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, "Canon\x00"...)
+	tiff = le.AppendUint32(tiff, 35)
+	tiff = le.AppendUint32(tiff, 2)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, 0xe1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	withExif := append(append(append([]byte{}, b[:2]...), app1...), b[2:]...)
+
+	fields := extractBytes(t, exifExtractor{}, withExif)
+	want := map[string]string{"make": "Canon", "orientation": "6", "iso": "200", "focal-length": "35/2"}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("expected %s %q, got: %v", k, v, fields)
+		}
+	}
+
+	if fields := extractBytes(t, exifExtractor{}, b); len(fields) != 0 {
+		t.Errorf("expected nothing from a JPEG without EXIF, got: %v", fields)
+	}
+}
+
+func TestPDFExtractor(t *testing.T) {
+	pdf := "%PDF-1.4\n" +
+		"1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R >> endobj\n" +
+		"4 0 obj << /Type /Page /Parent 2 0 R >> endobj\n" +
+		"5 0 obj << /Type /Page /Parent 2 0 R >> endobj\n" +
+		"6 0 obj << /Title (Datasheet \\(rev B\\)) /Producer (nd) >> endobj\n" +
+		"trailer << /Root 1 0 R /Info 6 0 R >>\n%%EOF\n"
+	fields := extractBytes(t, pdfExtractor{}, []byte(pdf))
+	if fields["version"] != "1.4" || fields["pages"] != "3" || fields["title"] != "Datasheet (rev B)" {
+		t.Errorf("expected version, pages and title, got: %v", fields)
+	}
+
+	utf16Title := "%PDF-1.7\n1 0 obj << /Type /Page >> endobj\n2 0 obj << /Title <FEFF 0050 00E9> >> endobj\n"
+	fields = extractBytes(t, pdfExtractor{}, []byte(utf16Title))
+	if fields["pages"] != "1" || fields["title"] != "Pé" {
+		t.Errorf("expected a counted page and a UTF-16 title, got: %v", fields)
+	}
+
+	if _, err := (pdfExtractor{}).Extract(bytes.NewReader([]byte("not a pdf")), 9); err != errInvalidPDF {
+		t.Errorf("expected errInvalidPDF, got: %v", err)
+	}
+}
+
+func TestZipExtractor(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create("cad/")
+	w, _ := zw.Create("cad/part.step")
+	w.Write([]byte("ISO-10303-21;"))
+	w, _ = zw.Create("readme.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+
+	fields := extractBytes(t, zipExtractor{}, buf.Bytes())
+	if fields["files"] != "2" || fields["uncompressed-size"] != "18" || fields["listing"] != "cad/part.step\nreadme.txt" {
+		t.Errorf("expected the zip's files, got: %v", fields)
+	}
+}
+
+func TestTextExtractor(t *testing.T) {
+	cases := []struct {
+		content, encoding string
+	}{
+		{"plain old text", "us-ascii"},
+		{"caf\xc3\xa9", "utf-8"},
+		{"\xef\xbb\xbfwith a BOM", "utf-8"},
+		{"\xff\xfeh\x00i\x00", "utf-16le"},
+		{"caf\xe9", "unknown"},
+	}
+	for _, c := range cases {
+		fields := extractBytes(t, textExtractor{}, []byte(c.content))
+		if fields["encoding"] != c.encoding {
+			t.Errorf("%q: expected %s, got: %v", c.content, c.encoding, fields)
+		}
+	}
+
+	// UTF-8 cut short at the end of the scan is still UTF-8.
+	long := bytes.Repeat([]byte("\xc3\xa9"), maxTextScan)
+	if fields := extractBytes(t, textExtractor{}, long[1:]); fields["encoding"] != "unknown" {
+		t.Errorf("expected a broken first character to be caught, got: %v", fields)
+	}
+	if fields := extractBytes(t, textExtractor{}, append([]byte("a"), long...)); fields["encoding"] != "utf-8" {
+		t.Errorf("expected a character cut by the scan to be ignored, got: %v", fields)
+	}
+}
+
+func extractBytes(t *testing.T, e Extractor, b []byte) map[string]string {
+	fields, err := e.Extract(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("%s: expected extraction to succeed, got: %s", e.Name(), err)
+	}
+	return fields
+}
@@ -8,131 +8,438 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"net/http"
+	"strconv"
+	"strings"
 )
 
 var (
-	errHashMismatch = errors.New("Content hash does not match OID")
-	errSizeMismatch = errors.New("Content size does not match")
+	errHashMismatch  = errors.New("Content hash does not match OID")
+	errSizeMismatch  = errors.New("Content size does not match")
+	errInvalidLayout = errors.New("Invalid store layout")
 )
 
 // FsObjectStore implements simple file-per object binary storage within
 // a filesystem folder
 type FsObjectStore struct {
-	path string
+	path    string
+	fanout  []int
+	intents IntentLog
 }
 
 // NewContentStore creates a ContentStore at the base directory.
 func NewFsObjectStore(path string) (*FsObjectStore, error) {
+	return NewShardedFsObjectStore(path, nil)
+}
+
+// NewShardedFsObjectStore creates an FsObjectStore that fans objects out
+// into nested directories named after the leading hex digits of their OIDs,
+// fanout[i] digits at level i, so no one directory gets too big. With
+// fanout [2 2] object abcdef... is stored as ab/cd/abcdef.... Objects at
+// the top level, as stored by a flat store, are still found, and Migrate
+// moves them into place.
+func NewShardedFsObjectStore(path string, fanout []int) (*FsObjectStore, error) {
 	err := os.MkdirAll(path, 0750)
 	if err != nil {
 		return nil, err
 	}
-	return &FsObjectStore{path}, nil
+	return &FsObjectStore{path: path, fanout: fanout}, nil
+}
+
+// parseStoreLayout parses a layout as set by ND_STORELAYOUT: "flat", or
+// the number of hex digits naming each level of directories, such as "2/2".
+func parseStoreLayout(layout string) ([]int, error) {
+	if layout == "" || layout == "flat" {
+		return nil, nil
+	}
+	var fanout []int
+	total := 0
+	for _, level := range strings.Split(layout, "/") {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 1 || n > 4 {
+			return nil, errInvalidLayout
+		}
+		total += n
+		fanout = append(fanout, n)
+	}
+	if total > 8 {
+		return nil, errInvalidLayout
+	}
+	return fanout, nil
+}
+
+// objectPath returns where oid belongs in the store's layout.
+func (s *FsObjectStore) objectPath(oid string) string {
+	dir := s.path
+	i := 0
+	for _, n := range s.fanout {
+		if i+n >= len(oid) {
+			break
+		}
+		dir = filepath.Join(dir, oid[i:i+n])
+		i += n
+	}
+	return filepath.Join(dir, oid)
+}
+
+// locate returns the path oid is stored at. In a sharded store that is
+// either where it belongs or, until it is migrated, the top level. If it
+// isn't stored at all that is where it belongs.
+func (s *FsObjectStore) locate(oid string) string {
+	path := s.objectPath(oid)
+	if len(s.fanout) == 0 {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	flat := filepath.Join(s.path, oid)
+	if _, err := os.Stat(flat); err == nil {
+		return flat
+	}
+	// Migrate may have moved it between the two checks.
+	return path
 }
 
 // List returns an array of hash strings for every object in the store.
-// TODO: Move this over to the metastore and use paging queries
-//       or this will be a weak point once there are a lot of files.
+// It reads the whole directory, so it is only meant for maintenance tasks;
+// GET /objects pages through MetaStore.Iterate instead.
 func (s *FsObjectStore) List() ([]string, error) {
 	files, err := ioutil.ReadDir(s.path)
 	if err != nil {
 		return nil, err
 	}
 	
-	N := len(files)
-	result := make([]string, N)
-	for i := 0; i < N; i++ {
-		result[i] = files[i].Name()
+	var result []string
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+			if len(s.fanout) > 0 && isShardDir(f.Name(), s.fanout[0]) {
+				if result, err = s.listShard(filepath.Join(s.path, f.Name()), 1, result); err != nil {
+					return nil, err
+				}
+			}
+		case isTempFile(f.Name()):
+		case len(s.fanout) > 0 && fileExists(s.objectPath(f.Name())):
+			// Already in place too, having been uploaded again since
+			// the layout changed.
+		default:
+			result = append(result, f.Name())
+		}
 	}
 	
 	return result, nil
 }
 
-// Get takes an hash string and and retreives the content from the store, returning
-// it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
-func (s *FsObjectStore) Get(hash string, fromByte int64) (io.ReadCloser, error) {
-	path := filepath.Join(s.path, hash)
-	f, err := os.Open(path)
+// listShard appends the objects in the shard directory dir, at the given
+// level, to result.
+func (s *FsObjectStore) listShard(dir string, level int, result []string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	if fromByte > 0 {
-		_, err = f.Seek(fromByte, os.SEEK_CUR)
+	for _, f := range files {
+		switch {
+		case level < len(s.fanout):
+			if f.IsDir() && isShardDir(f.Name(), s.fanout[level]) {
+				if result, err = s.listShard(filepath.Join(dir, f.Name()), level+1, result); err != nil {
+					return nil, err
+				}
+			}
+		case !f.IsDir():
+			result = append(result, f.Name())
+		}
 	}
-	return f, err
+	return result, nil
 }
 
-// DetectContentType takes a hash and attempts to determine the
-// MIME type of the associated object using net/http.DetectContentType
-// Returns "application/octet-stream" in the event of any errors.
-func (s *FsObjectStore) DetectContentType(hash string) string {
-	path := filepath.Join(s.path, hash)
-	f, err := os.Open(path)
+// isShardDir reports whether name could be a directory of n hex digits
+// in a sharded layout.
+func isShardDir(name string, n int) bool {
+	if len(name) != n {
+		return false
+	}
+	_, err := hex.DecodeString(strings.Repeat("0", n%2) + name)
+	return err == nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Migrate moves the objects at the top level of a sharded store, where a
+// flat store keeps them, to where they belong. Each is moved with a single
+// rename and locate looks in both places, so objects can be read throughout
+// and the store can be migrated while the server is running. It returns the
+// number of objects moved.
+func (s *FsObjectStore) Migrate() (int, error) {
+	if len(s.fanout) == 0 {
+		return 0, nil
+	}
+	
+	moved := 0
+	for {
+		// The directory is read in batches, as it may be huge, and again
+		// until nothing is left, as renaming entries while reading it
+		// can make the reads skip some.
+		dir, err := os.Open(s.path)
+		if err != nil {
+			return moved, err
+		}
+		pass := 0
+		for {
+			names, err := dir.Readdirnames(1024)
+			for _, name := range names {
+				if isTempFile(name) || !validOid(name) {
+					continue
+				}
+				if err := s.migrate(name); err != nil {
+					dir.Close()
+					return moved, err
+				}
+				pass++
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				dir.Close()
+				return moved, err
+			}
+		}
+		dir.Close()
+		moved += pass
+		if pass == 0 {
+			return moved, syncDir(s.path)
+		}
+	}
+}
+
+// migrate moves the object oid from the top level to where it belongs.
+func (s *FsObjectStore) migrate(oid string) error {
+	from := filepath.Join(s.path, oid)
+	to := s.objectPath(oid)
+	if err := s.makeDirs(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if fileExists(to) {
+		if err := os.Remove(from); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(to))
+}
+
+// makeDirs creates the shard directory dir and any missing parents, syncing
+// the parent of each one created so that it is durable.
+func (s *FsObjectStore) makeDirs(dir string) error {
+	if dir == s.path || fileExists(dir) {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if err := s.makeDirs(parent); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0750); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// TempFiles returns the names of the .tmp files in the store. While the
+// server is stopped these are all left over from writes that never finished.
+func (s *FsObjectStore) TempFiles() ([]string, error) {
+	files, err := ioutil.ReadDir(s.path)
 	if err != nil {
-		return "application/octet-stream"
+		return nil, err
 	}
-	defer f.Close()
 	
-	// Only the first 512 bytes are used to sniff the content type.
-	b := make([]byte, 512)
-	_, err = f.Read(b)
+	var result []string
+	for _, f := range files {
+		if !f.IsDir() && isTempFile(f.Name()) {
+			result = append(result, f.Name())
+		}
+	}
+	return result, nil
+}
+
+// RemoveTempFile deletes a .tmp file named by TempFiles.
+func (s *FsObjectStore) RemoveTempFile(name string) error {
+	if !isTempFile(name) || filepath.Base(name) != name {
+		return os.ErrNotExist
+	}
+	return os.Remove(filepath.Join(s.path, name))
+}
+
+// isTempFile reports whether name is one of the <hash>.tmp* files that put
+// writes to before renaming them.
+func isTempFile(name string) bool {
+	return strings.Contains(name, ".tmp")
+}
+
+// Get takes an hash string and and retreives the content from the store, returning
+// it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
+func (s *FsObjectStore) Get(hash string, fromByte int64) (io.ReadCloser, error) {
+	path := s.locate(hash)
+	f, err := os.Open(path)
 	if err != nil {
-		return "application/octet-stream"
+		return nil, err
+	}
+	if fromByte > 0 {
+		_, err = f.Seek(fromByte, io.SeekStart)
 	}
-	contentType := http.DetectContentType(b)
-	return contentType
+	return f, err
 }
 
 /*
  * Put takes an expected hash value and a io.Reader and attempts to store
- * it into the content store. Write initially happens into a <hash>.tmp
- * file and, upon completion:
- * 1) If the calculated hash matches the expected, the <hash>.tmp file
- *    is renamed to <hash> and the error is nil.
- * 2) If the hash doesn't match, <hash>.tmp is deleted and the returned
+ * it into the content store. Write initially happens into a uniquely
+ * named <hash>.tmp* file and, upon completion:
+ * 1) If the calculated hash matches the expected, the .tmp file is
+ *    synced to disk and renamed to <hash> and the error is nil.
+ * 2) If the hash doesn't match, the .tmp file is deleted and the returned
  *    error is errHashMismatch.
+ * Each attempt gets its own .tmp file, so one left behind by a crashed
+ * upload can't block a retry.
  */
 func (s *FsObjectStore) Put(hash string, r io.Reader) (int64, error) {
-	path := filepath.Join(s.path, hash)
-	tmpPath := path + ".tmp"
+	_, written, err := s.put(hash, r)
+	return written, err
+}
+
+// Ingest stores the content from r under its calculated hash, for when the
+// client doesn't know the hash up front. It returns the hash (the new OID).
+// If the object is already stored the new copy is simply discarded.
+func (s *FsObjectStore) Ingest(r io.Reader) (string, int64, error) {
+	return s.put("", r)
+}
+
+// UseIntentLog has the store record an intent in l before each new object
+// is renamed into place, to be ended when the object's meta is committed.
+// See recoverWrites.
+func (s *FsObjectStore) UseIntentLog(l IntentLog) {
+	s.intents = l
+}
+
+// stagedObject is content that has been written and synced to a .tmp file
+// and hashed, but not yet renamed into the store.
+type stagedObject struct {
+	tmpPath string
+	oid     string
+	size    int64
+}
+
+// put does the work for Put and Ingest. If hash is empty, the calculated
+// hash is used to name the object.
+//
+// A write is durable once put returns: the content is synced before the
+// rename that makes it an object, so a crash can't leave a torn object under
+// its permanent name, and the directory is synced after it, so the rename
+// itself survives. A crash part way through leaves at most a .tmp file, or
+// an object with an intent but no meta, which recoverWrites removes.
+func (s *FsObjectStore) put(hash string, r io.Reader) (string, int64, error) {
+	o, err := s.stage(hash, r)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(o.tmpPath)
+	
+	if hash == "" && s.Exists(o.oid) {
+		return o.oid, o.size, nil
+	}
+	
+	if s.intents != nil {
+		if err := s.intents.BeginIntent(o.oid); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := s.link(o); err != nil {
+		return "", 0, err
+	}
+	
+	return o.oid, o.size, nil
+}
 
-	dir := filepath.Dir(path)
+// stage writes the content from r to a .tmp file, syncs it and checks it
+// hashes to hash, if given. The .tmp file is removed if anything fails.
+func (s *FsObjectStore) stage(hash string, r io.Reader) (*stagedObject, error) {
+	dir := s.path
 	if err := os.MkdirAll(dir, 0750); err != nil {
-		return 0, err
+		return nil, err
 	}
 	
 	// Create the .tmp file
-	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	prefix := hash
+	if prefix == "" {
+		prefix = "ingest"
+	}
+	file, err := ioutil.TempFile(dir, prefix+".tmp")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer os.Remove(tmpPath)
+	tmpPath := file.Name()
 	
 	// Write to the .tmp file and calculate the sha256 at the same time
 	h := sha256.New()
 	hw := io.MultiWriter(h, file)
 	written, err := io.Copy(hw, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		file.Close()
-		return 0, err
+		os.Remove(tmpPath)
+		return nil, err
 	}
 	logger.Log(kv{"method": "FsObjectStore.Put()", "hash": hash, "length": written})
-	file.Close()
 	
 	// Chech the hash matches or error out
 	hash_chk := hex.EncodeToString(h.Sum(nil))
-	if hash_chk != hash {
+	if hash != "" && hash_chk != hash {
 		logger.Log(kv{"method": "FsObjectStore.Put()", "hash": hash, "calulated_hash": hash_chk})
-		return 0, errHashMismatch
+		os.Remove(tmpPath)
+		return nil, errHashMismatch
 	}
 	
-	// Rename the file to drop the .tmp
-	if err := os.Rename(tmpPath, path); err != nil {
-		return 0, err
+	return &stagedObject{tmpPath: tmpPath, oid: hash_chk, size: written}, nil
+}
+
+// link renames a staged object into place, dropping the .tmp, and syncs
+// the directory so the rename is durable.
+func (s *FsObjectStore) link(o *stagedObject) error {
+	path := s.objectPath(o.oid)
+	if err := s.makeDirs(filepath.Dir(path)); err != nil {
+		return err
 	}
-	
-	return written, nil
+	if err := os.Rename(o.tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// remove deletes an object, for recoverWrites to roll back an interrupted
+// write.
+func (s *FsObjectStore) remove(oid string) error {
+	path := s.locate(oid)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory, making the renames and removals in it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
 /*
@@ -146,7 +453,7 @@ func (s *FsObjectStore) Put(hash string, r io.Reader) (int64, error) {
  * uploading the same file at the same time.
  */
 func (s *FsObjectStore) Exists(hash string) bool {
-	path := filepath.Join(s.path, hash)
+	path := s.locate(hash)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
 	}
@@ -8,24 +8,21 @@ import (
 	"testing"
 )
 
-var contentStore *ContentStore
+var contentStore *FsObjectStore
 
 func TestContentStorePut(t *testing.T) {
 	setup()
 	defer teardown()
 
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 12,
-	}
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
 
 	b := bytes.NewBuffer([]byte("test content"))
 
-	if err := contentStore.Put(m, b); err != nil {
+	if _, err := contentStore.Put(oid, b); err != nil {
 		t.Fatalf("expected put to succeed, got: %s", err)
 	}
 
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	path := "content-store-test/" + oid
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		t.Fatalf("expected content to exist after putting")
 	}
@@ -35,60 +32,33 @@ func TestContentStorePutHashMismatch(t *testing.T) {
 	setup()
 	defer teardown()
 
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 12,
-	}
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
 
 	b := bytes.NewBuffer([]byte("bogus content"))
 
-	if err := contentStore.Put(m, b); err == nil {
+	if _, err := contentStore.Put(oid, b); err == nil {
 		t.Fatal("expected put with bogus content to fail")
 	}
 
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	path := "content-store-test/" + oid
 	if _, err := os.Stat(path); err == nil {
 		t.Fatalf("expected content to not exist after putting bogus content")
 	}
 }
 
-func TestContentStorePutSizeMismatch(t *testing.T) {
-	setup()
-	defer teardown()
-
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 14,
-	}
-
-	b := bytes.NewBuffer([]byte("test content"))
-
-	if err := contentStore.Put(m, b); err == nil {
-		t.Fatal("expected put with bogus size to fail")
-	}
-
-	path := "content-store-test/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
-	if _, err := os.Stat(path); err == nil {
-		t.Fatalf("expected content to not exist after putting bogus size")
-	}
-}
-
 func TestContentStoreGet(t *testing.T) {
 	setup()
 	defer teardown()
 
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 12,
-	}
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
 
 	b := bytes.NewBuffer([]byte("test content"))
 
-	if err := contentStore.Put(m, b); err != nil {
+	if _, err := contentStore.Put(oid, b); err != nil {
 		t.Fatalf("expected put to succeed, got: %s", err)
 	}
 
-	r, err := contentStore.Get(m, 0)
+	r, err := contentStore.Get(oid, 0)
 	if err != nil {
 		t.Fatalf("expected get to succeed, got: %s", err)
 	} else {
@@ -105,18 +75,15 @@ func TestContentStoreGetWithRange(t *testing.T) {
 	setup()
 	defer teardown()
 
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 12,
-	}
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
 
 	b := bytes.NewBuffer([]byte("test content"))
 
-	if err := contentStore.Put(m, b); err != nil {
+	if _, err := contentStore.Put(oid, b); err != nil {
 		t.Fatalf("expected put to succeed, got: %s", err)
 	}
 
-	r, err := contentStore.Get(m, 5)
+	r, err := contentStore.Get(oid, 5)
 	if err != nil {
 		t.Fatalf("expected get to succeed, got: %s", err)
 	} else {
@@ -133,7 +100,7 @@ func TestContenStoreGetNonExisting(t *testing.T) {
 	setup()
 	defer teardown()
 
-	_, err := contentStore.Get(&MetaObject{Oid: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, 0)
+	_, err := contentStore.Get("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", 0)
 	if err == nil {
 		t.Fatalf("expected to get an error, but content existed")
 	}
@@ -143,28 +110,129 @@ func TestContentStoreExists(t *testing.T) {
 	setup()
 	defer teardown()
 
-	m := &MetaObject{
-		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
-		Size: 12,
-	}
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
 
 	b := bytes.NewBuffer([]byte("test content"))
 
-	if contentStore.Exists(m) {
+	if contentStore.Exists(oid) {
 		t.Fatalf("expected content to not exist yet")
 	}
 
-	if err := contentStore.Put(m, b); err != nil {
+	if _, err := contentStore.Put(oid, b); err != nil {
 		t.Fatalf("expected put to succeed, got: %s", err)
 	}
 
-	if !contentStore.Exists(m) {
+	if !contentStore.Exists(oid) {
 		t.Fatalf("expected content to exist")
 	}
 }
 
+func TestContentStoreIngest(t *testing.T) {
+	setup()
+	defer teardown()
+
+	b := bytes.NewBuffer([]byte("test content"))
+
+	oid, n, err := contentStore.Ingest(b)
+	if err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+	if oid != "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72" {
+		t.Fatalf("expected oid to be the content hash, got: %s", oid)
+	}
+	if n != 12 {
+		t.Fatalf("expected 12 bytes written, got: %d", n)
+	}
+
+	if !contentStore.Exists(oid) {
+		t.Fatalf("expected content to exist after ingesting")
+	}
+
+	// Ingesting the same content again is fine and changes nothing
+	again, _, err := contentStore.Ingest(bytes.NewBuffer([]byte("test content")))
+	if err != nil || again != oid {
+		t.Fatalf("expected repeat ingest to return the same oid, got: %s, %v", again, err)
+	}
+
+	files, _ := ioutil.ReadDir("content-store-test")
+	if len(files) != 1 {
+		t.Fatalf("expected no temporary files to be left behind, got %d files", len(files))
+	}
+}
+
+func TestShardedContentStore(t *testing.T) {
+	setup()
+	defer teardown()
+	store, err := NewShardedFsObjectStore("content-store-sharded-test", []int{2, 2})
+	if err != nil {
+		t.Fatalf("expected the store to be created, got: %s", err)
+	}
+	defer os.RemoveAll("content-store-sharded-test")
+
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	if _, err := store.Put(oid, bytes.NewBuffer([]byte("test content"))); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if _, err := os.Stat("content-store-sharded-test/6a/e8/" + oid); err != nil {
+		t.Fatalf("expected content to be stored in its shard, got: %s", err)
+	}
+
+	// An object left at the top level by a flat store is still found
+	legacy, _, _ := contentStore.Ingest(bytes.NewBuffer([]byte("legacy content")))
+	old, _ := ioutil.ReadFile("content-store-test/" + legacy)
+	ioutil.WriteFile("content-store-sharded-test/"+legacy, old, 0640)
+
+	if !store.Exists(legacy) {
+		t.Fatalf("expected the flat object to exist")
+	}
+	if r, err := store.Get(legacy, 0); err != nil {
+		t.Fatalf("expected to get the flat object, got: %s", err)
+	} else {
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != "legacy content" {
+			t.Fatalf("expected the flat object's content, got: %q", b)
+		}
+	}
+	if oids, _ := store.List(); len(oids) != 2 {
+		t.Fatalf("expected both layouts to be listed, got: %v", oids)
+	}
+
+	n, err := store.Migrate()
+	if err != nil || n != 1 {
+		t.Fatalf("expected one object to be migrated, got: %d, %v", n, err)
+	}
+	if _, err := os.Stat("content-store-sharded-test/" + legacy[:2] + "/" + legacy[2:4] + "/" + legacy); err != nil {
+		t.Fatalf("expected the object to be moved to its shard, got: %s", err)
+	}
+	if _, err := os.Stat("content-store-sharded-test/" + legacy); !os.IsNotExist(err) {
+		t.Fatalf("expected the object to be gone from the top level, got: %v", err)
+	}
+	if oids, _ := store.List(); len(oids) != 2 || !store.Exists(legacy) {
+		t.Fatalf("expected both objects to be listed after migrating, got: %v", oids)
+	}
+	if n, err := store.Migrate(); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to migrate, got: %d, %v", n, err)
+	}
+}
+
+func TestParseStoreLayout(t *testing.T) {
+	cases := map[string][]int{"": nil, "flat": nil, "2": {2}, "2/2": {2, 2}, "1/3/4": {1, 3, 4}}
+	for layout, want := range cases {
+		got, err := parseStoreLayout(layout)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: expected %v, got: %v, %v", layout, want, got, err)
+		}
+	}
+	for _, bad := range []string{"sharded", "0", "2/", "5", "4/4/4"} {
+		if _, err := parseStoreLayout(bad); err != errInvalidLayout {
+			t.Errorf("%q: expected errInvalidLayout, got: %v", bad, err)
+		}
+	}
+}
+
 func setup() {
-	store, err := NewContentStore("content-store-test")
+	store, err := NewFsObjectStore("content-store-test")
 	if err != nil {
 		fmt.Printf("error initializing content store: %s\n", err)
 		os.Exit(1)
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"time"
+)
+
+// FsckEntry names an object's meta in one namespace, empty being the
+// default namespace.
+type FsckEntry struct {
+	Namespace string `json:"namespace"`
+	Oid       string `json:"oid"`
+}
+
+// FsckReport is what Fsck found. Orphans are objects with no meta in any
+// namespace, Dangling meta whose object isn't in the store, and Unreadable
+// objects that are listed but couldn't be read to the end. Interrupted are
+// objects without meta whose write has an open intent: uploads a crash cut
+// short, which recoverWrites rolls back as the server starts.
+type FsckReport struct {
+	Objects        int         `json:"objects"`
+	Orphans        []string    `json:"orphans,omitempty"`
+	Interrupted    []string    `json:"interrupted,omitempty"`
+	Dangling       []FsckEntry `json:"dangling,omitempty"`
+	TempFiles      []string    `json:"temp-files,omitempty"`
+	SizeMismatches []FsckEntry `json:"size-mismatches,omitempty"`
+	HashMismatches []string    `json:"hash-mismatches,omitempty"`
+	Unreadable     []string    `json:"unreadable,omitempty"`
+	Repaired       int         `json:"repaired"`
+}
+
+// Problems returns the number of problems found, less those repaired.
+func (r *FsckReport) Problems() int {
+	return len(r.Orphans) + len(r.Interrupted) + len(r.Dangling) + len(r.TempFiles) + len(r.SizeMismatches) + len(r.HashMismatches) + len(r.Unreadable) - r.Repaired
+}
+
+// tempFileStore is implemented by object stores that write through
+// temporary files, which a crash can leave behind.
+type tempFileStore interface {
+	TempFiles() ([]string, error)
+	RemoveTempFile(name string) error
+}
+
+// Fsck checks that the object store and the meta store agree: that every
+// object has meta and every piece of meta an object, that objects still
+// hash to their OIDs and have the sizes their meta gives, and that no
+// temporary files are left over. With repair, orphaned objects that hash
+// correctly are given meta in the default namespace, their content type
+// sniffed as for a new upload, and temporary files are deleted. Nothing
+// else can be repaired without losing data, so is only reported.
+//
+// Objects with an open intent are never given meta: the upload may have
+// been for another namespace, and it is rolled back when the server next
+// starts.
+//
+// It must only be run while the server is stopped.
+func Fsck(st ObjectStore, ms *BoltMetaStore, sn *Sniffer, repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+
+	// The meta of every object, by OID, across all namespaces.
+	namespaces, err := ms.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	metas := make(map[string]map[string]*MetaData)
+	for _, ns := range append([]string{""}, namespaces...) {
+		nms := ms.Namespace(ns)
+		oids, err := nms.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, oid := range oids {
+			meta, err := nms.Get(oid)
+			if err != nil {
+				return nil, err
+			}
+			if metas[oid] == nil {
+				metas[oid] = make(map[string]*MetaData)
+			}
+			metas[oid][ns] = meta
+		}
+	}
+
+	intents, err := ms.Intents()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]bool, len(intents))
+	for _, oid := range intents {
+		pending[oid] = true
+	}
+
+	oids, err := st.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(oids)
+	stored := make(map[string]bool, len(oids))
+	for _, oid := range oids {
+		if !validOid(oid) {
+			continue
+		}
+		stored[oid] = true
+		report.Objects++
+
+		size, sum, err := hashObject(st, oid)
+		if err != nil {
+			// Neither its size nor its hash is known, and it can't be
+			// repaired, but the rest of the store can still be checked.
+			report.Unreadable = append(report.Unreadable, oid)
+			logger.Log(kv{"fn": "fsck", "oid": oid, "err": err.Error()})
+			if len(metas[oid]) == 0 {
+				report.Orphans = append(report.Orphans, oid)
+				logger.Log(kv{"fn": "fsck", "oid": oid, "err": "Object has no meta"})
+			}
+			continue
+		}
+		if sum != oid {
+			report.HashMismatches = append(report.HashMismatches, oid)
+			logger.Log(kv{"fn": "fsck", "oid": oid, "err": errHashMismatch.Error()})
+		}
+
+		if len(metas[oid]) == 0 && pending[oid] {
+			report.Interrupted = append(report.Interrupted, oid)
+			logger.Log(kv{"fn": "fsck", "oid": oid, "err": "Object has an open intent"})
+			continue
+		}
+		if len(metas[oid]) == 0 {
+			report.Orphans = append(report.Orphans, oid)
+			logger.Log(kv{"fn": "fsck", "oid": oid, "err": "Object has no meta"})
+			if repair && sum == oid {
+				if err := rebuildMeta(st, ms, sn, oid, size); err != nil {
+					return nil, err
+				}
+				report.Repaired++
+				logger.Log(kv{"fn": "fsck", "oid": oid, "msg": "meta rebuilt"})
+			}
+			continue
+		}
+		for _, ns := range sortedNamespaces(metas[oid]) {
+			if metas[oid][ns].Length != size {
+				report.SizeMismatches = append(report.SizeMismatches, FsckEntry{ns, oid})
+				logger.Log(kv{"fn": "fsck", "oid": oid, "namespace": ns, "size": size, "meta-size": metas[oid][ns].Length, "err": errSizeMismatch.Error()})
+			}
+		}
+	}
+
+	var dangling []string
+	for oid := range metas {
+		if !stored[oid] {
+			dangling = append(dangling, oid)
+		}
+	}
+	sort.Strings(dangling)
+	for _, oid := range dangling {
+		for _, ns := range sortedNamespaces(metas[oid]) {
+			report.Dangling = append(report.Dangling, FsckEntry{ns, oid})
+			logger.Log(kv{"fn": "fsck", "oid": oid, "namespace": ns, "err": errObjectNotFound.Error()})
+		}
+	}
+
+	if ts, ok := st.(tempFileStore); ok {
+		names, err := ts.TempFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			report.TempFiles = append(report.TempFiles, name)
+			logger.Log(kv{"fn": "fsck", "file": name, "err": "Leftover temporary file"})
+			if repair {
+				if err := ts.RemoveTempFile(name); err != nil {
+					return nil, err
+				}
+				report.Repaired++
+				logger.Log(kv{"fn": "fsck", "file": name, "msg": "removed"})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// hashObject reads an object, returning its size and SHA256.
+func hashObject(st ObjectStore, oid string) (int64, string, error) {
+	r, err := st.Get(oid, 0)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rebuildMeta stores meta for an object that has none, in the default
+// namespace. Its filename was lost with its meta.
+func rebuildMeta(st ObjectStore, ms MetaStore, sn *Sniffer, oid string, size int64) error {
+	meta := &MetaData{Length: size, Created: time.Now().Unix()}
+	meta.ContentType, meta.ContentTypeFrom = sn.DetectObject(st, oid, "")
+	return ms.Put(oid, meta)
+}
+
+func sortedNamespaces(m map[string]*MetaData) []string {
+	names := make([]string, 0, len(m))
+	for ns := range m {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFsck(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta() // contentOid has meta but no object
+	defer teardownMeta()
+
+	// good has meta, orphan doesn't, short's meta in a namespace has the
+	// wrong size and rotten no longer hashes to its OID.
+	good, _, _ := contentStore.Ingest(bytes.NewReader(randomData(1, 1000)))
+	metaStoreTest.Put(good, &MetaData{FileName: "good.bin", Length: 1000})
+	orphan, _, _ := contentStore.Ingest(bytes.NewBufferString("a,b\n1,2\n"))
+	short, _, _ := contentStore.Ingest(bytes.NewReader(randomData(2, 1000)))
+	metaStoreTest.Namespace("team").Put(short, &MetaData{FileName: "short.bin", Length: 999})
+	rotten, _, _ := contentStore.Ingest(bytes.NewReader(randomData(3, 1000)))
+	metaStoreTest.Put(rotten, &MetaData{FileName: "rotten.bin", Length: 1000})
+	ioutil.WriteFile("content-store-test/"+rotten, randomData(4, 1000), 0640)
+	ioutil.WriteFile("content-store-test/"+good+".tmp123", []byte("partial"), 0640)
+
+	if oids, _ := contentStore.List(); len(oids) != 4 {
+		t.Fatalf("expected List to skip temporary files, got: %v", oids)
+	}
+
+	report, err := Fsck(contentStore, metaStoreTest, NewSniffer(), false)
+	if err != nil {
+		t.Fatalf("expected fsck to succeed, got: %s", err)
+	}
+	expected := &FsckReport{
+		Objects:        4,
+		Orphans:        []string{orphan},
+		Dangling:       []FsckEntry{{"", contentOid}},
+		TempFiles:      []string{good + ".tmp123"},
+		SizeMismatches: []FsckEntry{{"team", short}},
+		HashMismatches: []string{rotten},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("expected %+v, got: %+v", expected, report)
+	}
+	if _, err := metaStoreTest.Get(orphan); err != errObjectNotFound {
+		t.Fatalf("expected a dry run to change nothing, got: %v", err)
+	}
+	if _, err := os.Stat("content-store-test/" + good + ".tmp123"); err != nil {
+		t.Fatalf("expected a dry run to leave temporary files, got: %v", err)
+	}
+
+	report, err = Fsck(contentStore, metaStoreTest, NewSniffer(), true)
+	if err != nil {
+		t.Fatalf("expected fsck to succeed, got: %s", err)
+	}
+	if report.Repaired != 2 || report.Problems() != 3 {
+		t.Fatalf("expected the orphan and temporary file to be repaired, got: %+v", report)
+	}
+	meta, err := metaStoreTest.Get(orphan)
+	if err != nil || meta.Length != 8 || meta.ContentType != "text/plain; charset=utf-8" || meta.ContentTypeFrom != sniffText {
+		t.Fatalf("expected the orphan's meta to be rebuilt, got: %+v, %v", meta, err)
+	}
+
+	report, err = Fsck(contentStore, metaStoreTest, NewSniffer(), false)
+	if err != nil {
+		t.Fatalf("expected fsck to succeed, got: %s", err)
+	}
+	if len(report.Orphans) != 0 || len(report.TempFiles) != 0 || report.Problems() != 3 {
+		t.Fatalf("expected only what can't be repaired to be left, got: %+v", report)
+	}
+}
+
+// unreadableStore fails to read one of its objects part way through.
+type unreadableStore struct {
+	ObjectStore
+	oid string
+}
+
+func (s *unreadableStore) Get(oid string, fromByte int64) (io.ReadCloser, error) {
+	if oid == s.oid {
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.TimeoutReader(strings.NewReader("x")))), nil
+	}
+	return s.ObjectStore.Get(oid, fromByte)
+}
+
+func TestFsckUnreadable(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+
+	bad, _, _ := contentStore.Ingest(bytes.NewReader(randomData(1, 1000)))
+	metaStoreTest.Put(bad, &MetaData{FileName: "bad.bin", Length: 1000})
+	good, _, _ := contentStore.Ingest(bytes.NewReader(randomData(2, 1000)))
+	metaStoreTest.Put(good, &MetaData{FileName: "good.bin", Length: 999})
+
+	report, err := Fsck(&unreadableStore{contentStore, bad}, metaStoreTest, NewSniffer(), false)
+	if err != nil {
+		t.Fatalf("expected fsck to carry on past an unreadable object, got: %s", err)
+	}
+	if report.Objects != 2 || len(report.Unreadable) != 1 || report.Unreadable[0] != bad {
+		t.Fatalf("expected the object to be reported unreadable, got: %+v", report)
+	}
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0].Oid != good {
+		t.Fatalf("expected the objects after it to be checked, got: %+v", report)
+	}
+}
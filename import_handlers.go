@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ImportResult reports what happened to one member of an imported archive.
+// Status is "Created", "Already Exists" or the error that stopped the member
+// being stored.
+type ImportResult struct {
+	Path    string `json:"path"`
+	Oid     string `json:"oid,omitempty"`
+	Size    int64  `json:"size"`
+	Status  string `json:"status"`
+	Existed bool   `json:"existed"`
+}
+
+// defaultMaxImportSize limits the size of an archive sent to /import, unless
+// ND_IMPORTMAXSIZE says otherwise.
+const defaultMaxImportSize = 1 << 30
+
+// importFormats maps the media types an archive can be uploaded as to its
+// format.
+var importFormats = map[string]string{
+	"application/x-tar":            formatTar,
+	"application/gzip":             formatTarGz,
+	"application/x-gzip":           formatTarGz,
+	"application/zip":              formatZip,
+	"application/x-zip-compressed": formatZip,
+}
+
+// ImportHandler stores each regular file in an uploaded tar, tar.gz or zip
+// archive as an object of its own, hashed as it is stored, with its filename
+// taken from the archive. The format is given with "?format=" or the
+// request's Content-Type, or detected from the archive. Attributes and tags
+// sent in X-ND-Attributes and X-ND-Tags are given to every member.
+//
+// The response reports on each member. With "?manifest=1" a manifest of the
+// stored members at their paths in the archive is created too, named by
+// X-ND-Filename, and returned as the response's oid and meta. Archives
+// larger than the App's maxImportSize are refused with 413.
+func (a *App) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	var common MetaData
+	if err := addAttributes(&common, r.Header.Get("X-ND-Attributes"), r.Header.Get("X-ND-Tags")); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format = importFormats[mt]
+	}
+	ar, err := openArchive(format, http.MaxBytesReader(w, r.Body, a.maxImportSize), a.importDir)
+	if err != nil {
+		writeError(w, r, importErrorCode(err), err)
+		return
+	}
+	defer ar.Close()
+
+	ms := a.metaStoreFor(r)
+	var results []ImportResult
+	paths := make(map[string]string)
+	for {
+		name, content, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Members read before the archive broke off are kept
+			writeResponseData(w, r, &ResponseData{code: importErrorCode(err), Status: err.Error(), Imported: results})
+			return
+		}
+
+		res := ImportResult{Path: name}
+		p, ok := importPath(name)
+		if !ok {
+			res.Status = errInvalidManifestPath.Error()
+			results = append(results, res)
+			continue
+		}
+		meta := &MetaData{FileName: path.Base(p), Attributes: common.Attributes, Tags: common.Tags}
+		d, err := a.ingestObject(ms, meta, content)
+		if err != nil {
+			res.Status = err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.Oid, res.Size, res.Status = d.Oid, d.Meta.Length, d.Status
+		res.Existed = d.Status == "Already Exists"
+		results = append(results, res)
+		// A later member at the same path replaces an earlier one, as
+		// it would when unpacking the archive
+		paths[p] = d.Oid
+	}
+
+	d := &ResponseData{code: 200, Status: "OK", Imported: results}
+	if r.URL.Query().Get("manifest") != "" && len(paths) > 0 {
+		var entries []ManifestEntry
+		for p, oid := range paths {
+			entries = append(entries, ManifestEntry{Path: p, Oid: oid})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+		m, err := a.storeManifest(ms, entries, &MetaData{FileName: r.Header.Get("X-ND-Filename")})
+		if err != nil {
+			writeResponseData(w, r, &ResponseData{code: manifestErrorCode(err), Status: err.Error(), Imported: results})
+			return
+		}
+		d.Oid, d.Meta, d.Manifest = m.Oid, m.Meta, m.Manifest
+		w.Header().Set("Location", namespacePath(r)+"/objects/"+m.Oid)
+	}
+	writeResponseData(w, r, d)
+}
+
+// importErrorCode maps an error reading an archive onto an HTTP status code.
+func importErrorCode(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return 413
+	}
+	return 400
+}
+
+// ingestObject stores content whose OID isn't known in advance, hashing it
+// as it is written to the ObjectStore, and records meta for it.
+func (a *App) ingestObject(ms MetaStore, meta *MetaData, content io.Reader) (*ResponseData, error) {
+	oid, written, err := a.objectStore.Ingest(content)
+	if err != nil {
+		return nil, err
+	}
+	return a.recordNewMeta(ms, oid, meta, written)
+}
+
+// importPath cleans up the name of an archive member, which may have been
+// written with a leading "./" or "/", or with backslashes on Windows. Names
+// that would land outside the archive's directory are refused.
+func importPath(name string) (string, bool) {
+	p := strings.Replace(name, "\\", "/", -1)
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	return p, validManifestPath(p)
+}
@@ -0,0 +1,60 @@
+package main
+
+// recoverWrites finishes what a crash interrupted, before the server
+// starts. Each object with a pending intent either has meta in some
+// namespace, in which case another upload of it committed and the intent is
+// simply ended, or never had its meta committed, in which case it is
+// removed, so the object and its meta are added together or not at all. An
+// object with a pending intent that doesn't hash to its OID is torn, and is
+// removed even if it has meta. Leftover .tmp files are removed too.
+//
+// It returns the OIDs of the objects removed.
+func recoverWrites(st *FsObjectStore, ms *BoltMetaStore) ([]string, error) {
+	oids, err := ms.Intents()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := ms.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, oid := range oids {
+		torn := false
+		if st.Exists(oid) {
+			_, sum, err := hashObject(st, oid)
+			torn = err != nil || sum != oid
+		}
+		committed := false
+		for _, ns := range append([]string{""}, namespaces...) {
+			if _, err := ms.Namespace(ns).Get(oid); err == nil {
+				committed = true
+				break
+			}
+		}
+
+		if torn || (!committed && st.Exists(oid)) {
+			if err := st.remove(oid); err != nil {
+				return nil, err
+			}
+			removed = append(removed, oid)
+			logger.Log(kv{"fn": "recoverWrites", "oid": oid, "torn": torn, "committed": committed, "msg": "removed"})
+		}
+		if err := ms.EndIntent(oid); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := st.TempFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := st.RemoveTempFile(name); err != nil {
+			return nil, err
+		}
+		logger.Log(kv{"fn": "recoverWrites", "file": name, "msg": "removed"})
+	}
+	return removed, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// TestRecoverWrites crashes uploads at each step of a write, by running the
+// steps of FsObjectStore.put only so far, and checks that recovery leaves
+// each object either stored with its meta or not stored at all.
+func TestRecoverWrites(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+	contentStore.UseIntentLog(metaStoreTest)
+
+	content := make(map[string][]byte)
+	oids := make(map[string]string)
+	for i, step := range []string{"writing", "staged", "intent", "linked", "torn", "committed", "shared"} {
+		content[step] = randomData(int64(i), 1000)
+		oids[step] = sha256Hex(content[step])
+	}
+	stage := func(step string) *stagedObject {
+		o, err := contentStore.stage(oids[step], bytes.NewReader(content[step]))
+		if err != nil {
+			t.Fatalf("%s: expected stage to succeed, got: %s", step, err)
+		}
+		return o
+	}
+	link := func(step string, o *stagedObject) {
+		if err := metaStoreTest.BeginIntent(oids[step]); err != nil {
+			t.Fatalf("%s: expected intent to succeed, got: %s", step, err)
+		}
+		if err := contentStore.link(o); err != nil {
+			t.Fatalf("%s: expected link to succeed, got: %s", step, err)
+		}
+	}
+
+	// Crashed while writing the .tmp file
+	ioutil.WriteFile("content-store-test/"+oids["writing"]+".tmp1", content["writing"][:300], 0640)
+
+	// Crashed once the .tmp file was synced
+	stage("staged")
+
+	// Crashed once the intent was recorded
+	stage("intent")
+	metaStoreTest.BeginIntent(oids["intent"])
+
+	// Crashed once the object was renamed into place, before its meta
+	link("linked", stage("linked"))
+
+	// As above, but the object was torn, as it could be without the sync
+	link("torn", stage("torn"))
+	os.Truncate("content-store-test/"+oids["torn"], 10)
+
+	// Finished: committing the meta ended the intent
+	if _, err := contentStore.Put(oids["committed"], bytes.NewReader(content["committed"])); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if intents, _ := metaStoreTest.Intents(); !containsString(intents, oids["committed"]) {
+		t.Fatalf("expected an intent until the meta is committed, got: %v", intents)
+	}
+	metaStoreTest.Put(oids["committed"], &MetaData{FileName: "committed.bin", Length: 1000})
+	if intents, _ := metaStoreTest.Intents(); containsString(intents, oids["committed"]) {
+		t.Fatalf("expected committing the meta to end the intent, got: %v", intents)
+	}
+
+	// Stored with meta in one namespace, then crashed while being uploaded
+	// again for another
+	contentStore.Put(oids["shared"], bytes.NewReader(content["shared"]))
+	metaStoreTest.Namespace("team").Put(oids["shared"], &MetaData{FileName: "shared.bin", Length: 1000})
+	link("shared", stage("shared"))
+
+	removed, err := recoverWrites(contentStore, metaStoreTest)
+	if err != nil {
+		t.Fatalf("expected recovery to succeed, got: %s", err)
+	}
+	sort.Strings(removed)
+	expected := []string{oids["linked"], oids["torn"]}
+	sort.Strings(expected)
+	if len(removed) != 2 || removed[0] != expected[0] || removed[1] != expected[1] {
+		t.Errorf("expected the uncommitted objects to be removed, got: %v", removed)
+	}
+
+	listed, _ := contentStore.List()
+	sort.Strings(listed)
+	expected = []string{oids["committed"], oids["shared"]}
+	sort.Strings(expected)
+	if len(listed) != 2 || listed[0] != expected[0] || listed[1] != expected[1] {
+		t.Errorf("expected only the committed objects to be left, got: %v", listed)
+	}
+	if names, _ := contentStore.TempFiles(); len(names) != 0 {
+		t.Errorf("expected the .tmp files to be removed, got: %v", names)
+	}
+	if intents, _ := metaStoreTest.Intents(); len(intents) != 0 {
+		t.Errorf("expected no intents to be left, got: %v", intents)
+	}
+}
+
+// TestFsckInterruptedWrite checks that fsck leaves an upload a crash cut
+// short for recovery, rather than giving it meta in the default namespace.
+func TestFsckInterruptedWrite(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+	contentStore.UseIntentLog(metaStoreTest)
+
+	data := randomData(1, 1000)
+	oid := sha256Hex(data)
+	o, err := contentStore.stage(oid, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expected stage to succeed, got: %s", err)
+	}
+	metaStoreTest.BeginIntent(oid)
+	contentStore.link(o)
+
+	report, err := Fsck(contentStore, metaStoreTest, NewSniffer(), true)
+	if err != nil {
+		t.Fatalf("expected fsck to succeed, got: %s", err)
+	}
+	if len(report.Interrupted) != 1 || report.Interrupted[0] != oid || len(report.Orphans) != 0 || report.Repaired != 0 {
+		t.Fatalf("expected the write to be reported as interrupted, got: %+v", report)
+	}
+	if _, err := metaStoreTest.Get(oid); err != errObjectNotFound {
+		t.Fatalf("expected no meta to be made for an interrupted write, got: %v", err)
+	}
+	if intents, _ := metaStoreTest.Intents(); !containsString(intents, oid) {
+		t.Fatalf("expected the intent to be left open, got: %v", intents)
+	}
+
+	if removed, err := recoverWrites(contentStore, metaStoreTest); err != nil || len(removed) != 1 || removed[0] != oid {
+		t.Fatalf("expected recovery to roll the write back, got: %v, %v", removed, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidOperation = errors.New("Operation must be download or upload")
+	errNoTransfer       = errors.New("Only the basic transfer adapter is supported")
+	errLFSNotFound      = errors.New("Object does not exist")
+)
+
+// lfsActionExpiry is how long the actions in a batch response are offered
+// for.
+const lfsActionExpiry = time.Hour
+
+// lfsObject is an object as named in Git LFS requests.
+type lfsObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// batchRequest is the body of POST /lfs/objects/batch
+type batchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers,omitempty"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+// lfsAction tells a Git LFS client where to send or fetch an object.
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError       `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Transfer string         `json:"transfer,omitempty"`
+	Objects  []*batchObject `json:"objects"`
+}
+
+// lfsError is the body of a failed Git LFS request.
+type lfsError struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AcceptsLFS provides a mux.MatcherFunc that only allows requests that
+// contain an Accept header with the Git LFS media type.
+func AcceptsLFS(r *http.Request, m *mux.RouteMatch) bool {
+	mediaParts := strings.Split(r.Header.Get("Accept"), ";")
+	return strings.TrimSpace(mediaParts[0]) == lfsMediaType
+}
+
+func writeLFS(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	logRequest(r, code)
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeLFSError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	id, _ := context.Get(r, "RequestID").(string)
+	writeLFS(w, r, code, &lfsError{Message: err.Error(), RequestID: id})
+}
+
+// BatchHandler implements the Git LFS v1 batch API with the basic transfer
+// adapter. Downloads are served by GET /objects/{oid} and uploads go to PUT
+// /objects/{oid} like any other, so objects pushed with git lfs are ordinary
+// objects in the namespace, without a filename.
+func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSError(w, r, 400, err)
+		return
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		writeLFSError(w, r, 422, errInvalidOperation)
+		return
+	}
+	if len(req.Transfers) > 0 && !containsString(req.Transfers, "basic") {
+		writeLFSError(w, r, 422, errNoTransfer)
+		return
+	}
+	if req.Operation == "upload" && !requestIdentity(r).Can(scopeWrite) {
+		writeLFSError(w, r, 403, errForbidden)
+		return
+	}
+
+	ms := a.metaStoreFor(r)
+	res := &batchResponse{Transfer: "basic", Objects: []*batchObject{}}
+	for _, o := range req.Objects {
+		bo := &batchObject{Oid: o.Oid, Size: o.Size, Authenticated: true}
+		res.Objects = append(res.Objects, bo)
+		if !validOid(o.Oid) || o.Size < 0 {
+			bo.Error = &lfsObjectError{Code: 422, Message: errInvalidOid.Error()}
+			continue
+		}
+
+		meta, err := ms.Get(o.Oid)
+		stored := err == nil && a.objectStore.Exists(o.Oid)
+		switch {
+		case req.Operation == "download" && !stored:
+			bo.Error = &lfsObjectError{Code: 404, Message: errLFSNotFound.Error()}
+		case req.Operation == "download":
+			bo.Actions = map[string]*lfsAction{
+				"download": lfsActionFor(r, "/objects/"+o.Oid, contentMediaType),
+			}
+		case stored && meta.Length != o.Size:
+			bo.Error = &lfsObjectError{Code: 422, Message: errSizeMismatch.Error()}
+		case !stored:
+			// Objects the namespace already has need no actions
+			bo.Actions = map[string]*lfsAction{
+				"upload": lfsActionFor(r, "/objects/"+o.Oid, metaMediaType),
+				"verify": lfsActionFor(r, "/lfs/verify", lfsMediaType),
+			}
+		}
+	}
+	writeLFS(w, r, 200, res)
+}
+
+// lfsActionFor returns an action for path in the request's namespace. The
+// client is asked to send the request's own credentials with it.
+func lfsActionFor(r *http.Request, path, accept string) *lfsAction {
+	header := map[string]string{"Accept": accept}
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		header["Authorization"] = authz
+	}
+	return &lfsAction{
+		Href:      Config.Proto + "://" + Config.Host + namespacePath(r) + path,
+		Header:    header,
+		ExpiresIn: int(lfsActionExpiry.Seconds()),
+		ExpiresAt: time.Now().Add(lfsActionExpiry).UTC().Format(time.RFC3339),
+	}
+}
+
+// VerifyHandler is the verify action of a Git LFS upload. It checks that the
+// object was stored with the size the client meant to send.
+func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var o lfsObject
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		writeLFSError(w, r, 400, err)
+		return
+	}
+	meta, err := a.metaStoreFor(r).Get(o.Oid)
+	if err != nil || !a.objectStore.Exists(o.Oid) {
+		writeLFSError(w, r, 404, errLFSNotFound)
+		return
+	}
+	if meta.Length != o.Size {
+		writeLFSError(w, r, 422, errSizeMismatch)
+		return
+	}
+	writeLFS(w, r, 200, &o)
+}
+
+// containsString reports whether list holds s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
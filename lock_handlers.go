@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errLockNotFound = errors.New("Lock not found")
+	errInvalidPath  = errors.New("Lock path is required")
+)
+
+// Bodies of the Git LFS locking API.
+type LockRequest struct {
+	Path string `json:"path"`
+}
+
+type LockResponse struct {
+	Lock    *Lock  `json:"lock"`
+	Message string `json:"message,omitempty"`
+}
+
+type UnlockRequest struct {
+	Force bool `json:"force"`
+}
+
+type UnlockResponse struct {
+	Lock    *Lock  `json:"lock"`
+	Message string `json:"message,omitempty"`
+}
+
+type LockList struct {
+	Locks      []Lock `json:"locks"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+type VerifiableLockRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type VerifiableLockList struct {
+	Ours       []Lock `json:"ours"`
+	Theirs     []Lock `json:"theirs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// CreateLockHandler locks a path for the requesting identity.
+func (a *App) CreateLockHandler(w http.ResponseWriter, r *http.Request) {
+	var req LockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSError(w, r, 400, err)
+		return
+	}
+	if req.Path == "" {
+		writeLFSError(w, r, 422, errInvalidPath)
+		return
+	}
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		writeLFSError(w, r, 500, err)
+		return
+	}
+	lock := Lock{
+		Id:       hex.EncodeToString(b),
+		Path:     req.Path,
+		Owner:    User{Name: requestIdentity(r).Name},
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	ms := a.metaStoreFor(r)
+	err := ms.AddLocks(lock)
+	if err == errLockExists {
+		res := &LockResponse{Message: err.Error()}
+		if locks, _, err := ms.FilteredLocks(req.Path, "", 1); err == nil && len(locks) > 0 {
+			res.Lock = &locks[0]
+		}
+		writeLFS(w, r, 409, res)
+		return
+	}
+	if err != nil {
+		writeLFSError(w, r, 500, err)
+		return
+	}
+	writeLFS(w, r, 201, &LockResponse{Lock: &lock})
+}
+
+// ListLocksHandler lists locks, filtered by "path" or "id", a page at a
+// time with "cursor" and "limit".
+func (a *App) ListLocksHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := lockLimit(q.Get("limit"))
+	if err != nil {
+		writeLFSError(w, r, 422, err)
+		return
+	}
+
+	ms := a.metaStoreFor(r)
+	var list LockList
+	if id := q.Get("id"); id != "" {
+		locks, err := ms.Locks()
+		if err != nil {
+			writeLFSError(w, r, 500, err)
+			return
+		}
+		list.Locks = []Lock{}
+		for _, l := range locks {
+			if l.Id == id && (q.Get("path") == "" || q.Get("path") == l.Path) {
+				list.Locks = append(list.Locks, l)
+			}
+		}
+	} else {
+		list.Locks, list.NextCursor, err = ms.FilteredLocks(q.Get("path"), q.Get("cursor"), limit)
+		if err != nil {
+			writeLFSError(w, r, 500, err)
+			return
+		}
+	}
+	writeLFS(w, r, 200, &list)
+}
+
+// VerifyLocksHandler lists locks split into those held by the requesting
+// identity and those held by others, which git lfs checks before a push.
+func (a *App) VerifyLocksHandler(w http.ResponseWriter, r *http.Request) {
+	var req VerifiableLockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSError(w, r, 400, err)
+		return
+	}
+	if req.Limit < 0 || req.Limit > maxListLimit {
+		writeLFSError(w, r, 422, errInvalidLimit)
+		return
+	}
+
+	locks, next, err := a.metaStoreFor(r).FilteredLocks("", req.Cursor, req.Limit)
+	if err != nil {
+		writeLFSError(w, r, 500, err)
+		return
+	}
+	list := VerifiableLockList{Ours: []Lock{}, Theirs: []Lock{}, NextCursor: next}
+	user := requestIdentity(r).Name
+	for _, l := range locks {
+		if l.Owner.Name == user {
+			list.Ours = append(list.Ours, l)
+		} else {
+			list.Theirs = append(list.Theirs, l)
+		}
+	}
+	writeLFS(w, r, 200, &list)
+}
+
+// UnlockHandler releases a lock. Only its owner can, unless "force" is set.
+func (a *App) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	var req UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLFSError(w, r, 400, err)
+		return
+	}
+
+	lock, err := a.metaStoreFor(r).DeleteLock(requestIdentity(r).Name, mux.Vars(r)["id"], req.Force)
+	if err == errNotOwner {
+		writeLFSError(w, r, 403, err)
+		return
+	}
+	if err != nil {
+		writeLFSError(w, r, 500, err)
+		return
+	}
+	if lock == nil {
+		writeLFSError(w, r, 404, errLockNotFound)
+		return
+	}
+	writeLFS(w, r, 200, &UnlockResponse{Lock: lock})
+}
+
+// lockLimit parses the page size of a lock listing, which defaults to
+// defaultListLimit.
+func lockLimit(s string) (int, error) {
+	if s == "" {
+		return defaultListLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxListLimit {
+		return 0, errInvalidLimit
+	}
+	return n, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,9 +12,11 @@ import (
 )
 
 const (
-	contentMediaType = "application/vnd.nd"
-	metaMediaType    = contentMediaType + "+json"
-	version          = "0.0.3"
+	contentMediaType  = "application/vnd.nd"
+	metaMediaType     = contentMediaType + "+json"
+	manifestMediaType = contentMediaType + ".manifest+json"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	version           = "0.0.3"
 )
 
 var (
@@ -59,12 +62,25 @@ func wrapHttps(l net.Listener, cert, key string) (net.Listener, error) {
 	return tlsListener, nil
 }
 
+// newObjectStore opens the ObjectStore chosen by ND_STORE.
+func newObjectStore() (ObjectStore, error) {
+	switch Config.Store {
+	case "fs":
+		fanout, err := parseStoreLayout(Config.StoreLayout)
+		if err != nil {
+			return nil, err
+		}
+		return NewShardedFsObjectStore(Config.DataPath+"objects", fanout)
+	case "chunk":
+		return NewChunkObjectStore(Config.DataPath + "chunked")
+	}
+	return nil, fmt.Errorf("Unsupported store type: %s", Config.Store)
+}
+
 func main() {
-	if len(os.Args) == 2 && (
-		os.Args[1] == "--version" ||
-		os.Args[1] == "-v") {
-		fmt.Println(version)
-		os.Exit(0)
+	// Commands run instead of the server, e.g. "nd fsck".
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
 	}
 
 	var listener net.Listener
@@ -84,16 +100,91 @@ func main() {
 		}
 	}
 
+	// The S3 API has its own listener, as S3 clients expect buckets at the
+	// root of the endpoint.
+	var s3l *TrackingListener
+	var s3Listener net.Listener
+	if Config.S3Listen != "" {
+		if Config.S3AccessKey == "" || Config.S3SecretKey == "" {
+			logger.Fatal(kv{"fn": "main", "err": "ND_S3ACCESSKEY and ND_S3SECRETKEY must be set when ND_S3LISTEN is"})
+		}
+		s3l, err = NewTrackingListener(Config.S3Listen)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not create S3 listener: " + err.Error()})
+		}
+		s3Listener = s3l
+		if Config.IsHTTPS() {
+			s3Listener, err = wrapHttps(s3l, Config.Cert, Config.Key)
+			if err != nil {
+				logger.Fatal(kv{"fn": "main", "err": "Could not create https S3 listener: " + err.Error()})
+			}
+		}
+	}
+
 	metaStore, err := NewBoltMetaStore(Config.DataPath + "meta.db")
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
 	}
 
-	contentStore, err := NewFsObjectStore(Config.DataPath + "objects")
+	contentStore, err := newObjectStore()
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
 	}
 
+	// New objects in a filesystem store are recorded as intents in the meta
+	// store until their meta is committed, so that writes a crash
+	// interrupted can be rolled back before serving.
+	if fs, ok := contentStore.(*FsObjectStore); ok {
+		fs.UseIntentLog(metaStore)
+		removed, err := recoverWrites(fs, metaStore)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not recover interrupted writes: " + err.Error()})
+		}
+		if len(removed) > 0 {
+			logger.Log(kv{"fn": "main", "msg": "rolled back interrupted writes", "objects": len(removed)})
+		}
+	}
+
+	uploadExpiry, err := time.ParseDuration(Config.UploadExpiry)
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Invalid upload expiry: " + err.Error()})
+	}
+
+	uploadStore, err := NewUploadStore(Config.DataPath+"uploads", uploadExpiry)
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not open the upload store: " + err.Error()})
+	}
+	go uploadStore.Reap(time.Hour)
+
+	// Zip archives sent to /import are spooled under the data path while
+	// they are read. Any a crash left behind are removed.
+	maxImportSize, err := parseByteSize(Config.ImportMaxSize)
+	if err != nil || maxImportSize == 0 {
+		logger.Fatal(kv{"fn": "main", "err": "Invalid import size: " + Config.ImportMaxSize})
+	}
+	importDir := Config.DataPath + "imports"
+	if err := os.RemoveAll(importDir); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not clear the import directory: " + err.Error()})
+	}
+	if err := os.MkdirAll(importDir, 0750); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not create the import directory: " + err.Error()})
+	}
+
+	// The scrubber only runs when given a rate to read at, e.g. "8MB".
+	var scrubber *Scrubber
+	stopScrub := make(chan struct{})
+	scrubRate, err := parseByteRate(Config.ScrubRate)
+	if err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Invalid scrub rate: " + Config.ScrubRate})
+	}
+	if scrubRate > 0 {
+		scrubInterval, err := time.ParseDuration(Config.ScrubInterval)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Invalid scrub interval: " + err.Error()})
+		}
+		scrubber = NewScrubber(contentStore, metaStore, scrubRate, scrubInterval)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func(c chan os.Signal, listener net.Listener) {
@@ -102,13 +193,49 @@ func main() {
 			switch sig {
 			case syscall.SIGHUP: // Graceful shutdown
 				tl.Close()
+				if s3l != nil {
+					s3l.Close()
+				}
+				select {
+				case <-stopScrub:
+				default:
+					close(stopScrub)
+				}
 			}
 		}
 	}(c, tl)
 
 	logger.Log(kv{"fn": "main", "msg": "listening", "pid": os.Getpid(), "addr": Config.Listen, "version": version})
 
-	app := NewApp(contentStore, metaStore)
+	var auth []Authenticator
+	if Config.AdminUser != "" {
+		if Config.AdminPass == "" {
+			logger.Fatal(kv{"fn": "main", "err": "ND_ADMINPASS must be set when ND_ADMINUSER is"})
+		}
+		auth = append(auth, NewBasicAuthenticator(Config.AdminUser, Config.AdminPass), NewTokenAuthenticator(metaStore))
+	} else {
+		logger.Log(kv{"fn": "main", "msg": "ND_ADMINUSER is not set, authentication is disabled"})
+	}
+
+	app := NewApp(contentStore, metaStore, uploadStore, metaStore, auth...)
+	app.importDir, app.maxImportSize = importDir, maxImportSize
+	if s3l != nil {
+		multipartStore, err := NewMultipartStore(Config.DataPath+"multipart", uploadExpiry)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not open the multipart store: " + err.Error()})
+		}
+		go multipartStore.Reap(time.Hour)
+		s3 := NewS3Server(app, multipartStore, Config.S3Bucket, Config.S3AccessKey, Config.S3SecretKey)
+		go http.Serve(s3Listener, s3)
+		logger.Log(kv{"fn": "main", "msg": "serving the S3 API", "addr": Config.S3Listen, "bucket": Config.S3Bucket})
+	}
+	if scrubber != nil {
+		go scrubber.Run(stopScrub)
+		logger.Log(kv{"fn": "main", "msg": "scrubbing", "rate": scrubRate, "interval": Config.ScrubInterval})
+	}
 	app.Serve(listener)
 	tl.WaitForChildren()
+	if s3l != nil {
+		s3l.WaitForChildren()
+	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	errInvalidManifest       = errors.New("Manifest must be a non-empty JSON list of paths and OIDs")
+	errInvalidManifestPath   = errors.New("Invalid manifest path")
+	errDuplicateManifestPath = errors.New("Manifest lists a path more than once")
+	errManifestIncomplete    = errors.New("Manifest lists objects that don't exist")
+	errNotManifest           = errors.New("Object is not a manifest")
+)
+
+// maxManifestPath limits the length of a path within a manifest.
+const maxManifestPath = 4096
+
+// canonicalManifest checks the entries of a manifest and returns its
+// canonical encoding: a JSON list of {"path", "oid"} objects sorted by path,
+// without whitespace. The same set of entries always encodes to the same
+// bytes, and so to the same OID. entries is normalized and sorted in place.
+func canonicalManifest(entries []ManifestEntry) ([]byte, error) {
+	if len(entries) == 0 {
+		return nil, errInvalidManifest
+	}
+	for i, e := range entries {
+		if !validManifestPath(e.Path) {
+			return nil, errInvalidManifestPath
+		}
+		if !validOid(e.Oid) {
+			return nil, errInvalidOid
+		}
+		entries[i].Oid = strings.ToLower(e.Oid)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Path == entries[i-1].Path {
+			return nil, errDuplicateManifestPath
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// parseManifest decodes the content of a stored manifest.
+func parseManifest(b []byte) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, errInvalidManifest
+	}
+	return entries, nil
+}
+
+// validManifestPath reports whether p is a relative, slash separated path
+// with no empty, "." or ".." segments, so that a manifest can be unpacked
+// without anything landing outside its directory.
+func validManifestPath(p string) bool {
+	if p == "" || len(p) > maxManifestPath || strings.ContainsAny(p, "\x00\\") {
+		return false
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
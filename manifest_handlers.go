@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxManifestSize limits the size of a manifest sent to POST /manifests.
+const maxManifestSize = 16 * 1024 * 1024
+
+// CreateManifestHandler stores a manifest, a JSON list of {"path", "oid"}
+// objects, as an object of its own. Every object it lists must already be in
+// the namespace; if any are missing they are returned as "missing". A
+// filename, attributes and tags can be given in X-ND-Filename,
+// X-ND-Attributes and X-ND-Tags, as for a raw upload.
+func (a *App) CreateManifestHandler(w http.ResponseWriter, r *http.Request) {
+	var entries []ManifestEntry
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if err := json.Unmarshal(body, &entries); err != nil {
+		writeError(w, r, 400, errInvalidManifest)
+		return
+	}
+	meta := &MetaData{FileName: r.Header.Get("X-ND-Filename")}
+	if err := addAttributes(meta, r.Header.Get("X-ND-Attributes"), r.Header.Get("X-ND-Tags")); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+
+	ms := a.metaStoreFor(r)
+	d, err := a.storeManifest(ms, entries, meta)
+	if err == errManifestIncomplete {
+		writeResponseData(w, r, &ResponseData{code: 400, Status: err.Error(), Missing: missingObjects(ms, entries)})
+		return
+	}
+	if err != nil {
+		writeError(w, r, manifestErrorCode(err), err)
+		return
+	}
+	w.Header().Set("Location", namespacePath(r)+"/objects/"+d.Oid)
+	writeResponseData(w, r, d)
+}
+
+// manifestErrorCode maps the errors from storing a manifest onto HTTP status
+// codes.
+func manifestErrorCode(err error) int {
+	switch err {
+	case errInvalidManifest, errInvalidManifestPath, errDuplicateManifestPath, errInvalidOid, errManifestIncomplete:
+		return 400
+	}
+	return 500
+}
+
+// storeManifest stores a manifest of entries in ms, along with meta, which
+// has its ContentType, Length and Created filled in. The manifest is stored
+// in its canonical encoding, so its OID doesn't depend on the order or
+// formatting the entries were given in. It returns errManifestIncomplete if
+// any of the entries aren't in ms.
+func (a *App) storeManifest(ms MetaStore, entries []ManifestEntry, meta *MetaData) (*ResponseData, error) {
+	content, err := canonicalManifest(entries)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	// The same bytes may have been uploaded earlier as a plain object, in
+	// which case its meta is upgraded to that of a manifest below.
+	existing, err := a.BuildMetaResponse(ms, oid)
+	if err == nil && existing.Meta.ContentType == manifestMediaType {
+		existing.Status = "Already Exists"
+		existing.Manifest = entries
+		return existing, nil
+	}
+	if len(missingObjects(ms, entries)) > 0 {
+		return nil, errManifestIncomplete
+	}
+	if err == nil {
+		if err := ms.PutManifest(oid, existing.Meta, entries); err != nil {
+			return nil, err
+		}
+		d, err := a.BuildMetaResponse(ms, oid)
+		if err != nil {
+			return nil, err
+		}
+		d.code, d.Status = 201, "Created"
+		d.Manifest = entries
+		return d, nil
+	}
+	if !a.objectStore.Exists(oid) {
+		if _, err := a.objectStore.Put(oid, bytes.NewReader(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	meta.ContentType = manifestMediaType
+	meta.Length = int64(len(content))
+	meta.Created = time.Now().Unix()
+	if err := ms.PutManifest(oid, meta, entries); err != nil {
+		return nil, err
+	}
+	return &ResponseData{code: 201, Status: "Created", Oid: oid, Meta: meta, Manifest: entries}, nil
+}
+
+// missingObjects returns the OIDs listed in a manifest that aren't in ms.
+func missingObjects(ms MetaStore, entries []ManifestEntry) []string {
+	var missing []string
+	for _, e := range entries {
+		if _, err := ms.Get(e.Oid); err != nil {
+			missing = addTag(missing, e.Oid)
+		}
+	}
+	return missing
+}
+
+// GetManifestHandler lists the members of a manifest.
+func (a *App) GetManifestHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	entries, err := a.readManifest(a.metaStoreFor(r), oid)
+	if err == errObjectNotFound || err == errNotManifest {
+		writeError(w, r, 404, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: oid, Manifest: entries})
+}
+
+// readManifest returns the members of a manifest in ms.
+func (a *App) readManifest(ms MetaStore, oid string) ([]ManifestEntry, error) {
+	meta, _, err := latestMeta(ms, oid)
+	if err != nil {
+		return nil, errObjectNotFound
+	}
+	if meta.ContentType != manifestMediaType {
+		return nil, errNotManifest
+	}
+	content, err := a.objectStore.Get(oid, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(b)
+}
+
+// ReferencedByHandler lists the manifests that an object is a member of.
+func (a *App) ReferencedByHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	ms := a.metaStoreFor(r)
+	if _, err := ms.Get(oid); err != nil {
+		writeError(w, r, 404, err)
+		return
+	}
+	manifests, err := ms.ReferencedBy(oid)
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: oid, Manifests: manifests})
+}
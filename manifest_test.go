@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalManifest(t *testing.T) {
+	a := []ManifestEntry{
+		{Path: "images/front.png", Oid: strings.ToUpper(contentOid)},
+		{Path: "datasheet.pdf", Oid: nonExistingOid},
+	}
+	b := []ManifestEntry{
+		{Path: "datasheet.pdf", Oid: nonExistingOid},
+		{Path: "images/front.png", Oid: contentOid},
+	}
+	ca, err := canonicalManifest(a)
+	if err != nil {
+		t.Fatalf("expected manifest to be valid, got: %s", err)
+	}
+	cb, _ := canonicalManifest(b)
+	if string(ca) != string(cb) {
+		t.Fatalf("expected the same entries to encode the same way, got:\n%s\n%s", ca, cb)
+	}
+	want := `[{"path":"datasheet.pdf","oid":"` + nonExistingOid + `"},{"path":"images/front.png","oid":"` + contentOid + `"}]`
+	if string(ca) != want {
+		t.Errorf("expected canonical encoding %s, got: %s", want, ca)
+	}
+
+	entries, err := parseManifest(ca)
+	if err != nil || len(entries) != 2 || entries[1].Path != "images/front.png" {
+		t.Errorf("expected the manifest to parse back, got: %+v, %v", entries, err)
+	}
+
+	for _, bad := range [][]ManifestEntry{
+		nil,
+		{{Path: "a", Oid: "abc"}},
+		{{Path: "/etc/passwd", Oid: contentOid}},
+		{{Path: "a/../../b", Oid: contentOid}},
+		{{Path: "a//b", Oid: contentOid}},
+		{{Path: "a", Oid: contentOid}, {Path: "a", Oid: nonExistingOid}},
+	} {
+		if _, err := canonicalManifest(bad); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields of MetaData that objects can be listed in the order of and
+// filtered on. Every field but oid has an index in the MetaStore.
+const (
+	fieldOid         = "oid"
+	fieldFileName    = "filename"
+	fieldContentType = "content-type"
+	fieldSize        = "size"
+	fieldCreated     = "created"
+)
+
+// indexedFields are the fields with a secondary index.
+var indexedFields = []string{fieldFileName, fieldContentType, fieldSize, fieldCreated}
+
+// Filter operators. Prefix only applies to the text fields.
+const (
+	opEq     = "="
+	opPrefix = "^="
+	opLt     = "<"
+	opLe     = "<="
+	opGt     = ">"
+	opGe     = ">="
+)
+
+// MetaFilter restricts a listing to the objects whose Field compares to
+// Value using Op. Value is encoded as by fieldValue.
+type MetaFilter struct {
+	Field string
+	Op    string
+	Value []byte
+}
+
+// newMetaFilter checks and encodes a filter as given in a query string.
+// created can be given either as a Unix time or in RFC 3339 format.
+func newMetaFilter(field, op, value string) (MetaFilter, error) {
+	f := MetaFilter{Field: field, Op: op}
+	switch op {
+	case opEq, opPrefix, opLt, opLe, opGt, opGe:
+	default:
+		return f, errInvalidFilter
+	}
+
+	switch field {
+	case fieldOid, fieldFileName, fieldContentType:
+		f.Value = []byte(value)
+	case fieldSize, fieldCreated:
+		if op == opPrefix {
+			return f, errInvalidFilter
+		}
+		var n int64
+		var err error
+		if field == fieldCreated {
+			n, err = parseTime(value)
+		} else {
+			n, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil || n < 0 {
+			return f, errInvalidFilter
+		}
+		f.Value = encodeInt(n)
+	default:
+		return f, errInvalidFilter
+	}
+	return f, nil
+}
+
+// parseTime parses a time given either as a Unix time or in RFC 3339 format,
+// returning it as a Unix time.
+func parseTime(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// match compares a field value, encoded as by fieldValue, against the
+// filter. more is false if no value that sorts after this one can match
+// either, so that a scan in field order can stop.
+func (f MetaFilter) match(value []byte) (ok, more bool) {
+	c := bytes.Compare(value, f.Value)
+	switch f.Op {
+	case opEq:
+		return c == 0, c <= 0
+	case opPrefix:
+		ok = bytes.HasPrefix(value, f.Value)
+		return ok, ok || c < 0
+	case opLt:
+		return c < 0, c < 0
+	case opLe:
+		return c <= 0, c <= 0
+	case opGt:
+		return c > 0, true
+	case opGe:
+		return c >= 0, true
+	}
+	return false, false
+}
+
+// fieldValue encodes a field of an object so that byte order is the order of
+// the field: text as is, numbers as 8 byte big endian.
+func fieldValue(field, oid string, d *MetaData) []byte {
+	switch field {
+	case fieldFileName:
+		return []byte(d.FileName)
+	case fieldContentType:
+		return []byte(d.ContentType)
+	case fieldSize:
+		return encodeInt(d.Length)
+	case fieldCreated:
+		return encodeInt(d.Created)
+	}
+	return []byte(oid)
+}
+
+func encodeInt(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// listQuery is a parsed GET /objects query string.
+type listQuery struct {
+	order   string
+	limit   int
+	after   string
+	filters []MetaFilter
+	// terms are the filters as they were given, for the next page's URL
+	terms []string
+}
+
+// parseListQuery parses a raw query string such as
+// "content-type=application/pdf&created>=1530000000&limit=10". Any term that
+// isn't limit, order or after is a filter of the form <field><op><value>.
+// Without an order, objects are listed in the order of the first filter's
+// field, or by oid if there are no filters.
+func parseListQuery(raw string) (*listQuery, error) {
+	q := &listQuery{limit: defaultListLimit}
+	for _, term := range strings.Split(raw, "&") {
+		if term == "" {
+			continue
+		}
+		t, err := url.QueryUnescape(term)
+		if err != nil {
+			return nil, errInvalidFilter
+		}
+		i := strings.IndexAny(t, "<>^=")
+		if i < 1 {
+			return nil, errInvalidFilter
+		}
+		field, op, value := t[:i], t[i:i+1], t[i+1:]
+		if len(value) > 0 && value[0] == '=' && op != opEq {
+			op, value = op+"=", value[1:]
+		}
+
+		switch {
+		case field == "limit" && op == opEq:
+			q.limit, err = strconv.Atoi(value)
+			if err != nil || q.limit < 1 || q.limit > maxListLimit {
+				return nil, errInvalidLimit
+			}
+		case field == "order" && op == opEq:
+			q.order = value
+		case field == "after" && op == opEq:
+			q.after = value
+		default:
+			f, err := newMetaFilter(field, op, value)
+			if err != nil {
+				return nil, err
+			}
+			q.filters = append(q.filters, f)
+			q.terms = append(q.terms, term)
+		}
+	}
+
+	if q.order == "" {
+		q.order = fieldOid
+		if len(q.filters) > 0 {
+			q.order = q.filters[0].Field
+		}
+	}
+	return q, nil
+}
+
+// next returns the query string for the page following the given cursor.
+func (q *listQuery) next(cursor string) string {
+	v := url.Values{
+		"order": {q.order},
+		"limit": {strconv.Itoa(q.limit)},
+		"after": {cursor},
+	}
+	return strings.Join(append(q.terms[:len(q.terms):len(q.terms)], v.Encode()), "&")
+}
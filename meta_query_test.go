@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseListQuery(t *testing.T) {
+	q, err := parseListQuery("created%3E=2018-06-26T08:00:00Z&filename^=a%26b&size<10&limit=5&after=abc")
+	if err != nil {
+		t.Fatalf("expected query to parse, got: %s", err)
+	}
+	if q.order != fieldCreated || q.limit != 5 || q.after != "abc" {
+		t.Fatalf("expected order, limit and after to be set, got: %+v", q)
+	}
+	if len(q.filters) != 3 {
+		t.Fatalf("expected 3 filters, got: %+v", q.filters)
+	}
+	for i, want := range []MetaFilter{
+		{fieldCreated, opGe, encodeInt(1530000000)},
+		{fieldFileName, opPrefix, []byte("a&b")},
+		{fieldSize, opLt, encodeInt(10)},
+	} {
+		f := q.filters[i]
+		if f.Field != want.Field || f.Op != want.Op || string(f.Value) != string(want.Value) {
+			t.Errorf("expected filter %+v, got: %+v", want, f)
+		}
+	}
+	if next := q.next("xyz"); next != "created%3E=2018-06-26T08:00:00Z&filename^=a%26b&size<10&after=xyz&limit=5&order=created" {
+		t.Errorf("expected next page to keep the filters, got: %s", next)
+	}
+
+	q, err = parseListQuery("")
+	if err != nil || q.order != fieldOid || q.limit != defaultListLimit || len(q.filters) != 0 {
+		t.Errorf("expected defaults for an empty query, got: %+v, %v", q, err)
+	}
+
+	for _, raw := range []string{"size^=1", "created=yesterday", "size=-1", "colour=red", "=x", "filename^x", "limit=0", "limit=1001"} {
+		if _, err := parseListQuery(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidRefName = errors.New("Invalid ref name")
+	errRefChanged     = errors.New("Ref does not match the precondition")
+)
+
+// Ref names are one or more path segments, e.g. "sku-1234/datasheet".
+var refNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+const maxRefName = 255
+
+// refRequest is the body of PUT /refs/{name}
+type refRequest struct {
+	Oid string `json:"oid"`
+}
+
+func validRefName(name string) bool {
+	return len(name) <= maxRefName && refNameRegexp.MatchString(name)
+}
+
+// refErrorCode maps RefStore errors onto HTTP status codes.
+func refErrorCode(err error) int {
+	switch err {
+	case errRefNotFound:
+		return 404
+	case errRefChanged:
+		return 412
+	case errObjectNotFound:
+		return 400
+	}
+	return 500
+}
+
+// refCondition returns a check for RefStore.UpdateRef from the request's
+// If-Match and If-None-Match headers. A ref's ETag is the ETag of the object
+// it points at, so "If-Match: <old oid>" is a compare-and-swap and
+// "If-None-Match: *" only creates a ref that doesn't exist yet.
+func refCondition(r *http.Request, existed *bool) func(*Ref) error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	return func(current *Ref) error {
+		*existed = current != nil
+		if ifNoneMatch == "*" && current != nil {
+			return errRefChanged
+		}
+		if ifMatch != "" && (current == nil || (ifMatch != "*" && ifMatch != objectETag(current.Oid))) {
+			return errRefChanged
+		}
+		return nil
+	}
+}
+
+// PutRefHandler points a ref at an object in the same namespace, creating
+// the ref if need be.
+func (a *App) PutRefHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validRefName(name) {
+		writeError(w, r, 400, errInvalidRefName)
+		return
+	}
+	var req refRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if !validOid(req.Oid) {
+		writeError(w, r, 400, errInvalidOid)
+		return
+	}
+
+	var existed bool
+	ref, err := a.metaStoreFor(r).UpdateRef(name, req.Oid, requestIdentity(r).Name, refCondition(r, &existed))
+	if err != nil {
+		writeError(w, r, refErrorCode(err), err)
+		return
+	}
+	d := &ResponseData{code: 200, Status: "OK", Oid: ref.Oid, Ref: ref}
+	if !existed {
+		d.code, d.Status = 201, "Created"
+	}
+	w.Header().Set("ETag", objectETag(ref.Oid))
+	writeResponseData(w, r, d)
+}
+
+// DeleteRefHandler removes a ref. Its reflog is kept.
+func (a *App) DeleteRefHandler(w http.ResponseWriter, r *http.Request) {
+	var existed bool
+	_, err := a.metaStoreFor(r).UpdateRef(mux.Vars(r)["name"], "", requestIdentity(r).Name, refCondition(r, &existed))
+	if err != nil {
+		writeError(w, r, refErrorCode(err), err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "Deleted"})
+}
+
+// GetRefHandler redirects to the object a ref points at. With "?proxy=1"
+// the object is served directly instead, for clients that can't follow
+// redirects. Either way the response mustn't be cached, as the ref can move.
+func (a *App) GetRefHandler(w http.ResponseWriter, r *http.Request) {
+	ref, err := a.metaStoreFor(r).Ref(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, r, refErrorCode(err), err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.URL.Query().Get("proxy") != "" {
+		a.serveObject(w, r, ref.Oid)
+		return
+	}
+	logRequest(r, 302)
+	http.Redirect(w, r, namespacePath(r)+"/objects/"+ref.Oid, 302)
+}
+
+// GetRefMetaHandler returns a ref along with its reflog.
+func (a *App) GetRefMetaHandler(w http.ResponseWriter, r *http.Request) {
+	ms := a.metaStoreFor(r)
+	name := mux.Vars(r)["name"]
+	ref, err := ms.Ref(name)
+	if err != nil {
+		writeError(w, r, refErrorCode(err), err)
+		return
+	}
+	reflog, err := ms.RefLog(name)
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	w.Header().Set("ETag", objectETag(ref.Oid))
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: ref.Oid, Ref: ref, RefLog: reflog})
+}
+
+// ListRefsHandler lists the refs in the request's namespace.
+func (a *App) ListRefsHandler(w http.ResponseWriter, r *http.Request) {
+	refs, err := a.metaStoreFor(r).Refs()
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Refs: refs})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errInvalidRendition = errors.New("Invalid rendition spec")
+	errNotImage         = errors.New("Renditions can only be made of JPEG, PNG and GIF images")
+	errImageTooLarge    = errors.New("Image is too large to make renditions of")
+	errInvalidImage     = errors.New("Image could not be decoded")
+)
+
+// Rendition formats
+const (
+	renditionJPEG = "jpeg"
+	renditionPNG  = "png"
+)
+
+// Rendition limits. Source images are decoded whole, taking up to 8 bytes a
+// pixel, so their size is capped to bound the memory a render can take, and
+// only a few renders run at once.
+const (
+	maxRenditionSize   = 4096
+	maxRenditionPixels = 40 * 1000 * 1000
+	maxRenders         = 2
+	defaultJPEGQuality = 85
+)
+
+// Fields set on the meta of a rendition, naming what it was made of.
+const (
+	renditionFieldOf   = "rendition-of"
+	renditionFieldSpec = "rendition"
+)
+
+// renditionSources are the content types renditions can be made of, with
+// the format a rendition is made in when the spec doesn't say.
+var renditionSources = map[string]string{
+	"image/jpeg": renditionJPEG,
+	"image/png":  renditionPNG,
+	"image/gif":  renditionPNG,
+}
+
+// renditionSpec describes a rendition of an image: the box it is scaled to
+// fit, either side of which may be 0 to follow the aspect ratio, and the
+// format it is encoded in.
+type renditionSpec struct {
+	width   int
+	height  int
+	format  string
+	quality int
+}
+
+// parseRenditionSpec parses a spec such as "w=256,fmt=jpeg" for an image of
+// the given content type. w and h are the width and height, at least one of
+// which must be given, fmt is jpeg or png and q is the JPEG quality.
+func parseRenditionSpec(s, contentType string) (renditionSpec, error) {
+	var spec renditionSpec
+	ct := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	defaultFormat, ok := renditionSources[ct]
+	if !ok {
+		return spec, errNotImage
+	}
+
+	for _, term := range strings.Split(s, ",") {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 {
+			return spec, errInvalidRendition
+		}
+		var err error
+		switch kv[0] {
+		case "w":
+			spec.width, err = strconv.Atoi(kv[1])
+			if spec.width < 1 || spec.width > maxRenditionSize {
+				err = errInvalidRendition
+			}
+		case "h":
+			spec.height, err = strconv.Atoi(kv[1])
+			if spec.height < 1 || spec.height > maxRenditionSize {
+				err = errInvalidRendition
+			}
+		case "fmt":
+			spec.format = kv[1]
+			if spec.format == "jpg" {
+				spec.format = renditionJPEG
+			}
+			if spec.format != renditionJPEG && spec.format != renditionPNG {
+				err = errInvalidRendition
+			}
+		case "q":
+			spec.quality, err = strconv.Atoi(kv[1])
+			if spec.quality < 1 || spec.quality > 100 {
+				err = errInvalidRendition
+			}
+		default:
+			err = errInvalidRendition
+		}
+		if err != nil {
+			return spec, errInvalidRendition
+		}
+	}
+	if spec.width == 0 && spec.height == 0 {
+		return spec, errInvalidRendition
+	}
+
+	if spec.format == "" {
+		spec.format = defaultFormat
+	}
+	switch {
+	case spec.format == renditionPNG && spec.quality != 0:
+		return spec, errInvalidRendition
+	case spec.format == renditionJPEG && spec.quality == 0:
+		spec.quality = defaultJPEGQuality
+	}
+	return spec, nil
+}
+
+// String returns the spec in its canonical form, with every value spelled
+// out, so that equivalent specs share one rendition.
+func (s renditionSpec) String() string {
+	var terms []string
+	if s.width > 0 {
+		terms = append(terms, "w="+strconv.Itoa(s.width))
+	}
+	if s.height > 0 {
+		terms = append(terms, "h="+strconv.Itoa(s.height))
+	}
+	terms = append(terms, "fmt="+s.format)
+	if s.quality > 0 {
+		terms = append(terms, "q="+strconv.Itoa(s.quality))
+	}
+	return strings.Join(terms, ",")
+}
+
+// contentType is the content type of renditions made to the spec.
+func (s renditionSpec) contentType() string {
+	return "image/" + s.format
+}
+
+// size returns the size of a rendition of an image of w×h pixels: scaled
+// to fit the spec's box, keeping its aspect ratio, but never enlarged.
+func (s renditionSpec) size(w, h int) (int, int) {
+	rw, rh := s.width, s.height
+	switch {
+	case rw == 0:
+		rw = scaleSide(w, rh, h)
+	case rh == 0:
+		rh = scaleSide(h, rw, w)
+	case w*rh > h*rw:
+		rh = scaleSide(h, rw, w)
+	default:
+		rw = scaleSide(w, rh, h)
+	}
+	if rw >= w || rh >= h {
+		return w, h
+	}
+	return rw, rh
+}
+
+// scaleSide returns side scaled by num/den, rounded and at least 1.
+func scaleSide(side, num, den int) int {
+	n := (side*num + den/2) / den
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// renditionFileName names a rendition after its source, e.g.
+// "front-w=256,fmt=jpeg.jpeg" for a rendition of "front.png".
+func renditionFileName(source string, spec renditionSpec) string {
+	name := strings.TrimSuffix(source, path.Ext(source))
+	if name == "" {
+		name = "rendition"
+	}
+	return name + "-" + spec.String() + "." + spec.format
+}
+
+// renderer runs renders, at most a fixed number at a time. Concurrent
+// requests for the same rendition share one render rather than each making
+// it.
+type renderer struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+// renderCall is a render in progress, which later requests for the same
+// rendition wait on.
+type renderCall struct {
+	done chan struct{}
+	rid  string
+	err  error
+}
+
+func newRenderer(n int) *renderer {
+	return &renderer{slots: make(chan struct{}, n), calls: make(map[string]*renderCall)}
+}
+
+// do runs fn, which makes the rendition named by key, once a slot is free.
+// If a call for key is already running, it waits for that call instead and
+// returns its result.
+func (r *renderer) do(key string, fn func() (string, error)) (string, error) {
+	r.mu.Lock()
+	if c, ok := r.calls[key]; ok {
+		r.mu.Unlock()
+		<-c.done
+		return c.rid, c.err
+	}
+	c := &renderCall{done: make(chan struct{})}
+	r.calls[key] = c
+	r.mu.Unlock()
+
+	r.slots <- struct{}{}
+	c.rid, c.err = fn()
+	<-r.slots
+
+	r.mu.Lock()
+	delete(r.calls, key)
+	r.mu.Unlock()
+	close(c.done)
+	return c.rid, c.err
+}
+
+// render scales img to the spec and encodes it.
+func render(img image.Image, spec renditionSpec) ([]byte, error) {
+	b := img.Bounds()
+	w, h := spec.size(b.Dx(), b.Dy())
+	dst := resize(img, w, h)
+
+	var buf bytes.Buffer
+	var err error
+	if spec.format == renditionJPEG {
+		// JPEG has no alpha channel, so transparent areas become white
+		// rather than black.
+		flat := image.NewRGBA(dst.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+		draw.Draw(flat, flat.Bounds(), dst, image.ZP, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: spec.quality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// resize scales img to w×h pixels. Each pixel of the result is the average
+// of the source pixels it covers (a box filter), which gives smooth results
+// when shrinking, the only direction renditions go.
+func resize(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != image.ZP {
+		src = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RenditionHandler serves a rendition of an image, such as a thumbnail,
+// made to a spec like "w=256,fmt=jpeg" (see parseRenditionSpec). The first
+// request for a rendition makes it and stores it as an object of its own,
+// linked to the image; later requests are served that object. Renders are
+// made a few at a time, and concurrent requests for one share it.
+func (a *App) RenditionHandler(w http.ResponseWriter, r *http.Request) {
+	mv := mux.Vars(r)
+	oid := mv["oid"]
+	ms := a.metaStoreFor(r)
+	meta, _, err := latestMeta(ms, oid)
+	if err != nil || !a.objectStore.Exists(oid) {
+		writeError(w, r, 404, errObjectNotFound)
+		return
+	}
+
+	// The filename isn't trusted here, so only the content can make an
+	// object an image.
+	ct, _ := a.sniffer.DetectObject(a.objectStore, oid, "")
+	spec, err := parseRenditionSpec(mv["spec"], ct)
+	if err != nil {
+		writeError(w, r, renditionErrorCode(err), err)
+		return
+	}
+
+	rid, err := ms.Rendition(oid, spec.String())
+	if err == errRenditionNotFound {
+		key := requestNamespace(r) + "/" + oid + "/" + spec.String()
+		rid, err = a.renderer.do(key, func() (string, error) {
+			// Made while this request waited for a slot
+			if rid, err := ms.Rendition(oid, spec.String()); err != errRenditionNotFound {
+				return rid, err
+			}
+			return a.storeRendition(ms, oid, meta, spec)
+		})
+	}
+	if err != nil {
+		writeError(w, r, renditionErrorCode(err), err)
+		return
+	}
+	a.serveObject(w, r, rid)
+}
+
+// renditionErrorCode maps the errors from making a rendition onto HTTP
+// status codes.
+func renditionErrorCode(err error) int {
+	switch err {
+	case errInvalidRendition:
+		return 400
+	case errNotImage:
+		return 415
+	case errImageTooLarge, errInvalidImage:
+		return 422
+	}
+	return 500
+}
+
+// storeRendition makes a rendition of the image oid to spec, stores it and
+// links it to the image in ms. It returns the rendition's OID.
+func (a *App) storeRendition(ms MetaStore, oid string, meta *MetaData, spec renditionSpec) (string, error) {
+	img, err := a.decodeImage(oid)
+	if err != nil {
+		return "", err
+	}
+	content, err := render(img, spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	rid := hex.EncodeToString(sum[:])
+
+	if !a.objectStore.Exists(rid) {
+		if _, err := a.objectStore.Put(rid, bytes.NewReader(content)); err != nil {
+			return "", err
+		}
+	}
+
+	d := &MetaData{
+		FileName:    renditionFileName(meta.FileName, spec),
+		ContentType: spec.contentType(),
+		Length:      int64(len(content)),
+		Created:     time.Now().Unix(),
+		Fields:      map[string]string{renditionFieldOf: oid, renditionFieldSpec: spec.String()},
+	}
+	if err := ms.PutRendition(oid, spec.String(), rid, d); err != nil {
+		return "", err
+	}
+	return rid, nil
+}
+
+// decodeImage decodes the image oid. Its dimensions are checked before it
+// is decoded, so oversized images are refused without being read whole.
+func (a *App) decodeImage(oid string) (image.Image, error) {
+	content, err := a.objectStore.Get(oid, 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(content)
+	content.Close()
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	if cfg.Width*cfg.Height > maxRenditionPixels {
+		return nil, errImageTooLarge
+	}
+
+	content, err = a.objectStore.Get(oid, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	img, _, err := image.Decode(content)
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	return img, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRenditionSpec(t *testing.T) {
+	cases := []struct {
+		spec, contentType, canonical string
+	}{
+		{"w=256,fmt=jpeg", "image/png", "w=256,fmt=jpeg,q=85"},
+		{"fmt=jpg,w=256,q=85", "image/png", "w=256,fmt=jpeg,q=85"},
+		{"h=100", "image/png", "h=100,fmt=png"},
+		{"h=100", "image/gif", "h=100,fmt=png"},
+		{"w=64,h=48", "image/jpeg", "w=64,h=48,fmt=jpeg,q=85"},
+		{"w=64,q=50", "image/jpeg", "w=64,fmt=jpeg,q=50"},
+	}
+	for _, c := range cases {
+		spec, err := parseRenditionSpec(c.spec, c.contentType)
+		if err != nil {
+			t.Fatalf("%s: expected spec to be valid, got: %s", c.spec, err)
+		}
+		if spec.String() != c.canonical {
+			t.Errorf("%s: expected canonical spec %s, got: %s", c.spec, c.canonical, spec)
+		}
+	}
+
+	for _, bad := range []string{"", "fmt=png", "w=0", "w=5000", "w=abc", "w=10,fmt=webp", "w=10,fmt=png,q=50", "w=10,q=101", "w=10,x=1", "w"} {
+		if _, err := parseRenditionSpec(bad, "image/png"); err != errInvalidRendition {
+			t.Errorf("%q: expected errInvalidRendition, got: %v", bad, err)
+		}
+	}
+	if _, err := parseRenditionSpec("w=10", "text/plain; charset=utf-8"); err != errNotImage {
+		t.Errorf("expected errNotImage, got: %v", err)
+	}
+}
+
+func TestRenditionSize(t *testing.T) {
+	cases := []struct {
+		width, height int
+		w, h          int
+		rw, rh        int
+	}{
+		{256, 0, 1024, 768, 256, 192},
+		{0, 96, 1024, 768, 128, 96},
+		{100, 100, 400, 200, 100, 50},
+		{100, 100, 200, 400, 50, 100},
+		{2048, 0, 1024, 768, 1024, 768},
+		{10, 0, 1000, 10, 10, 1},
+	}
+	for _, c := range cases {
+		spec := renditionSpec{width: c.width, height: c.height}
+		if rw, rh := spec.size(c.w, c.h); rw != c.rw || rh != c.rh {
+			t.Errorf("%s of %dx%d: expected %dx%d, got: %dx%d", spec, c.w, c.h, c.rw, c.rh, rw, rh)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				src.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			}
+		}
+	}
+
+	spec, _ := parseRenditionSpec("w=10,fmt=jpeg", "image/png")
+	b, err := render(src, spec)
+	if err != nil {
+		t.Fatalf("expected render to succeed, got: %s", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("expected a JPEG, got: %s", err)
+	}
+	if size := img.Bounds().Size(); size.X != 10 || size.Y != 5 {
+		t.Fatalf("expected a 10x5 rendition, got: %v", size)
+	}
+	// The transparent right half is flattened onto white.
+	if r, g, _, _ := img.At(8, 2).RGBA(); r>>8 < 240 || g>>8 < 240 {
+		t.Errorf("expected transparency to become white, got: %v", img.At(8, 2))
+	}
+	if r, g, _, _ := img.At(1, 2).RGBA(); r>>8 < 200 || g>>8 > 60 {
+		t.Errorf("expected red to stay red, got: %v", img.At(1, 2))
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	r := newRenderer(2)
+	var mu sync.Mutex
+	var calls, running, most int
+	release := make(chan struct{})
+	fn := func() (string, error) {
+		mu.Lock()
+		calls++
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return "rendered", nil
+	}
+
+	// Eight requests for each of four renditions
+	var wg sync.WaitGroup
+	results := make(chan string, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			rid, _ := r.do(key, fn)
+			results <- rid
+		}(strconv.Itoa(i % 4))
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for rid := range results {
+		if rid != "rendered" {
+			t.Fatalf("expected every request to get the rendition, got %q", rid)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("expected one render per rendition, got %d", calls)
+	}
+	if most > 2 {
+		t.Errorf("expected at most 2 renders at once, got %d", most)
+	}
+}
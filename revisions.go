@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+var (
+	errRevisionNotFound = errors.New("Revision not found")
+	errInvalidRevision  = errors.New("Invalid revision or time")
+)
+
+// apply returns a copy of d with the annotation's changes made to it.
+func (a *Annotation) apply(d *MetaData) *MetaData {
+	m := *d
+	if a.FileName != "" {
+		m.FileName = a.FileName
+	}
+	if a.ContentType != "" {
+		m.ContentType, m.ContentTypeFrom = a.ContentType, ""
+	}
+
+	if len(a.Set) > 0 || len(a.Unset) > 0 {
+		m.Attributes = make(map[string]Attribute, len(d.Attributes)+len(a.Set))
+		for name, v := range d.Attributes {
+			m.Attributes[name] = v
+		}
+		for name, v := range a.Set {
+			m.Attributes[name] = v
+		}
+		for _, name := range a.Unset {
+			delete(m.Attributes, name)
+		}
+		if len(m.Attributes) == 0 {
+			m.Attributes = nil
+		}
+	}
+
+	if len(a.AddTags) > 0 || len(a.RemoveTags) > 0 {
+		m.Tags = nil
+		for _, tag := range append(d.Tags[:len(d.Tags):len(d.Tags)], a.AddTags...) {
+			removed := false
+			for _, r := range a.RemoveTags {
+				removed = removed || r == tag
+			}
+			if !removed {
+				m.Tags = addTag(m.Tags, tag)
+			}
+		}
+	}
+	return &m
+}
+
+// mergeRevisions returns an object's meta as of revision n: its uploaded
+// meta with the first n annotations of its history applied.
+func mergeRevisions(d *MetaData, history []*Annotation, n int) *MetaData {
+	for _, a := range history[:n] {
+		d = a.apply(d)
+	}
+	return d
+}
+
+// revisionAt returns the revision of an object's meta that was current at
+// the given Unix time, or errRevisionNotFound if the object hadn't been
+// uploaded yet.
+func revisionAt(d *MetaData, history []*Annotation, at int64) (int, error) {
+	if at < d.Created {
+		return 0, errRevisionNotFound
+	}
+	n := 0
+	for n < len(history) && history[n].Created <= at {
+		n++
+	}
+	return n, nil
+}
+
+// latestMeta returns an object's meta as of its latest revision, and the
+// number of that revision.
+func latestMeta(ms MetaStore, oid string) (*MetaData, int, error) {
+	meta, err := ms.Get(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	history, err := ms.Annotations(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	return mergeRevisions(meta, history, len(history)), len(history), nil
+}
+
+// requestRevision returns the revision of an object's meta asked for by a
+// request's "revision" or "at" query value, or the latest if neither is set.
+func requestRevision(r *http.Request, d *MetaData, history []*Annotation) (int, error) {
+	q := r.URL.Query()
+	revision, at := q.Get("revision"), q.Get("at")
+	switch {
+	case revision != "" && at != "":
+		return 0, errInvalidRevision
+	case revision != "":
+		n, err := strconv.Atoi(revision)
+		if err != nil || n < 0 {
+			return 0, errInvalidRevision
+		}
+		if n > len(history) {
+			return 0, errRevisionNotFound
+		}
+		return n, nil
+	case at != "":
+		t, err := parseTime(at)
+		if err != nil {
+			return 0, errInvalidRevision
+		}
+		return revisionAt(d, history, t)
+	}
+	return len(history), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMergeRevisions(t *testing.T) {
+	uploaded := &MetaData{
+		FileName:   "scan.pdf",
+		Created:    100,
+		Attributes: map[string]Attribute{"sku": {Type: attrString, String: "A-1"}},
+		Tags:       []string{"draft"},
+	}
+	history := []*Annotation{
+		{Revision: 1, Created: 200, FileName: "datasheet.pdf", Set: map[string]Attribute{"lang": {Type: attrString, String: "en"}}},
+		{Revision: 2, Created: 300, Unset: []string{"sku"}, AddTags: []string{"final"}, RemoveTags: []string{"draft"}},
+	}
+
+	m := mergeRevisions(uploaded, history, 2)
+	if m.FileName != "datasheet.pdf" {
+		t.Errorf("expected corrected filename, got: %s", m.FileName)
+	}
+	if len(m.Attributes) != 1 || m.Attributes["lang"].String != "en" {
+		t.Errorf("expected sku to be replaced by lang, got: %+v", m.Attributes)
+	}
+	if len(m.Tags) != 1 || m.Tags[0] != "final" {
+		t.Errorf("expected draft tag to be replaced by final, got: %v", m.Tags)
+	}
+
+	m = mergeRevisions(uploaded, history, 1)
+	if m.FileName != "datasheet.pdf" || len(m.Attributes) != 2 || len(m.Tags) != 1 || m.Tags[0] != "draft" {
+		t.Errorf("expected only the first annotation to apply, got: %+v", m)
+	}
+
+	if uploaded.FileName != "scan.pdf" || len(uploaded.Attributes) != 1 || uploaded.Tags[0] != "draft" {
+		t.Errorf("expected uploaded meta to be left alone, got: %+v", uploaded)
+	}
+
+	for at, want := range map[int64]int{100: 0, 250: 1, 300: 2, 1000: 2} {
+		if n, err := revisionAt(uploaded, history, at); err != nil || n != want {
+			t.Errorf("expected revision %d at %d, got: %d, %v", want, at, n, err)
+		}
+	}
+	if _, err := revisionAt(uploaded, history, 99); err != errRevisionNotFound {
+		t.Errorf("expected no revision before upload, got: %v", err)
+	}
+}
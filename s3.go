@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/context"
+)
+
+// s3Error is an error with the status and code S3 clients expect for it.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.message
+}
+
+var (
+	s3AccessDenied                      = &s3Error{403, "AccessDenied", "Access Denied"}
+	s3Immutable                         = &s3Error{403, "AccessDenied", "Objects are immutable and can't be overwritten or deleted"}
+	s3InvalidAccessKeyId                = &s3Error{403, "InvalidAccessKeyId", "The access key you provided does not exist in our records"}
+	s3SignatureDoesNotMatch             = &s3Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	s3RequestTimeTooSkewed              = &s3Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	s3RequestExpired                    = &s3Error{403, "AccessDenied", "Request has expired"}
+	s3AuthorizationHeaderMalformed      = &s3Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	s3AuthorizationQueryParametersError = &s3Error{400, "AuthorizationQueryParametersError", "The authorization query parameters are malformed"}
+	s3MissingContentSHA256              = &s3Error{400, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	s3ContentSHA256Mismatch             = &s3Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	s3BadDigest                         = &s3Error{400, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+	s3InvalidDigest                     = &s3Error{400, "InvalidDigest", "The Content-MD5 you specified is not valid"}
+	s3OidMismatch                       = &s3Error{400, "BadDigest", "The content does not hash to the OID used as its key"}
+	s3InvalidArgument                   = &s3Error{400, "InvalidArgument", "Invalid Argument"}
+	s3InvalidKey                        = &s3Error{400, "KeyTooLongError", "Keys must be valid UTF-8 of at most 1024 bytes"}
+	s3InvalidRefKey                     = &s3Error{400, "InvalidArgument", "Keys other than an OID must be valid ref names"}
+	s3InvalidRange                      = &s3Error{416, "InvalidRange", "The requested range is not satisfiable"}
+	s3InvalidPart                       = &s3Error{400, "InvalidPart", "One or more of the specified parts could not be found or its entity tag did not match"}
+	s3InvalidPartOrder                  = &s3Error{400, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	s3MalformedXML                      = &s3Error{400, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	s3NoSuchBucket                      = &s3Error{404, "NoSuchBucket", "The specified bucket does not exist"}
+	s3NoSuchKey                         = &s3Error{404, "NoSuchKey", "The specified key does not exist"}
+	s3NoSuchUpload                      = &s3Error{404, "NoSuchUpload", "The specified multipart upload does not exist"}
+	s3PreconditionFailed                = &s3Error{412, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	s3NotImplemented                    = &s3Error{501, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	s3InternalError                     = &s3Error{500, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+// maxS3Key is the longest key S3 allows, in bytes.
+const maxS3Key = 1024
+
+// S3Server serves a subset of the Amazon S3 API from the same stores as an
+// App, so that S3 tools and SDKs can read and write objects: PutObject,
+// GetObject, HeadObject, ListObjectsV2 and multipart uploads, path style
+// only. Each namespace is a bucket of the same name, and defaultBucket is the
+// default namespace.
+//
+// A key is either an OID, for the object itself, or any other name, which is
+// a ref. Objects are immutable, so putting a key that already exists only
+// succeeds if the content is the same, and objects can't be deleted.
+//
+// Every request must be signed with AWS Signature Version 4 using the one
+// configured access key, which may do anything an admin can.
+type S3Server struct {
+	app           *App
+	multipart     *MultipartStore
+	defaultBucket string
+	accessKey     string
+	secretKey     string
+	now           func() time.Time
+}
+
+// NewS3Server creates an S3Server in front of app, keeping multipart uploads
+// in mst until they complete.
+func NewS3Server(app *App, mst *MultipartStore, defaultBucket, accessKey, secretKey string) *S3Server {
+	return &S3Server{app: app, multipart: mst, defaultBucket: defaultBucket, accessKey: accessKey, secretKey: secretKey, now: time.Now}
+}
+
+// ServeHTTP authenticates the request and dispatches it on its bucket, key,
+// method and query. S3 keys may hold anything, including "//" and "..", so
+// the path is split by hand rather than routed through mux, which would
+// clean it.
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer context.Clear(r)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err == nil {
+		id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		context.Set(r, "RequestID", id)
+		w.Header().Set("x-amz-request-id", id)
+	}
+
+	v, err := parseSigV4(r)
+	if err == nil && v.accessKey != s.accessKey {
+		err = s3InvalidAccessKeyId
+	}
+	if err == nil {
+		err = v.verify(r, s.secretKey, s.now())
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		writeS3Error(w, r, s3NotImplemented)
+		return
+	}
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	ms, ok := s.metaStoreFor(bucket)
+	if !ok {
+		writeS3Error(w, r, s3NoSuchBucket)
+		return
+	}
+
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case key == "" && r.Method == "HEAD":
+		logRequest(r, 200)
+	case key == "" && r.Method == "GET":
+		if _, ok := q["location"]; ok {
+			writeS3XML(w, r, 200, &s3LocationConstraint{})
+		} else if q.Get("list-type") == "2" {
+			s.listObjectsV2(w, r, ms, bucket)
+		} else {
+			writeS3Error(w, r, s3NotImplemented)
+		}
+	case key == "":
+		writeS3Error(w, r, s3NotImplemented)
+	case len(key) > maxS3Key || !utf8.ValidString(key):
+		writeS3Error(w, r, s3InvalidKey)
+	case (r.Method == "GET" || r.Method == "HEAD") && uploadID == "":
+		s.getObject(w, r, ms, key)
+	case r.Method == "PUT" && uploadID != "":
+		s.uploadPart(w, r, v, bucket, key, uploadID)
+	case r.Method == "PUT":
+		s.putObject(w, r, v, ms, key)
+	case r.Method == "POST" && uploads:
+		s.createMultipartUpload(w, r, ms, bucket, key)
+	case r.Method == "POST" && uploadID != "":
+		s.completeMultipartUpload(w, r, ms, bucket, key, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		s.abortMultipartUpload(w, r, bucket, key, uploadID)
+	case r.Method == "DELETE":
+		writeS3Error(w, r, s3Immutable)
+	default:
+		writeS3Error(w, r, s3NotImplemented)
+	}
+}
+
+// metaStoreFor returns the view of the MetaStore for a bucket, if the bucket
+// names a namespace.
+func (s *S3Server) metaStoreFor(bucket string) (MetaStore, bool) {
+	switch {
+	case bucket == s.defaultBucket:
+		return s.app.metaStore, true
+	case namespaceRegexp.MatchString(bucket):
+		return s.app.metaStore.Namespace(bucket), true
+	}
+	return nil, false
+}
+
+// author is who changes made through the S3 API are recorded as.
+func (s *S3Server) author() string {
+	return "s3:" + s.accessKey
+}
+
+// s3ErrorResponse is the body of an S3 error response.
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+// writeS3Error responds with err, which should be an *s3Error. Anything else
+// is logged and reported as an internal error.
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3Error)
+	if !ok {
+		logger.Log(kv{"fn": "S3Server", "url": r.URL, "err": err})
+		e = s3InternalError
+	}
+	id, _ := context.Get(r, "RequestID").(string)
+	writeS3XML(w, r, e.status, &s3ErrorResponse{Code: e.code, Message: e.message, Resource: r.URL.Path, RequestId: id})
+}
+
+// writeS3XML responds with v encoded as XML, or just the status for HEAD
+// requests.
+func writeS3XML(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	logRequest(r, code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3LocationConstraint is the body of a GetBucketLocation response. Empty
+// means the default region.
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Value   string   `xml:",chardata"`
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, as used by the S3 API. Requests are signed either
+// in the Authorization header or, for presigned URLs, in the query string.
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// sigV4 is the signature on a request and the values it was made with.
+type sigV4 struct {
+	accessKey     string
+	scopeDate     string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	// expires is set for presigned URLs, which are valid for that long after
+	// amzDate.
+	expires time.Duration
+}
+
+// parseSigV4 reads the signature from a request's Authorization header or,
+// failing that, from the X-Amz-* query parameters of a presigned URL.
+func parseSigV4(r *http.Request) (*sigV4, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		return parseSigV4Header(r, h)
+	}
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") == "" {
+		return nil, s3AccessDenied
+	}
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, s3AuthorizationQueryParametersError
+	}
+	v := &sigV4{
+		signature:   q.Get("X-Amz-Signature"),
+		amzDate:     q.Get("X-Amz-Date"),
+		payloadHash: unsignedPayload,
+	}
+	if h := q.Get("X-Amz-Content-Sha256"); h != "" {
+		v.payloadHash = h
+	}
+	secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || secs < 1 || time.Duration(secs)*time.Second > maxPresignExpiry {
+		return nil, s3AuthorizationQueryParametersError
+	}
+	v.expires = time.Duration(secs) * time.Second
+	if !v.setCredential(q.Get("X-Amz-Credential")) || !v.setSignedHeaders(q.Get("X-Amz-SignedHeaders")) || v.signature == "" {
+		return nil, s3AuthorizationQueryParametersError
+	}
+	return v, nil
+}
+
+// parseSigV4Header parses an Authorization header of the form
+// "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=...".
+func parseSigV4Header(r *http.Request, h string) (*sigV4, error) {
+	if !strings.HasPrefix(h, sigV4Algorithm+" ") {
+		return nil, s3AuthorizationHeaderMalformed
+	}
+	v := &sigV4{
+		amzDate:     r.Header.Get("X-Amz-Date"),
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	var credential, signedHeaders string
+	for _, part := range strings.Split(h[len(sigV4Algorithm)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, s3AuthorizationHeaderMalformed
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "SignedHeaders":
+			signedHeaders = kv[1]
+		case "Signature":
+			v.signature = kv[1]
+		}
+	}
+	if !v.setCredential(credential) || !v.setSignedHeaders(signedHeaders) || v.signature == "" || v.amzDate == "" {
+		return nil, s3AuthorizationHeaderMalformed
+	}
+	if v.payloadHash == "" {
+		return nil, s3MissingContentSHA256
+	}
+	return v, nil
+}
+
+// setCredential parses a credential scope, "<key>/<date>/<region>/<service>/aws4_request".
+func (v *sigV4) setCredential(s string) bool {
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return false
+	}
+	v.accessKey, v.scopeDate, v.region, v.service = parts[0], parts[1], parts[2], parts[3]
+	return v.accessKey != ""
+}
+
+// setSignedHeaders parses a ";" separated list of signed header names, which
+// must include host.
+func (v *sigV4) setSignedHeaders(s string) bool {
+	v.signedHeaders = strings.Split(strings.ToLower(s), ";")
+	for _, h := range v.signedHeaders {
+		if h == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns the credential scope the signature was made for.
+func (v *sigV4) scope() string {
+	return strings.Join([]string{v.scopeDate, v.region, v.service, "aws4_request"}, "/")
+}
+
+// verify checks the signature against the secret key, and that it was made
+// at a time the server will accept.
+func (v *sigV4) verify(r *http.Request, secret string, now time.Time) error {
+	t, err := time.Parse(amzDateFormat, v.amzDate)
+	if err != nil || v.amzDate[:8] != v.scopeDate || v.service != "s3" {
+		return s3AuthorizationHeaderMalformed
+	}
+	if v.expires > 0 {
+		if now.Before(t.Add(-maxClockSkew)) || now.After(t.Add(v.expires)) {
+			return s3RequestExpired
+		}
+	} else if now.Sub(t) > maxClockSkew || t.Sub(now) > maxClockSkew {
+		return s3RequestTimeTooSkewed
+	}
+
+	expected := v.sign(secret, v.canonicalRequest(r))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(v.signature)) != 1 {
+		return s3SignatureDoesNotMatch
+	}
+	return nil
+}
+
+// sign returns the hex encoded signature of a canonical request.
+func (v *sigV4) sign(secret, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, v.amzDate, v.scope(), hex.EncodeToString(hash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), v.scopeDate)
+	key = hmacSHA256(key, v.region)
+	key = hmacSHA256(key, v.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalRequest builds the canonical form of a request that is hashed
+// into the string to sign.
+func (v *sigV4) canonicalRequest(r *http.Request) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var query []string
+	for name, values := range r.URL.Query() {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			query = append(query, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(query)
+
+	var headers []string
+	for _, name := range v.signedHeaders {
+		headers = append(headers, name+":"+canonicalHeaderValue(r, name)+"\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(path, false),
+		strings.Join(query, "&"),
+		strings.Join(headers, ""),
+		strings.Join(v.signedHeaders, ";"),
+		v.payloadHash,
+	}, "\n")
+}
+
+// canonicalHeaderValue returns a header's values, trimmed and with runs of
+// spaces collapsed, joined by commas. net/http moves Host out of the header
+// map, so it is read from the request.
+func canonicalHeaderValue(r *http.Request, name string) string {
+	values := append([]string(nil), r.Header[http.CanonicalHeaderKey(name)]...)
+	switch {
+	case name == "host":
+		values = []string{r.Host}
+	case name == "content-length" && len(values) == 0:
+		values = []string{strconv.FormatInt(r.ContentLength, 10)}
+	}
+	for i, value := range values {
+		values[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved characters
+// and, unless escapeSlash is set, "/". Spaces are %20, never +.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+// payloadOid returns the SHA-256 the signature says the request body has,
+// which is the OID it will be stored under, or "" if the body is unsigned.
+// Chunked streaming signatures are not supported.
+func (v *sigV4) payloadOid() (string, error) {
+	if v.payloadHash == unsignedPayload {
+		return "", nil
+	}
+	oid := strings.ToLower(v.payloadHash)
+	if !validOid(oid) {
+		return "", s3NotImplemented
+	}
+	return oid, nil
+}
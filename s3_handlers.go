@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 listing and multipart limits.
+const (
+	maxS3ListKeys      = 1000
+	maxS3Parts         = 10000
+	maxCompleteRequest = 1 << 20
+	// s3ListPage is how many OIDs a listing reads from the MetaStore at a time.
+	s3ListPage = 100
+)
+
+// s3TimeFormat is how S3 writes times in XML bodies.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// resolveS3Key returns the OID a key names: the key itself if it is an OID,
+// otherwise the object its ref points at.
+func resolveS3Key(ms MetaStore, key string) (string, error) {
+	if validOid(key) {
+		return key, nil
+	}
+	ref, err := ms.Ref(key)
+	if err == errRefNotFound {
+		return "", s3NoSuchKey
+	}
+	if err != nil {
+		return "", err
+	}
+	return ref.Oid, nil
+}
+
+// s3MetaData returns the meta for an object put through the S3 API. Its
+// filename is the last segment of a ref key, and x-amz-meta-* headers are
+// kept as Fields.
+func s3MetaData(r *http.Request, key string) *MetaData {
+	meta := &MetaData{}
+	if !validOid(key) {
+		meta.FileName = path.Base(key)
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			addField(meta, strings.TrimPrefix(name, "X-Amz-Meta-"), values[0])
+		}
+	}
+	return meta
+}
+
+// getObject serves GetObject and HeadObject. As in S3, only a single range
+// is honoured; a Range header asking for several gets the whole object.
+func (s *S3Server) getObject(w http.ResponseWriter, r *http.Request, ms MetaStore, key string) {
+	oid, err := resolveS3Key(ms, key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	meta, _, err := latestMeta(ms, oid)
+	if err != nil || !s.app.objectStore.Exists(oid) {
+		writeS3Error(w, r, s3NoSuchKey)
+		return
+	}
+
+	etag := objectETag(oid)
+	h := w.Header()
+	setValidators(w, etag, meta.Created)
+	h.Set("Accept-Ranges", "bytes")
+	for name, value := range meta.Fields {
+		h.Set("X-Amz-Meta-"+name, value)
+	}
+
+	if m := r.Header.Get("If-Match"); m != "" && !etagListMatches(m, etag) {
+		writeS3Error(w, r, s3PreconditionFailed)
+		return
+	}
+	if notModified(r, etag, meta.Created) {
+		writeNotModified(w, r)
+		return
+	}
+
+	rg, code := byteRange{0, meta.Length}, 200
+	if rangeHdr := r.Header.Get("Range"); rangeHdr != "" && checkIfRange(r, oid, meta) {
+		ranges, err := parseRange(rangeHdr, meta.Length)
+		if err == errUnsatisfiableRange {
+			h.Set("Content-Range", "bytes */"+strconv.FormatInt(meta.Length, 10))
+			writeS3Error(w, r, s3InvalidRange)
+			return
+		}
+		if err == nil && len(ranges) == 1 {
+			rg, code = ranges[0], 206
+			h.Set("Content-Range", rg.contentRange(meta.Length))
+		}
+	}
+	s.app.writeObject(w, r, oid, meta, rg, code)
+}
+
+// putObject serves PutObject. The content is stored under the SHA-256 the
+// request was signed with, if it was, and otherwise hashed as it is stored.
+// A key that already exists can only be put again with the same content.
+func (s *S3Server) putObject(w http.ResponseWriter, r *http.Request, v *sigV4, ms MetaStore, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, r, s3NotImplemented)
+		return
+	}
+	oid, err := v.payloadOid()
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	body, err := contentMD5(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	mismatch := s3ContentSHA256Mismatch
+	current := ""
+	if validOid(key) {
+		if oid != "" && oid != key {
+			writeS3Error(w, r, s3OidMismatch)
+			return
+		}
+		oid, mismatch = key, s3OidMismatch
+	} else if !validRefName(key) {
+		writeS3Error(w, r, s3InvalidRefKey)
+		return
+	} else if ref, err := ms.Ref(key); err == nil {
+		current = ref.Oid
+	} else if err != errRefNotFound {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if current != "" {
+		// Nothing new needs storing, but the content must be the same.
+		if oid != "" && oid != current {
+			writeS3Error(w, r, s3Immutable)
+			return
+		}
+		if _, err := verifyContent(current, body); err == errHashMismatch {
+			writeS3Error(w, r, s3Immutable)
+			return
+		} else if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", objectETag(current))
+		logRequest(r, 200)
+		return
+	}
+
+	var written int64
+	switch {
+	case oid == "":
+		oid, written, err = s.app.objectStore.Ingest(body)
+	case s.app.objectStore.Exists(oid):
+		written, err = verifyContent(oid, body)
+	default:
+		written, err = s.app.objectStore.Put(oid, body)
+	}
+	if err == errHashMismatch {
+		err = mismatch
+	}
+	if err == nil {
+		err = s.commitKey(ms, key, oid, s3MetaData(r, key), written)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", objectETag(oid))
+	logRequest(r, 200)
+}
+
+// contentMD5 wraps the request body so that, if a Content-MD5 header was
+// sent, reading it fails at the end unless it matched. The object store
+// sees the error before it links the object, so content with a bad digest
+// is never stored.
+func contentMD5(r *http.Request) (io.Reader, error) {
+	h := r.Header.Get("Content-MD5")
+	if h == "" {
+		return r.Body, nil
+	}
+	want, err := base64.StdEncoding.DecodeString(h)
+	if err != nil || len(want) != md5.Size {
+		return nil, s3InvalidDigest
+	}
+	return &md5Reader{r: r.Body, hash: md5.New(), want: want}, nil
+}
+
+// md5Reader reads r, returning s3BadDigest in place of io.EOF if what was
+// read doesn't have the MD5 want.
+type md5Reader struct {
+	r    io.Reader
+	hash hash.Hash
+	want []byte
+}
+
+func (m *md5Reader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(m.hash.Sum(nil), m.want) {
+		return n, s3BadDigest
+	}
+	return n, err
+}
+
+// commitKey records meta for a stored object and, unless the key is an OID,
+// creates the key's ref. Keys are immutable, so a ref that already points at
+// a different object is an error.
+func (s *S3Server) commitKey(ms MetaStore, key, oid string, meta *MetaData, written int64) error {
+	isRef := !validOid(key)
+	if !isRef && key != oid {
+		return s3OidMismatch
+	}
+	if isRef && !validRefName(key) {
+		return s3InvalidRefKey
+	}
+	if isRef {
+		if ref, err := ms.Ref(key); err == nil && ref.Oid != oid {
+			return s3Immutable
+		} else if err != nil && err != errRefNotFound {
+			return err
+		}
+	}
+	if _, err := s.app.recordNewMeta(ms, oid, meta, written); err != nil {
+		return err
+	}
+	if !isRef {
+		return nil
+	}
+	_, err := ms.UpdateRef(key, oid, s.author(), func(current *Ref) error {
+		if current != nil && current.Oid != oid {
+			return s3Immutable
+		}
+		return nil
+	})
+	return err
+}
+
+// s3ListBucketResult is the body of a ListObjectsV2 response.
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// listObjectsV2 serves ListObjectsV2. A bucket's keys are the OIDs of the
+// objects in its namespace together with the names of its refs. The
+// continuation token is the last key or common prefix returned.
+func (s *S3Server) listObjectsV2(w http.ResponseWriter, r *http.Request, ms MetaStore, bucket string) {
+	q := r.URL.Query()
+	res := &s3ListBucketResult{
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		MaxKeys:           maxS3ListKeys,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+		EncodingType:      q.Get("encoding-type"),
+	}
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, s3InvalidArgument)
+			return
+		}
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+	if res.EncodingType != "" && res.EncodingType != "url" {
+		writeS3Error(w, r, s3InvalidArgument)
+		return
+	}
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, s3InvalidArgument)
+			return
+		}
+		after = string(b)
+	}
+
+	keys, err := newS3KeyLister(ms, res.Prefix, after)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	// Keys under the common prefix a previous page ended on were all
+	// accounted for by it.
+	lastPrefix, last := "", ""
+	if res.Delimiter != "" && strings.HasSuffix(after, res.Delimiter) {
+		lastPrefix = after
+	}
+	for {
+		k, err := keys.next()
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if k == nil {
+			break
+		}
+		if i := strings.Index(k.key[len(res.Prefix):], res.Delimiter); res.Delimiter != "" && i >= 0 {
+			cp := k.key[:len(res.Prefix)+i+len(res.Delimiter)]
+			if cp == lastPrefix {
+				continue
+			}
+			if res.KeyCount == res.MaxKeys {
+				res.IsTruncated = true
+				break
+			}
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: res.encode(cp)})
+			lastPrefix, last = cp, cp
+			res.KeyCount++
+			continue
+		}
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+		res.Contents = append(res.Contents, s3Object{
+			Key:          res.encode(k.key),
+			LastModified: time.Unix(k.meta.Created, 0).UTC().Format(s3TimeFormat),
+			ETag:         objectETag(k.oid),
+			Size:         k.meta.Length,
+			StorageClass: "STANDARD",
+		})
+		last = k.key
+		res.KeyCount++
+	}
+	if res.IsTruncated && last != "" {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	res.Prefix, res.Delimiter, res.StartAfter = res.encode(res.Prefix), res.encode(res.Delimiter), res.encode(res.StartAfter)
+	writeS3XML(w, r, 200, res)
+}
+
+// encode applies the listing's encoding type to a key or prefix.
+func (res *s3ListBucketResult) encode(s string) string {
+	if res.EncodingType == "url" {
+		return s3Escape(s, false)
+	}
+	return s
+}
+
+// s3Key is a key in a bucket listing, with the object it names.
+type s3Key struct {
+	key  string
+	oid  string
+	meta *MetaData
+}
+
+// s3KeyLister merges the OIDs and ref names of a namespace into one sorted
+// run of the keys that start with prefix and sort after a given key. OIDs
+// are read from the MetaStore a page at a time, so no read transaction is
+// held while the listing is built.
+type s3KeyLister struct {
+	ms       MetaStore
+	prefix   string
+	cursor   string
+	oids     []s3Key
+	oidsDone bool
+	refs     []*Ref
+}
+
+func newS3KeyLister(ms MetaStore, prefix, after string) (*s3KeyLister, error) {
+	refs, err := ms.Refs()
+	if err != nil {
+		return nil, err
+	}
+	l := &s3KeyLister{ms: ms, prefix: prefix, cursor: base64.RawURLEncoding.EncodeToString([]byte(after))}
+	for _, ref := range refs {
+		if ref.Name > after && strings.HasPrefix(ref.Name, prefix) {
+			l.refs = append(l.refs, ref)
+		}
+	}
+	return l, nil
+}
+
+// next returns the next key, or nil after the last.
+func (l *s3KeyLister) next() (*s3Key, error) {
+	if len(l.oids) == 0 && !l.oidsDone {
+		if err := l.fill(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(l.oids) > 0 && (len(l.refs) == 0 || l.oids[0].key < l.refs[0].Name):
+		k := l.oids[0]
+		l.oids = l.oids[1:]
+		return &k, nil
+	case len(l.refs) > 0:
+		ref := l.refs[0]
+		l.refs = l.refs[1:]
+		meta, _, err := latestMeta(l.ms, ref.Oid)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Key{key: ref.Name, oid: ref.Oid, meta: meta}, nil
+	}
+	return nil, nil
+}
+
+func (l *s3KeyLister) fill() error {
+	var filters []MetaFilter
+	if l.prefix != "" {
+		filters = []MetaFilter{{Field: fieldOid, Op: opPrefix, Value: []byte(l.prefix)}}
+	}
+	err := l.ms.Query(fieldOid, filters, l.cursor, func(cursor, oid string, d *MetaData) bool {
+		l.oids = append(l.oids, s3Key{key: oid, oid: oid, meta: d})
+		l.cursor = cursor
+		return len(l.oids) < s3ListPage
+	})
+	l.oidsDone = len(l.oids) < s3ListPage
+	return err
+}
+
+// s3InitiateMultipartUploadResult is the body of a CreateMultipartUpload
+// response.
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+// s3CompleteMultipartUpload is the body of a CompleteMultipartUpload request.
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+// s3CompleteMultipartUploadResult is the body of a CompleteMultipartUpload
+// response.
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// createMultipartUpload serves CreateMultipartUpload. As the content isn't
+// known until the upload completes, an existing ref key is refused up front.
+func (s *S3Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, ms MetaStore, bucket, key string) {
+	if !validOid(key) {
+		if !validRefName(key) {
+			writeS3Error(w, r, s3InvalidRefKey)
+			return
+		}
+		if _, err := ms.Ref(key); err == nil {
+			writeS3Error(w, r, s3Immutable)
+			return
+		} else if err != errRefNotFound {
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+	u, err := s.multipart.Create(bucket, key, s3MetaData(r, key))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	writeS3XML(w, r, 200, &s3InitiateMultipartUploadResult{Bucket: bucket, Key: key, UploadId: u.ID})
+}
+
+// multipartUpload returns the upload with the given id, if it is for the
+// bucket and key of the request.
+func (s *S3Server) multipartUpload(bucket, key, id string) (*MultipartUpload, error) {
+	u, err := s.multipart.Get(id)
+	if err == errUploadNotFound || err == errUploadExpired || (err == nil && (u.Bucket != bucket || u.Key != key)) {
+		return nil, s3NoSuchUpload
+	}
+	return u, err
+}
+
+// uploadPart serves UploadPart. A part's entity tag is the MD5 of its
+// content, as S3 clients expect.
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, v *sigV4, bucket, key, id string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxS3Parts {
+		writeS3Error(w, r, s3InvalidArgument)
+		return
+	}
+	if _, err := s.multipartUpload(bucket, key, id); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	oid, err := v.payloadOid()
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	var wantMD5 []byte
+	if h := r.Header.Get("Content-MD5"); h != "" {
+		wantMD5, err = base64.StdEncoding.DecodeString(h)
+		if err != nil || len(wantMD5) != md5.Size {
+			writeS3Error(w, r, s3InvalidDigest)
+			return
+		}
+	}
+
+	etag, err := s.multipart.PutPart(id, n, r.Body, func(sha, md5sum []byte) error {
+		if oid != "" && hex.EncodeToString(sha) != oid {
+			return s3ContentSHA256Mismatch
+		}
+		if wantMD5 != nil && !bytes.Equal(md5sum, wantMD5) {
+			return s3BadDigest
+		}
+		return nil
+	})
+	if err == errUploadNotFound || err == errUploadExpired {
+		err = s3NoSuchUpload
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	logRequest(r, 200)
+}
+
+// completeMultipartUpload serves CompleteMultipartUpload, joining the listed
+// parts into one object, hashed as it is stored.
+func (s *S3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, ms MetaStore, bucket, key, id string) {
+	u, err := s.multipartUpload(bucket, key, id)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	var req s3CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, maxCompleteRequest)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeS3Error(w, r, s3MalformedXML)
+		return
+	}
+	parts := make([]MultipartPart, len(req.Parts))
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			writeS3Error(w, r, s3InvalidPartOrder)
+			return
+		}
+		parts[i] = MultipartPart{Number: p.PartNumber, ETag: strings.ToLower(strings.Trim(p.ETag, `"`))}
+		if !validPartETag(parts[i].ETag) {
+			writeS3Error(w, r, s3InvalidPart)
+			return
+		}
+	}
+
+	content, err := s.multipart.Open(id, parts)
+	if err == errPartNotFound {
+		err = s3InvalidPart
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	oid, written, err := s.app.objectStore.Ingest(content)
+	content.Close()
+	if err == nil {
+		err = s.commitKey(ms, key, oid, &MetaData{FileName: u.FileName, Fields: u.Fields}, written)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	s.multipart.Delete(id)
+	writeS3XML(w, r, 200, &s3CompleteMultipartUploadResult{Location: r.URL.Path, Bucket: bucket, Key: key, ETag: objectETag(oid)})
+}
+
+// abortMultipartUpload serves AbortMultipartUpload.
+func (s *S3Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+	if _, err := s.multipartUpload(bucket, key, id); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := s.multipart.Delete(id); err != nil && err != errUploadNotFound {
+		writeS3Error(w, r, err)
+		return
+	}
+	logRequest(r, 204)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errPartNotFound = errors.New("Part not found")
+
+// MultipartUpload is an S3 multipart upload in progress. Its parts can
+// arrive in any order, and be replaced, until it is completed into a single
+// object.
+type MultipartUpload struct {
+	ID       string            `json:"id"`
+	Bucket   string            `json:"bucket"`
+	Key      string            `json:"key"`
+	FileName string            `json:"filename,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Created  int64             `json:"created"`
+	Expires  int64             `json:"expires"`
+}
+
+// MultipartPart identifies an uploaded part by its number and entity tag,
+// the hex encoded MD5 of its content.
+type MultipartPart struct {
+	Number int
+	ETag   string
+}
+
+// MultipartStore keeps multipart uploads within a filesystem folder. Each
+// upload is a directory holding an upload.json record and one file per
+// part, named <number>-<etag> so that a part and its entity tag are always
+// replaced together.
+type MultipartStore struct {
+	path   string
+	expiry time.Duration
+}
+
+// NewMultipartStore creates a MultipartStore at the base directory. Uploads
+// not completed within expiry of their last part are removed by Expire.
+func NewMultipartStore(path string, expiry time.Duration) (*MultipartStore, error) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, err
+	}
+	return &MultipartStore{path: path, expiry: expiry}, nil
+}
+
+func (s *MultipartStore) dir(id string) string {
+	return filepath.Join(s.path, id)
+}
+
+func (s *MultipartStore) infoPath(id string) string {
+	return filepath.Join(s.dir(id), "upload.json")
+}
+
+// validPartETag reports whether etag is the hex encoded MD5 a part's entity
+// tag must be. Entity tags sent by clients name part files, so anything else
+// is refused before it reaches a path.
+func validPartETag(etag string) bool {
+	b, err := hex.DecodeString(etag)
+	return err == nil && len(b) == md5.Size
+}
+
+func (s *MultipartStore) partPath(id string, p MultipartPart) string {
+	return filepath.Join(s.dir(id), fmt.Sprintf("%05d-%s", p.Number, p.ETag))
+}
+
+// Create starts a multipart upload of an object to be stored under key in
+// bucket, with the filename and fields of meta.
+func (s *MultipartStore) Create(bucket, key string, meta *MetaData) (*MultipartUpload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	u := &MultipartUpload{
+		ID:       hex.EncodeToString(b),
+		Bucket:   bucket,
+		Key:      key,
+		FileName: meta.FileName,
+		Fields:   meta.Fields,
+		Created:  now.Unix(),
+		Expires:  now.Add(s.expiry).Unix(),
+	}
+	if err := os.Mkdir(s.dir(u.ID), 0750); err != nil {
+		return nil, err
+	}
+	if err := s.writeInfo(u); err != nil {
+		os.RemoveAll(s.dir(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *MultipartStore) writeInfo(u *MultipartUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.infoPath(u.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.infoPath(u.ID))
+}
+
+// Get returns a multipart upload that hasn't expired.
+func (s *MultipartStore) Get(id string) (*MultipartUpload, error) {
+	if !validUploadID(id) {
+		return nil, errUploadNotFound
+	}
+	b, err := ioutil.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u MultipartUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > u.Expires {
+		return nil, errUploadExpired
+	}
+	return &u, nil
+}
+
+// PutPart stores part number n of an upload from r, replacing any earlier
+// part with that number, and returns its entity tag. check is called with
+// the SHA-256 and MD5 of the content before the part is kept, so that it can
+// be refused.
+func (s *MultipartStore) PutPart(id string, n int, r io.Reader, check func(sha, md5sum []byte) error) (string, error) {
+	u, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(s.dir(id), "part-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	shaHash, md5Hash := sha256.New(), md5.New()
+	_, err = io.Copy(io.MultiWriter(f, shaHash, md5Hash), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = check(shaHash.Sum(nil), md5Hash.Sum(nil))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	part := MultipartPart{Number: n, ETag: hex.EncodeToString(md5Hash.Sum(nil))}
+	if err := os.Rename(f.Name(), s.partPath(id, part)); err != nil {
+		return "", err
+	}
+	old, _ := filepath.Glob(filepath.Join(s.dir(id), fmt.Sprintf("%05d-*", n)))
+	for _, p := range old {
+		if p != s.partPath(id, part) {
+			os.Remove(p)
+		}
+	}
+
+	// Activity pushes expiry back
+	u.Expires = time.Now().Add(s.expiry).Unix()
+	return part.ETag, s.writeInfo(u)
+}
+
+// Open returns the content of the given parts, one after another.
+// errPartNotFound is returned if any of them hasn't been uploaded with the
+// given entity tag, or the entity tag isn't a valid one.
+func (s *MultipartStore) Open(id string, parts []MultipartPart) (io.ReadCloser, error) {
+	if !validUploadID(id) {
+		return nil, errUploadNotFound
+	}
+	for _, p := range parts {
+		if !validPartETag(p.ETag) {
+			return nil, errPartNotFound
+		}
+	}
+	m := &multiFileReader{}
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		f, err := os.Open(s.partPath(id, p))
+		if os.IsNotExist(err) {
+			err = errPartNotFound
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.files = append(m.files, f)
+		readers = append(readers, f)
+	}
+	m.Reader = io.MultiReader(readers...)
+	return m, nil
+}
+
+// multiFileReader reads several files in turn and closes them all.
+type multiFileReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (m *multiFileReader) Close() error {
+	for _, f := range m.files {
+		f.Close()
+	}
+	return nil
+}
+
+// Delete removes a multipart upload and its parts.
+func (s *MultipartStore) Delete(id string) error {
+	if !validUploadID(id) {
+		return errUploadNotFound
+	}
+	if _, err := os.Stat(s.infoPath(id)); os.IsNotExist(err) {
+		return errUploadNotFound
+	}
+	return os.RemoveAll(s.dir(id))
+}
+
+// Expire removes every upload whose expiry time is before now, returning the
+// number removed.
+func (s *MultipartStore) Expire(now time.Time) (int, error) {
+	dirs, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range dirs {
+		if !d.IsDir() || !validUploadID(d.Name()) {
+			continue
+		}
+		b, err := ioutil.ReadFile(s.infoPath(d.Name()))
+		var u MultipartUpload
+		if err == nil {
+			err = json.Unmarshal(b, &u)
+		}
+		if err != nil || now.Unix() > u.Expires {
+			if os.RemoveAll(s.dir(d.Name())) == nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Reap runs Expire every interval until the process exits.
+func (s *MultipartStore) Reap(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.Expire(time.Now())
+		if err != nil {
+			logger.Log(kv{"fn": "MultipartStore.Reap", "err": err})
+			continue
+		}
+		if n > 0 {
+			logger.Log(kv{"fn": "MultipartStore.Reap", "expired": n})
+		}
+	}
+}
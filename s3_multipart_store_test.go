@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var multipartStoreTest *MultipartStore
+
+func TestMultipartStoreParts(t *testing.T) {
+	setupMultipartStore()
+	defer teardownMultipartStore()
+
+	u, err := multipartStoreTest.Create("nd", "parts.txt", &MetaData{FileName: "parts.txt"})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got: %s", err)
+	}
+
+	accept := func(sha, md5sum []byte) error { return nil }
+	first, err := multipartStoreTest.PutPart(u.ID, 1, bytes.NewBufferString("first draft "), accept)
+	if err != nil {
+		t.Fatalf("expected put part to succeed, got: %s", err)
+	}
+	second, err := multipartStoreTest.PutPart(u.ID, 2, bytes.NewBufferString("part two"), accept)
+	if err != nil {
+		t.Fatalf("expected put part to succeed, got: %s", err)
+	}
+
+	refused := errors.New("refused")
+	_, err = multipartStoreTest.PutPart(u.ID, 1, bytes.NewBufferString("refused "), func(sha, md5sum []byte) error { return refused })
+	if err != refused {
+		t.Fatalf("expected the check's error, got: %v", err)
+	}
+
+	replaced, err := multipartStoreTest.PutPart(u.ID, 1, bytes.NewBufferString("part one "), accept)
+	if err != nil {
+		t.Fatalf("expected put part to succeed, got: %s", err)
+	}
+	if replaced == first {
+		t.Fatalf("expected a different ETag for different content")
+	}
+
+	if _, err := multipartStoreTest.Open(u.ID, []MultipartPart{{1, first}, {2, second}}); err != errPartNotFound {
+		t.Fatalf("expected a replaced part to be gone, got: %v", err)
+	}
+	if _, err := multipartStoreTest.Open(u.ID, []MultipartPart{{1, "/../upload.json"}}); err != errPartNotFound {
+		t.Fatalf("expected a malformed entity tag to be refused, got: %v", err)
+	}
+
+	r, err := multipartStoreTest.Open(u.ID, []MultipartPart{{1, replaced}, {2, second}})
+	if err != nil {
+		t.Fatalf("expected open to succeed, got: %s", err)
+	}
+	defer r.Close()
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "part one part two" {
+		t.Fatalf("expected to read the parts in order, got: %s", by)
+	}
+}
+
+func TestMultipartStoreExpire(t *testing.T) {
+	setupMultipartStore()
+	defer teardownMultipartStore()
+
+	u, err := multipartStoreTest.Create("nd", "expiring.txt", &MetaData{})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got: %s", err)
+	}
+
+	if n, err := multipartStoreTest.Expire(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to expire yet, got: %d, %v", n, err)
+	}
+	if n, err := multipartStoreTest.Expire(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("expected one upload to expire, got: %d, %v", n, err)
+	}
+	if _, err := multipartStoreTest.Get(u.ID); err != errUploadNotFound {
+		t.Fatalf("expected errUploadNotFound, got: %v", err)
+	}
+}
+
+func setupMultipartStore() {
+	store, err := NewMultipartStore("multipart-store-test", time.Hour)
+	if err != nil {
+		fmt.Printf("error initializing multipart store: %s\n", err)
+		os.Exit(1)
+	}
+	multipartStoreTest = store
+}
+
+func teardownMultipartStore() {
+	os.RemoveAll("multipart-store-test")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errScrubStopped     = errors.New("Scrub stopped")
+	errScrubNotFound    = errors.New("Object has not been scrubbed")
+	errInvalidScrubRate = errors.New("Invalid scrub rate")
+	errInvalidByteSize  = errors.New("Invalid size")
+)
+
+// Scrub statuses
+const (
+	scrubOK      = "ok"
+	scrubCorrupt = "corrupt"
+	scrubMissing = "missing"
+)
+
+// scrubMetrics are published through expvar, at /debug/vars.
+var scrubMetrics = expvar.NewMap("scrub")
+
+// ScrubRecord is the result of the last check of an object: when it was
+// verified, whether it still hashed to its OID, and the pass of the scrub
+// that checked it.
+type ScrubRecord struct {
+	Oid      string `json:"oid"`
+	Verified int64  `json:"verified"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Pass     int    `json:"pass"`
+}
+
+// ScrubState is how far the scrubber has got. A pass is under way while
+// Started is after Finished, and has checked the objects up to Cursor, in
+// OID order. The counts are those of the current, or else the last, pass.
+type ScrubState struct {
+	Pass     int    `json:"pass"`
+	Started  int64  `json:"started,omitempty"`
+	Finished int64  `json:"finished,omitempty"`
+	Cursor   string `json:"cursor,omitempty"`
+	Objects  int    `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+	Corrupt  int    `json:"corrupt"`
+	Missing  int    `json:"missing"`
+}
+
+// running reports whether a pass is under way.
+func (st *ScrubState) running() bool {
+	return st.Started > st.Finished
+}
+
+// Scrubber re-hashes every object in an ObjectStore, one pass after another,
+// to catch content that has rotted on disk. Reads are throttled to rate
+// bytes a second, so scrubbing doesn't starve requests. Each object's result
+// is recorded in the ScrubStore along with the scrubber's progress, so a
+// restarted scrubber carries on from the last object it checked.
+type Scrubber struct {
+	objects  ObjectStore
+	store    ScrubStore
+	rate     int64
+	interval time.Duration
+	now      func() time.Time
+	after    func(time.Duration) <-chan time.Time
+}
+
+// NewScrubber creates a Scrubber reading at up to rate bytes a second, or
+// without limit if rate is 0, that waits interval between the end of one
+// pass and the start of the next.
+func NewScrubber(st ObjectStore, ss ScrubStore, rate int64, interval time.Duration) *Scrubber {
+	return &Scrubber{objects: st, store: ss, rate: rate, interval: interval, now: time.Now, after: time.After}
+}
+
+// Run scrubs until stop is closed.
+func (s *Scrubber) Run(stop <-chan struct{}) {
+	for {
+		state, err := s.store.ScrubState()
+		if err != nil {
+			logger.Log(kv{"fn": "Scrubber.Run", "err": err.Error()})
+			return
+		}
+		if !state.running() && state.Finished > 0 {
+			wait := time.Unix(state.Finished, 0).Add(s.interval).Sub(s.now())
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if _, err := s.Pass(stop); err == errScrubStopped {
+			return
+		} else if err != nil {
+			logger.Log(kv{"fn": "Scrubber.Run", "err": err.Error()})
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}
+}
+
+// Pass checks every object in the store, resuming the pass under way if
+// there is one, and returns its final state. It returns errScrubStopped if
+// stop is closed first.
+func (s *Scrubber) Pass(stop <-chan struct{}) (*ScrubState, error) {
+	state, err := s.store.ScrubState()
+	if err != nil {
+		return nil, err
+	}
+	if !state.running() {
+		state = &ScrubState{Pass: state.Pass + 1, Started: s.now().Unix()}
+		logger.Log(kv{"fn": "scrub", "msg": "pass started", "pass": state.Pass})
+	} else {
+		logger.Log(kv{"fn": "scrub", "msg": "pass resumed", "pass": state.Pass, "cursor": state.Cursor})
+	}
+
+	oids, err := s.objects.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(oids)
+	for _, oid := range oids {
+		if !validOid(oid) || oid <= state.Cursor {
+			continue
+		}
+		rec, n, err := s.verify(oid, stop)
+		if err == errScrubStopped {
+			return state, err
+		}
+		rec.Pass = state.Pass
+		state.Cursor = oid
+		state.Objects++
+		state.Bytes += n
+		scrubMetrics.Add("objects", 1)
+		scrubMetrics.Add("bytes", n)
+		switch rec.Status {
+		case scrubCorrupt:
+			state.Corrupt++
+		case scrubMissing:
+			state.Missing++
+		}
+		s.report(rec)
+		if err := s.store.RecordScrub(rec, state); err != nil {
+			return nil, err
+		}
+	}
+
+	// Objects checked by earlier passes but gone from the store now are
+	// counted as missing as the pass is finished, unless they were removed
+	// along with their meta.
+	state.Finished = s.now().Unix()
+	state.Cursor = ""
+	gone, err := s.store.FinishScrubPass(state)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range gone {
+		s.report(rec)
+	}
+	scrubMetrics.Add("passes", 1)
+	logger.Log(kv{"fn": "scrub", "msg": "pass finished", "pass": state.Pass, "objects": state.Objects, "bytes": state.Bytes, "corrupt": state.Corrupt, "missing": state.Missing})
+	return state, nil
+}
+
+// report logs an object found to be corrupt or missing and counts it in
+// the metrics.
+func (s *Scrubber) report(rec *ScrubRecord) {
+	if rec.Status == scrubOK {
+		return
+	}
+	scrubMetrics.Add(rec.Status, 1)
+	logger.Log(kv{"fn": "scrub", "oid": rec.Oid, "status": rec.Status, "err": rec.Error})
+}
+
+// verify re-hashes an object, returning the result and the number of bytes
+// read.
+func (s *Scrubber) verify(oid string, stop <-chan struct{}) (*ScrubRecord, int64, error) {
+	rec := &ScrubRecord{Oid: oid, Status: scrubOK}
+	r, err := s.objects.Get(oid, 0)
+	if err != nil {
+		rec.Verified = s.now().Unix()
+		rec.Status, rec.Error = scrubMissing, err.Error()
+		return rec, 0, nil
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, &throttledReader{r: r, s: s, stop: stop, start: s.now()})
+	rec.Verified = s.now().Unix()
+	switch {
+	case err == errScrubStopped:
+		return nil, n, err
+	case os.IsNotExist(err):
+		rec.Status, rec.Error = scrubMissing, err.Error()
+	case err != nil:
+		rec.Status, rec.Error = scrubCorrupt, err.Error()
+	case hex.EncodeToString(hash.Sum(nil)) != oid:
+		rec.Status, rec.Error = scrubCorrupt, errHashMismatch.Error()
+	}
+	return rec, n, nil
+}
+
+// throttledReader reads no faster than its Scrubber's rate, and fails with
+// errScrubStopped once stop is closed, even while waiting out the throttle.
+type throttledReader struct {
+	r     io.Reader
+	s     *Scrubber
+	stop  <-chan struct{}
+	start time.Time
+	read  int64
+}
+
+// scrubChunk bounds each read, so the throttle works in small steps.
+const scrubChunk = 64 * 1024
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	select {
+	case <-t.stop:
+		return 0, errScrubStopped
+	default:
+	}
+	if len(p) > scrubChunk {
+		p = p[:scrubChunk]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	if t.s.rate > 0 {
+		due := t.start.Add(time.Duration(float64(t.read) / float64(t.s.rate) * float64(time.Second)))
+		if wait := due.Sub(t.s.now()); wait > 0 {
+			select {
+			case <-t.stop:
+				return n, errScrubStopped
+			case <-t.s.after(wait):
+			}
+		}
+	}
+	return n, err
+}
+
+// parseByteRate parses a rate in bytes a second, such as "512K" or "10MB",
+// with binary multiples. Empty or "0" is no rate.
+func parseByteRate(s string) (int64, error) {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return 0, errInvalidScrubRate
+	}
+	return n, nil
+}
+
+// parseByteSize parses a number of bytes, such as "512K" or "10MB", with
+// binary multiples. Empty is 0.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errInvalidByteSize
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ScrubHandler reports how far the scrubber has got and the objects its
+// last checks found corrupt or missing.
+func (a *App) ScrubHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := a.metaStore.ScrubState()
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	problems, err := a.metaStore.ScrubProblems()
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Scrub: state, Scrubbed: problems})
+}
+
+// ScrubRecordHandler returns the result of the scrubber's last check of an
+// object, including when it was last verified.
+func (a *App) ScrubRecordHandler(w http.ResponseWriter, r *http.Request) {
+	oid := mux.Vars(r)["oid"]
+	rec, err := a.metaStore.ScrubRecord(oid)
+	if err == errScrubNotFound {
+		writeError(w, r, 404, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Oid: oid, Scrubbed: []*ScrubRecord{rec}})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestScrubPass(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+
+	var oids []string
+	for i := 0; i < 4; i++ {
+		oid, _, err := contentStore.Ingest(bytes.NewReader(randomData(int64(i), 1000)))
+		if err != nil {
+			t.Fatalf("expected ingest to succeed, got: %s", err)
+		}
+		metaStoreTest.Put(oid, &MetaData{FileName: "object.bin", Length: 1000})
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+
+	scrubber := NewScrubber(contentStore, metaStoreTest, 0, time.Hour)
+	state, err := scrubber.Pass(nil)
+	if err != nil {
+		t.Fatalf("expected the pass to succeed, got: %s", err)
+	}
+	if state.Pass != 1 || state.Objects != 4 || state.Corrupt != 0 || state.Missing != 0 || state.Bytes != 4000 {
+		t.Fatalf("expected four good objects, got: %+v", state)
+	}
+
+	// An object the first pass checked, since removed along with its meta
+	removed := sha256Hex([]byte("removed"))
+	if err := metaStoreTest.RecordScrub(&ScrubRecord{Oid: removed, Verified: 1, Status: scrubOK, Pass: 1}, state); err != nil {
+		t.Fatalf("expected record to succeed, got: %s", err)
+	}
+
+	// Rot one object and lose another, then start a second pass that is
+	// interrupted after the first object.
+	if err := ioutil.WriteFile("content-store-test/"+oids[1], randomData(9, 1000), 0640); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+	os.Remove("content-store-test/" + oids[2])
+	interrupted := &ScrubState{Pass: 2, Started: time.Now().Unix(), Cursor: oids[0], Objects: 1, Bytes: 1000}
+	if err := metaStoreTest.RecordScrub(&ScrubRecord{Oid: oids[0], Verified: 1, Status: scrubOK, Pass: 2}, interrupted); err != nil {
+		t.Fatalf("expected record to succeed, got: %s", err)
+	}
+
+	state, err = scrubber.Pass(nil)
+	if err != nil {
+		t.Fatalf("expected the pass to succeed, got: %s", err)
+	}
+	if state.Pass != 2 || state.Objects != 3 || state.Corrupt != 1 || state.Missing != 1 {
+		t.Fatalf("expected the pass to resume and find one corrupt and one missing object, got: %+v", state)
+	}
+	if rec, err := metaStoreTest.ScrubRecord(oids[0]); err != nil || rec.Verified != 1 {
+		t.Errorf("expected the object checked before the restart to be skipped, got: %+v, %v", rec, err)
+	}
+	if rec, err := metaStoreTest.ScrubRecord(oids[3]); err != nil || rec.Status != scrubOK || rec.Pass != 2 || rec.Verified == 0 {
+		t.Errorf("expected the last object to be verified again, got: %+v, %v", rec, err)
+	}
+	if rec, err := metaStoreTest.ScrubRecord(removed); err != errScrubNotFound {
+		t.Errorf("expected the record of the removed object to be dropped, got: %+v, %v", rec, err)
+	}
+
+	problems, err := metaStoreTest.ScrubProblems()
+	if err != nil || len(problems) != 2 {
+		t.Fatalf("expected two problems, got: %v, %v", problems, err)
+	}
+	status := map[string]string{problems[0].Oid: problems[0].Status, problems[1].Oid: problems[1].Status}
+	if status[oids[1]] != scrubCorrupt || status[oids[2]] != scrubMissing {
+		t.Errorf("expected one corrupt and one missing object, got: %v", status)
+	}
+
+	if saved, _ := metaStoreTest.ScrubState(); saved.running() || saved.Cursor != "" || saved.Missing != 1 {
+		t.Errorf("expected the finished pass to be saved, got: %+v", saved)
+	}
+}
+
+func TestScrubThrottle(t *testing.T) {
+	setup()
+	defer teardown()
+	setupMeta()
+	defer teardownMeta()
+
+	if _, _, err := contentStore.Ingest(bytes.NewReader(randomData(1, 300*1024))); err != nil {
+		t.Fatalf("expected ingest to succeed, got: %s", err)
+	}
+
+	clock := time.Unix(1530000000, 0)
+	var slept time.Duration
+	scrubber := NewScrubber(contentStore, metaStoreTest, 100*1024, time.Hour)
+	scrubber.now = func() time.Time { return clock.Add(slept) }
+	scrubber.after = func(d time.Duration) <-chan time.Time {
+		slept += d
+		c := make(chan time.Time, 1)
+		c <- clock.Add(slept)
+		return c
+	}
+
+	if _, err := scrubber.Pass(nil); err != nil {
+		t.Fatalf("expected the pass to succeed, got: %s", err)
+	}
+	if slept != 3*time.Second {
+		t.Errorf("expected 300K at 100K a second to take 3s, got: %s", slept)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := scrubber.Pass(stop); err != errScrubStopped {
+		t.Errorf("expected errScrubStopped, got: %v", err)
+	}
+
+	// Stopping doesn't wait for the throttle, here 300s at 1K a second.
+	scrubber = NewScrubber(contentStore, metaStoreTest, 1024, time.Hour)
+	stop = make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+	done := make(chan error, 1)
+	go func() {
+		_, err := scrubber.Pass(stop)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errScrubStopped {
+			t.Errorf("expected errScrubStopped, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected stopping to interrupt the throttle")
+	}
+}
+
+func TestParseByteRate(t *testing.T) {
+	cases := map[string]int64{"": 0, "0": 0, "512": 512, "64K": 64 << 10, "8MB": 8 << 20, "1g": 1 << 30}
+	for s, want := range cases {
+		if got, err := parseByteRate(s); err != nil || got != want {
+			t.Errorf("%q: expected %d, got: %d, %v", s, want, got, err)
+		}
+	}
+	for _, bad := range []string{"fast", "-1", "MB"} {
+		if _, err := parseByteRate(bad); err != errInvalidScrubRate {
+			t.Errorf("%q: expected errInvalidScrubRate, got: %v", bad, err)
+		}
+	}
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,14 +29,36 @@ type ObjectStore interface {
 	Exists(oid string) bool
 	Get(oid string, fromByte int64) (io.ReadCloser, error)
 	Put(oid string, f io.Reader) (int64, error)
-	DetectContentType(oid string) string
+	Ingest(f io.Reader) (string, int64, error)
 }
 
 type MetaData struct {
-	FileName	string	`json:"filename"`
-	ContentType	string	`json:"content-type"`
-	Length		int64	`json:"size"`
-	Created		int64	`json:"created"`
+	FileName	string			`json:"filename"`
+	ContentType	string			`json:"content-type"`
+	ContentTypeFrom	string			`json:"content-type-from,omitempty"`
+	Length		int64			`json:"size"`
+	Created		int64			`json:"created"`
+	Fields		map[string]string	`json:"fields,omitempty"`
+	Attributes	map[string]Attribute	`json:"attributes,omitempty"`
+	Tags		[]string		`json:"tags,omitempty"`
+}
+
+// Annotation is a change to an object's filename, attributes and tags made
+// after it was uploaded. Annotations are kept as an append-only history
+// beside the object's original MetaData, which never changes. Each is a
+// revision of the object's meta, numbered from 1; the upload is revision 0.
+// ContentType is only set by the server, when an object uploaded as a plain
+// object is later sent as a manifest.
+type Annotation struct {
+	Revision	int			`json:"revision"`
+	Author		string			`json:"author"`
+	Created		int64			`json:"created"`
+	FileName	string			`json:"filename,omitempty"`
+	Set		map[string]Attribute	`json:"set,omitempty"`
+	Unset		[]string		`json:"unset,omitempty"`
+	AddTags		[]string		`json:"add-tags,omitempty"`
+	RemoveTags	[]string		`json:"remove-tags,omitempty"`
+	ContentType	string			`json:"content-type,omitempty"`
 }
 
 type ResponseData struct {
@@ -38,32 +66,278 @@ type ResponseData struct {
 	Status	string		`json:"status"`
 	Oid	string		`json:"oid,omitempty"`
 	Meta	*MetaData	`json:"meta,omitempty"`
+	Upload	*Upload		`json:"upload,omitempty"`
+	Token	*Token		`json:"token,omitempty"`
+	Tokens	[]*Token	`json:"tokens,omitempty"`
+	Annotation	*Annotation	`json:"annotation,omitempty"`
+	Annotations	[]*Annotation	`json:"annotations,omitempty"`
+	Revision	*int		`json:"revision,omitempty"`
+	Ref		*Ref		`json:"ref,omitempty"`
+	Refs		[]*Ref		`json:"refs,omitempty"`
+	RefLog		[]*RefLogEntry	`json:"reflog,omitempty"`
+	Manifest	[]ManifestEntry	`json:"manifest,omitempty"`
+	Manifests	[]string	`json:"manifests,omitempty"`
+	Missing		[]string	`json:"missing,omitempty"`
+	Imported	[]ImportResult	`json:"imported,omitempty"`
+	Derived		Derived		`json:"derived,omitempty"`
+	Scrub		*ScrubState	`json:"scrub,omitempty"`
+	Scrubbed	[]*ScrubRecord	`json:"scrubbed,omitempty"`
 }
 
 type MetaStore interface {
 	Get(oid string) (*MetaData, error)
 	Put(oid string, d *MetaData) error
 	Keys() ([]string, error)
+	Iterate(order, after string, fn func(cursor, oid string, d *MetaData) bool) error
+	Query(order string, filters []MetaFilter, after string, fn func(cursor, oid string, d *MetaData) bool) error
+	Annotate(oid string, a *Annotation) error
+	Annotations(oid string) ([]*Annotation, error)
+	RefStore
+	ManifestStore
+	RenditionStore
+	DerivedStore
+	ScrubStore
+	LockStore
+	Namespace(name string) MetaStore
+}
+
+// Ref is a named, movable pointer to an object, e.g. "sku-1234/datasheet".
+// Revision counts the updates made to it, which are kept in its reflog.
+type Ref struct {
+	Name		string	`json:"name"`
+	Oid		string	`json:"oid"`
+	Revision	int	`json:"revision"`
+	Updated		int64	`json:"updated"`
+	UpdatedBy	string	`json:"updated-by"`
+}
+
+// RefLogEntry records one update of a ref. New is empty if the ref was
+// deleted.
+type RefLogEntry struct {
+	Revision	int	`json:"revision"`
+	Old		string	`json:"old,omitempty"`
+	New		string	`json:"new,omitempty"`
+	Author		string	`json:"author"`
+	Time		int64	`json:"time"`
+}
+
+// RefStore keeps the refs of a namespace. UpdateRef sets a ref to point at
+// oid, which must be an object in the namespace, or deletes it if oid is
+// empty. check is given the ref's current state, nil if it doesn't exist,
+// and can veto the update by returning an error; it is called in the same
+// transaction as the update, so can be used for compare-and-swap.
+type RefStore interface {
+	Ref(name string) (*Ref, error)
+	Refs() ([]*Ref, error)
+	UpdateRef(name, oid, author string, check func(current *Ref) error) (*Ref, error)
+	RefLog(name string) ([]*RefLogEntry, error)
+}
+
+// ManifestEntry is one member of a manifest: an object and the path it has
+// within the bundle.
+type ManifestEntry struct {
+	Path	string	`json:"path"`
+	Oid	string	`json:"oid"`
+}
+
+// ManifestStore records manifests, objects whose content lists other
+// objects, so that the manifests an object belongs to can be found.
+// PutManifest stores the manifest's meta like Put, but only if every object
+// it lists is in the namespace. ReferencedBy returns the OIDs of the
+// manifests that list oid directly.
+type ManifestStore interface {
+	PutManifest(oid string, d *MetaData, entries []ManifestEntry) error
+	ReferencedBy(oid string) ([]string, error)
+}
+
+// RenditionStore links images to their renditions, which are objects of
+// their own. PutRendition stores the rendition's meta like Put, unless it is
+// already in the namespace, and links it to oid for spec, which must be
+// canonical. Rendition returns the OID linked to oid for spec, or
+// errRenditionNotFound.
+type RenditionStore interface {
+	Rendition(oid, spec string) (string, error)
+	PutRendition(oid, spec, renditionOid string, d *MetaData) error
+}
+
+// DerivedStore keeps what the extractors learned from object content.
+// Content is shared by every namespace, so the namespace views of a store
+// share its Derived metadata. PutDerived merges the results of the
+// extractors in d with any recorded before. Derived returns
+// errDerivedNotFound if no extractor has inspected oid.
+type DerivedStore interface {
+	Derived(oid string) (Derived, error)
+	PutDerived(oid string, d Derived) error
+}
+
+// ScrubStore keeps the scrubber's progress and the result of its last check
+// of each object. Like DerivedStore it is shared by every namespace view of
+// a store. RecordScrub stores a result and the state the scrub reached with
+// it together, and FinishScrubPass marks the objects a finished pass didn't
+// find as missing.
+type ScrubStore interface {
+	ScrubState() (*ScrubState, error)
+	RecordScrub(rec *ScrubRecord, state *ScrubState) error
+	FinishScrubPass(state *ScrubState) ([]*ScrubRecord, error)
+	ScrubRecord(oid string) (*ScrubRecord, error)
+	ScrubProblems() ([]*ScrubRecord, error)
+}
+
+// IntentLog durably records the objects an ObjectStore is about to add,
+// before they become visible. Committing an object's meta, in any
+// namespace, ends its intent in the same transaction, so an intent left
+// after a crash marks an object whose meta was never committed.
+type IntentLog interface {
+	BeginIntent(oid string) error
+	EndIntent(oid string) error
+	Intents() ([]string, error)
+}
+
+// User is the owner of a Lock, as named in the Git LFS locking API.
+type User struct {
+	Name	string	`json:"name"`
+}
+
+// Lock is a Git LFS file lock. Only the lock's owner can release it, unless
+// the release is forced.
+type Lock struct {
+	Id		string		`json:"id"`
+	Path		string		`json:"path"`
+	Owner		User		`json:"owner"`
+	LockedAt	time.Time	`json:"locked_at"`
+}
+
+// LockStore keeps the Git LFS locks of a namespace, at most one per path.
+// AddLocks returns errLockExists if a path is already locked. FilteredLocks
+// returns up to limit locks, all of them if limit is 0, starting from cursor,
+// along with the cursor for the next page. DeleteLock returns the deleted
+// lock, or nil if there was no lock with that id.
+type LockStore interface {
+	AddLocks(locks ...Lock) error
+	Locks() ([]Lock, error)
+	FilteredLocks(path, cursor string, limit int) ([]Lock, string, error)
+	DeleteLock(user, id string, force bool) (*Lock, error)
+}
+
+type Token struct {
+	ID		string		`json:"id"`
+	Name		string		`json:"name"`
+	Scopes		[]string	`json:"scopes"`
+	Namespaces	[]string	`json:"namespaces,omitempty"`
+	CreatedBy	string		`json:"created-by"`
+	Created		int64		`json:"created"`
+	Secret		string		`json:"token,omitempty"`
 }
 
+type TokenStore interface {
+	CreateToken(name, createdBy string, scopes, namespaces []string) (*Token, string, error)
+	LookupToken(secret string) (*Token, error)
+	Tokens() ([]*Token, error)
+	RevokeToken(id string) error
+}
+
+var (
+	errInvalidOid    = errors.New("Invalid OID")
+	errNoFileParts   = errors.New("No file parts found in request")
+	errFieldTooLarge = errors.New("Form value is too large")
+	errInvalidOrder  = errors.New("Invalid listing order")
+	errInvalidCursor = errors.New("Invalid listing cursor")
+	errInvalidLimit  = errors.New("Invalid listing limit")
+	errInvalidFilter = errors.New("Invalid listing filter")
+)
+
+// maxFieldSize limits the size of a plain form value sent with an upload,
+// and maxFieldsSize that of all of them, names included, or of all the
+// X-ND-Meta-* headers.
+const (
+	maxFieldSize  = 64 * 1024
+	maxFieldsSize = 256 * 1024
+)
+
+// Page sizes for GET /objects.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
 // App links a Router, ObjectStore, and MetaStore to provide the LFS server.
 type App struct {
 	router		*mux.Router
 	objectStore	ObjectStore
 	metaStore	MetaStore
+	uploadStore	*UploadStore
+	tokenStore	TokenStore
+	auth		[]Authenticator
+	sniffer		*Sniffer
+	renderer	*renderer
+	extractQueue	chan extractJob
+	extractSlots	chan struct{}
+	importDir	string
+	maxImportSize	int64
 }
 
-func NewApp(st ObjectStore, mst MetaStore) *App {
-	app := &App{objectStore: st, metaStore: mst}
+// NewApp creates the App. Requests are checked against each Authenticator in
+// turn; if none are given, authentication is disabled.
+func NewApp(st ObjectStore, mst MetaStore, ust *UploadStore, tst TokenStore, auth ...Authenticator) *App {
+	app := &App{objectStore: st, metaStore: mst, uploadStore: ust, tokenStore: tst, auth: auth, sniffer: NewSniffer(), renderer: newRenderer(maxRenders), extractQueue: make(chan extractJob, extractQueueSize), extractSlots: make(chan struct{}, maxExtracts), maxImportSize: defaultMaxImportSize}
+	for i := 0; i < extractWorkers; i++ {
+		go app.extractWorker()
+	}
 	r := mux.NewRouter()
+	read := func(h http.HandlerFunc) http.HandlerFunc { return app.requireScope(scopeRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return app.requireScope(scopeWrite, h) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return app.requireScope(scopeAdmin, h) }
 	
 	r.HandleFunc("/", app.RootHandler).Methods("GET").MatcherFunc(AcceptsMeta)
 	
-	r.HandleFunc("/objects", app.DirHandler).Methods("GET").MatcherFunc(AcceptsMeta)
+	// Object, manifest, ref, Git LFS and upload routes are served for the default namespace and,
+	// with the same handlers, for each named one under /ns/{namespace}.
+	for _, prefix := range []string{"", "/ns/{namespace:" + namespacePattern + "}"} {
+		r.HandleFunc(prefix+"/objects", read(app.DirHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects", write(app.PostHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+		
+		r.HandleFunc(prefix+"/objects/{oid}", write(app.PutHandler)).Methods("PUT").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}", read(app.GetHandler)).Methods("GET", "HEAD").MatcherFunc(AcceptsNotMeta)
+		r.HandleFunc(prefix+"/objects/{oid}", read(app.GetMetaHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}/annotations", read(app.ListAnnotationsHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}/annotations", write(app.AnnotateHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}/manifests", read(app.ReferencedByHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}/derived", read(app.DerivedHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/objects/{oid}/renditions/{spec}", read(app.RenditionHandler)).Methods("GET", "HEAD").MatcherFunc(AcceptsNotMeta)
+		
+		r.HandleFunc(prefix+"/manifests", write(app.CreateManifestHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/manifests/{oid}", read(app.GetManifestHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/manifests/{oid}/archive", read(app.ManifestArchiveHandler)).Methods("GET").MatcherFunc(AcceptsNotMeta)
+		r.HandleFunc(prefix+"/archive", read(app.ArchiveHandler)).Methods("GET", "POST").MatcherFunc(AcceptsNotMeta)
+		r.HandleFunc(prefix+"/import", write(app.ImportHandler)).Methods("PUT", "POST").MatcherFunc(AcceptsMeta)
+		
+		r.HandleFunc(prefix+"/refs", read(app.ListRefsHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/refs/{name:.+}", write(app.PutRefHandler)).Methods("PUT").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/refs/{name:.+}", write(app.DeleteRefHandler)).Methods("DELETE").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/refs/{name:.+}", read(app.GetRefHandler)).Methods("GET", "HEAD").MatcherFunc(AcceptsNotMeta)
+		r.HandleFunc(prefix+"/refs/{name:.+}", read(app.GetRefMetaHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+		
+		r.HandleFunc(prefix+"/lfs/objects/batch", read(app.BatchHandler)).Methods("POST").MatcherFunc(AcceptsLFS)
+		r.HandleFunc(prefix+"/lfs/verify", write(app.VerifyHandler)).Methods("POST").MatcherFunc(AcceptsLFS)
+		r.HandleFunc(prefix+"/lfs/locks", read(app.ListLocksHandler)).Methods("GET").MatcherFunc(AcceptsLFS)
+		r.HandleFunc(prefix+"/lfs/locks", write(app.CreateLockHandler)).Methods("POST").MatcherFunc(AcceptsLFS)
+		r.HandleFunc(prefix+"/lfs/locks/verify", write(app.VerifyLocksHandler)).Methods("POST").MatcherFunc(AcceptsLFS)
+		r.HandleFunc(prefix+"/lfs/locks/{id}/unlock", write(app.UnlockHandler)).Methods("POST").MatcherFunc(AcceptsLFS)
+		
+		r.HandleFunc(prefix+"/uploads", write(app.CreateUploadHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/uploads/{id}", write(app.GetUploadHandler)).Methods("GET", "HEAD").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/uploads/{id}", write(app.PatchUploadHandler)).Methods("PATCH").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/uploads/{id}", write(app.DeleteUploadHandler)).Methods("DELETE").MatcherFunc(AcceptsMeta)
+		r.HandleFunc(prefix+"/uploads/{id}/finalize", write(app.FinalizeUploadHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+	}
+	
+	r.HandleFunc("/tokens", admin(app.ListTokensHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+	r.HandleFunc("/tokens", admin(app.CreateTokenHandler)).Methods("POST").MatcherFunc(AcceptsMeta)
+	r.HandleFunc("/tokens/{id}", admin(app.RevokeTokenHandler)).Methods("DELETE").MatcherFunc(AcceptsMeta)
 	
-	r.HandleFunc("/objects/{oid}", app.PutHandler).Methods("PUT").MatcherFunc(AcceptsMeta)
-	r.HandleFunc("/objects/{oid}", app.GetHandler).Methods("GET", "HEAD").MatcherFunc(AcceptsNotMeta)
-	r.HandleFunc("/objects/{oid}", app.GetMetaHandler).Methods("GET").MatcherFunc(AcceptsMeta)
+	r.HandleFunc("/scrub", admin(app.ScrubHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+	r.HandleFunc("/scrub/{oid}", admin(app.ScrubRecordHandler)).Methods("GET").MatcherFunc(AcceptsMeta)
+	r.HandleFunc("/debug/vars", admin(expvar.Handler().ServeHTTP)).Methods("GET")
 	
 	app.router = r
 
@@ -129,153 +403,547 @@ func writeError(w http.ResponseWriter, r *http.Request, code int, e error) {
 	writeResponseData(w, r, d)
 }
 
+// validOid reports whether oid looks like a hex encoded SHA-256.
+func validOid(oid string) bool {
+	if len(oid) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(oid)
+	return err == nil
+}
+
+// requestNamespace returns the namespace a request was routed to, or "" for
+// the default namespace.
+func requestNamespace(r *http.Request) string {
+	return mux.Vars(r)["namespace"]
+}
+
+// namespacePath returns the URL prefix for the request's namespace.
+func namespacePath(r *http.Request) string {
+	if ns := requestNamespace(r); ns != "" {
+		return "/ns/" + ns
+	}
+	return ""
+}
+
+// metaStoreFor returns the view of the MetaStore for the request's
+// namespace. Content is shared between namespaces in the ObjectStore, but an
+// object is only visible in the namespaces that hold meta for it.
+func (a *App) metaStoreFor(r *http.Request) MetaStore {
+	if ns := requestNamespace(r); ns != "" {
+		return a.metaStore.Namespace(ns)
+	}
+	return a.metaStore
+}
+
 func (a *App) RootHandler(w http.ResponseWriter, r *http.Request) {
 	d := &ResponseData{code: 200, Status: "OK", Meta: nil}
 	writeResponseData(w, r, d)
 }
 
+// objectList is the body of a GET /objects response. Next is the URL of the
+// following page, if there is one.
+type objectList struct {
+	Objects	[]string	`json:"objects"`
+	Next	string		`json:"next,omitempty"`
+}
+
+// DirHandler lists the OIDs in the request's namespace a page at a time.
+// The query takes "order" (oid, filename, content-type, size or created),
+// "limit", "after", the cursor from the previous page, and any number of
+// filters such as "content-type=application/pdf" or "size>=1024"; see
+// parseListQuery. The next page's URL is returned as "next" and in a Link
+// header.
 func (a *App) DirHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest(r,200)
-	w.Header().Set("Content-Type", metaMediaType)
-	w.WriteHeader(200)
-	/*
-	objs, err := a.objectStore.List()
-	*/
-	keys, err := a.metaStore.Keys()
-	if (err != nil) || (len(keys) == 0) {
-		fmt.Fprintf(w, `{"objects":[]}`)
+	q, err := parseListQuery(r.URL.RawQuery)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	
+	list := objectList{Objects: []string{}}
+	var last string
+	more := false
+	err = a.metaStoreFor(r).Query(q.order, q.filters, q.after, func(cursor, oid string, d *MetaData) bool {
+		if len(list.Objects) == q.limit {
+			more = true
+			return false
+		}
+		list.Objects = append(list.Objects, oid)
+		last = cursor
+		return true
+	})
+	if err == errInvalidOrder || err == errInvalidCursor {
+		writeError(w, r, 400, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
 		return
 	}
 	
-	fmt.Fprint(w, "{\"objects\": ")
-	d := '['
-	for _, h := range keys {
-		fmt.Fprintf(w, "%c\"%s\"", d, h)
-		d = ','
+	if more {
+		list.Next = namespacePath(r) + "/objects?" + q.next(last)
+		w.Header().Set("Link", "<"+list.Next+`>; rel="next"`)
 	}
-	fmt.Fprint(w, "]}")
+	
+	logRequest(r,200)
+	w.Header().Set("Content-Type", metaMediaType)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(list)
 }
 
-func (a *App) BuildMetaResponse(oid string) (*ResponseData, error) {
-	meta,err := a.metaStore.Get(oid)
+// BuildMetaResponse responds with the latest revision of an object's meta.
+func (a *App) BuildMetaResponse(ms MetaStore, oid string) (*ResponseData, error) {
+	meta,n,err := latestMeta(ms, oid)
 	if err != nil {
 		return nil, err
 	}
-	return &ResponseData{code: 200, Status: "OK", Oid: oid, Meta: meta}, nil
+	return &ResponseData{code: 200, Status: "OK", Oid: oid, Meta: meta, Revision: &n}, nil
 }
 
+// GetMetaHandler returns an object's meta, by default as of its latest
+// revision. Earlier revisions can be read with "?revision=N", where 0 is the
+// meta as uploaded, or "?at=<time>".
 func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 	mv := mux.Vars(r)
 	oid := mv["oid"]
-	d,err := a.BuildMetaResponse(oid)
+	ms := a.metaStoreFor(r)
+	meta,err := ms.Get(oid)
+	if err != nil {
+		writeError(w, r, 404, err)
+		return
+	}
+	history,err := ms.Annotations(oid)
 	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	
+	n,err := requestRevision(r, meta, history)
+	if err == errRevisionNotFound {
 		writeError(w, r, 404, err)
 		return
 	}
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	
+	// The latest revision changes with each annotation, so caches must check
+	// back, but a revision asked for by number never changes.
+	modified := meta.Created
+	if n > 0 {
+		modified = history[n-1].Created
+	}
+	setValidators(w, metaETag(oid, n), modified)
+	if r.URL.Query().Get("revision") != "" {
+		w.Header().Set("Cache-Control", immutableCacheControl(r))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if notModified(r, metaETag(oid, n), modified) {
+		writeNotModified(w, r)
+		return
+	}
+	d := &ResponseData{code: 200, Status: "OK", Oid: oid, Meta: mergeRevisions(meta, history, n), Revision: &n}
 	writeResponseData(w, r, d)
 }
 
 func (a *App) GetHandler(w http.ResponseWriter, r *http.Request) {
 	mv := mux.Vars(r)
-	oid := mv["oid"]
-	
-	/* TODO: Support resume download using Range header
-	var fromByte int64
-	statusCode := 200
-	if rangeHdr := r.Header.Get("Range"); rangeHdr != "" {
-		regex := regexp.MustCompile(`bytes=(\d+)\-.*`)
-		match := regex.FindStringSubmatch(rangeHdr)
-		if match != nil && len(match) > 1 {
-			statusCode = 206
-			fromByte, _ = strconv.ParseInt(match[1], 10, 32)
-			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", fromByte, meta.Size-1, int64(meta.Size)-fromByte))
-		}
-	}
-	content, err := a.contentStore.Get(meta, fromByte)*/
+	a.serveObject(w, r, mv["oid"])
+}
 
-	meta,err := a.metaStore.Get(oid)
+// serveObject responds with the content of an object in the request's
+// namespace, or the parts of it asked for in a Range header. Content never
+// changes, so it is sent with the OID as its ETag and may be cached for good,
+// unless the caller has already set a Cache-Control header. An annotated
+// object is the exception: its filename can still change, so caches must
+// check back.
+func (a *App) serveObject(w http.ResponseWriter, r *http.Request, oid string) {
+	meta,n,err := latestMeta(a.metaStoreFor(r), oid)
 	if err != nil {
 		writeError(w, r, 404, err)
 		return
 	}
-	content, err := a.objectStore.Get(oid, 0)
+	if !a.objectStore.Exists(oid) {
+		writeError(w, r, 404, errObjectNotFound)
+		return
+	}
+	
+	setValidators(w, objectETag(oid), meta.Created)
+	if w.Header().Get("Cache-Control") == "" {
+		if n > 0 {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", immutableCacheControl(r))
+		}
+	}
+	// Sent with a 304 too, so that a cache revalidating an annotated object
+	// picks up its new filename.
+	w.Header().Set("Content-Disposition", contentDisposition("inline", meta.FileName))
+	if notModified(r, objectETag(oid), meta.Created) {
+		writeNotModified(w, r)
+		return
+	}
+
+	/* Also need to properly pass the accept content-type header in the request */
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	var ranges []byteRange
+	if rangeHdr := r.Header.Get("Range"); rangeHdr != "" && checkIfRange(r, oid, meta) {
+		// A Range header that can't be parsed is ignored, and the whole
+		// object sent, as RFC 7233 asks; only one that parses but covers
+		// none of the object is refused.
+		ranges, err = parseRange(rangeHdr, meta.Length)
+		if err == errUnsatisfiableRange {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Length))
+			writeError(w, r, 416, err)
+			return
+		}
+		// Overlapping ranges adding up to more than the whole object
+		// are cheaper to answer with the whole object.
+		var total int64
+		for _, rg := range ranges {
+			total += rg.length
+		}
+		if total > meta.Length {
+			ranges = nil
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		a.writeObject(w, r, oid, meta, byteRange{0, meta.Length}, 200)
+	case 1:
+		w.Header().Set("Content-Range", ranges[0].contentRange(meta.Length))
+		a.writeObject(w, r, oid, meta, ranges[0], 206)
+	default:
+		a.writeObjectRanges(w, r, oid, meta, ranges)
+	}
+}
+
+// writeObject sends a single span of an object as the response body. Only
+// the requested bytes are read from the ObjectStore.
+func (a *App) writeObject(w http.ResponseWriter, r *http.Request, oid string, meta *MetaData, rg byteRange, code int) {
+	content, err := a.objectStore.Get(oid, rg.start)
 	if err != nil {
 		writeError(w, r, 404, err)
 		return
 	}
 	defer content.Close()
-	
-	/* Also need to properly pass the accept content-type header in the request */
-	logRequest(r,200)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", meta.FileName))
+
+	logRequest(r, code)
 	w.Header().Set("Content-Type", meta.ContentType)
-	w.WriteHeader(200)
-	io.Copy(w, content)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(rg.length, 10))
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		io.CopyN(w, content, rg.length)
+	}
+}
+
+// contentDisposition returns a Content-Disposition header of the given type
+// naming a file, with the name quoted and escaped as needed.
+func contentDisposition(disposition, fileName string) string {
+	if fileName == "" {
+		return disposition
+	}
+	if cd := mime.FormatMediaType(disposition, map[string]string{"filename": fileName}); cd != "" {
+		return cd
+	}
+	return disposition
+}
+
+// writeObjectRanges sends several spans of an object as a multipart/byteranges
+// response.
+func (a *App) writeObjectRanges(w http.ResponseWriter, r *http.Request, oid string, meta *MetaData, ranges []byteRange) {
+	mw := multipart.NewWriter(w)
+	logRequest(r, 206)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(206)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	for _, rg := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {meta.ContentType},
+			"Content-Range": {rg.contentRange(meta.Length)},
+		})
+		if err != nil {
+			return
+		}
+		content, err := a.objectStore.Get(oid, rg.start)
+		if err != nil {
+			logger.Log(kv{"fn": "writeObjectRanges", "oid": oid, "err": err})
+			return
+		}
+		_, err = io.CopyN(part, content, rg.length)
+		content.Close()
+		if err != nil {
+			return
+		}
+	}
+	mw.Close()
 }
 
 func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 	mv := mux.Vars(r)
 	oid := mv["oid"]
-	if a.objectStore.Exists(oid) {
+	ms := a.metaStoreFor(r)
+	if d, err := a.BuildMetaResponse(ms, oid); err == nil {
 		io.Copy(ioutil.Discard, r.Body) // Consume the file data and throw away
-		d, err := a.BuildMetaResponse(oid)
-		if err != nil {
-			writeError(w, r, 500, err)
-			return
-		}
 		d.Status = "Already Exists"
 		writeResponseData(w, r, d)
 		return
 	}
 	
-	// Set up for Multipart streaming read
-	reader, err := r.MultipartReader()
+	content, meta, err := uploadContent(r)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	
+	// Try to put the file into the store
+	d, err := a.commitObject(ms, oid, meta, content)
+	if err == errHashMismatch {
+		writeError(w, r, 400, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, d)
+}
+
+// PostHandler stores an object without the client having to know its OID
+// up front. The content is hashed as it is streamed into the ObjectStore and
+// the calculated hash becomes the OID. If the client does know the hash it
+// can send it in X-ND-Expected-Oid to have it checked.
+func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
+	expected := r.Header.Get("X-ND-Expected-Oid")
+	if expected != "" && !validOid(expected) {
+		writeError(w, r, 400, errInvalidOid)
+		return
+	}
+	
+	content, meta, err := uploadContent(r)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	
+	oid := expected
+	var written int64
+	switch {
+	case oid == "":
+		oid, written, err = a.objectStore.Ingest(content)
+	case a.objectStore.Exists(oid):
+		written, err = verifyContent(oid, content)
+	default:
+		written, err = a.objectStore.Put(oid, content)
+	}
+	if err == errHashMismatch {
+		writeError(w, r, 400, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	
+	w.Header().Set("Location", namespacePath(r)+"/objects/"+oid)
+	d, err := a.recordNewMeta(a.metaStoreFor(r), oid, meta, written)
 	if err != nil {
 		writeError(w, r, 500, err)
 		return
 	}
+	writeResponseData(w, r, d)
+}
+
+// uploadContent returns the file content of a PUT or POST request along
+// with the client supplied metadata for it. Two body formats are accepted:
+//
+// multipart/form-data: the first file part is the content and its filename
+// is used. Plain form values sent before the file are kept as Fields.
+//
+// Anything else: the raw body is the content. The filename is taken from
+// X-ND-Filename or Content-Disposition, and X-ND-Meta-* headers are kept as
+// Fields.
+//
+// Either way, attributes can be sent as a JSON object and tags as a comma
+// separated list, in form values or X-ND-Attributes and X-ND-Tags headers.
+func uploadContent(r *http.Request) (io.Reader, *MetaData, error) {
+	meta := &MetaData{FileName: "", ContentType: "", Length: 0}
+	
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		meta.FileName = r.Header.Get("X-ND-Filename")
+		if meta.FileName == "" {
+			if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+				meta.FileName = params["filename"]
+			}
+		}
+		total := 0
+		for key, value := range r.Header {
+			if strings.HasPrefix(key, "X-Nd-Meta-") {
+				if total += len(key) + len(value[0]); total > maxFieldsSize {
+					return nil, nil, errFieldTooLarge
+				}
+				addField(meta, strings.TrimPrefix(key, "X-Nd-Meta-"), value[0])
+			}
+		}
+		if err := addAttributes(meta, r.Header.Get("X-ND-Attributes"), r.Header.Get("X-ND-Tags")); err != nil {
+			return nil, nil, err
+		}
+		return r.Body, meta, nil
+	}
 	
-	meta := MetaData{FileName: "", ContentType: "", Length: 0}
+	// Set up for Multipart streaming read
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
 	
 	// Iterate through the parts
+	total := 0
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
-			break
+			return nil, nil, errNoFileParts
 		}
-		log.Printf("FormName: %s\n", part.FormName())
-		log.Printf("FileName: %s\n", part.FileName())
-		meta.FileName = part.FileName()
-		for key, value := range part.Header {
-			log.Printf("%s: %s\n", key, value[0])
+		if err != nil {
+			return nil, nil, err
 		}
-		
 		// if part.FileName() is empty, decode the value
 		if part.FileName() == "" {
 			buf := new(bytes.Buffer)
-			buf.ReadFrom(part)
-			log.Printf("Value: %s\n", buf.String())
+			if _, err := buf.ReadFrom(io.LimitReader(part, maxFieldSize+1)); err != nil {
+				return nil, nil, err
+			}
+			if buf.Len() > maxFieldSize {
+				return nil, nil, errFieldTooLarge
+			}
+			if total += len(part.FormName()) + buf.Len(); total > maxFieldsSize {
+				return nil, nil, errFieldTooLarge
+			}
+			switch part.FormName() {
+			case "attributes":
+				err = addAttributes(meta, buf.String(), "")
+			case "tags":
+				err = addAttributes(meta, "", buf.String())
+			default:
+				addField(meta, part.FormName(), buf.String())
+			}
+			if err != nil {
+				return nil, nil, err
+			}
 			continue
 		}
 		
-		// Otherwise, part is a file, try to put it into the store
-		written, err := a.objectStore.Put(oid, part)
+		meta.FileName = part.FileName()
+		return part, meta, nil
+	}
+}
+
+// addField records a client supplied metadata value. Names are case
+// insensitive, so they are stored lower cased.
+func addField(meta *MetaData, name, value string) {
+	if name == "" {
+		return
+	}
+	if meta.Fields == nil {
+		meta.Fields = make(map[string]string)
+	}
+	meta.Fields[strings.ToLower(name)] = value
+}
+
+// addAttributes adds attributes, from a JSON object, and tags, from a comma
+// separated list, to meta. Either may be empty.
+func addAttributes(meta *MetaData, attrs, tags string) error {
+	if attrs != "" {
+		a, err := parseAttributes(attrs)
 		if err != nil {
-			writeError(w, r, 500, err)
-			return
+			return err
+		}
+		if meta.Attributes == nil {
+			meta.Attributes = a
+		} else {
+			for name, v := range a {
+				meta.Attributes[name] = v
+			}
 		}
-		meta.Length = written
-		meta.ContentType = a.objectStore.DetectContentType(oid)
-		log.Printf("Detected Content-Type: %s", meta.ContentType)
-		meta.Created = time.Now().Unix()
-		err = a.metaStore.Put(oid, &meta)
+	}
+	if tags != "" {
+		t, err := parseTags(tags)
 		if err != nil {
-			writeError(w, r, 500, err)
-			return
+			return err
 		}
-		d := &ResponseData{code: 201, Status: "Created", Oid: oid, Meta: &meta}
-		writeResponseData(w, r, d)
-		return
+		for _, tag := range t {
+			meta.Tags = addTag(meta.Tags, tag)
+		}
+	}
+	return nil
+}
+
+// commitObject writes the content from r into the ObjectStore under oid and,
+// once the hash has been verified, records meta in ms. Length, ContentType
+// and Created are filled in from the stored content.
+//
+// If the content is already stored, for another namespace, it is not stored
+// again, but r must still hash to oid: knowing an OID is not enough to add
+// its object to a namespace.
+func (a *App) commitObject(ms MetaStore, oid string, meta *MetaData, r io.Reader) (*ResponseData, error) {
+	var written int64
+	var err error
+	if a.objectStore.Exists(oid) {
+		written, err = verifyContent(oid, r)
+	} else {
+		written, err = a.objectStore.Put(oid, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.recordMeta(ms, oid, meta, written)
+}
+
+// verifyContent reads r to the end and checks that it hashes to oid.
+func verifyContent(oid string, r io.Reader) (int64, error) {
+	hash := sha256.New()
+	written, err := io.Copy(hash, r)
+	if err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != oid {
+		return 0, errHashMismatch
+	}
+	return written, nil
+}
+
+// recordNewMeta records meta for a stored object, unless ms already has meta
+// for it, in which case that is returned as "Already Exists".
+func (a *App) recordNewMeta(ms MetaStore, oid string, meta *MetaData, written int64) (*ResponseData, error) {
+	if d, err := a.BuildMetaResponse(ms, oid); err == nil {
+		d.Status = "Already Exists"
+		return d, nil
+	}
+	return a.recordMeta(ms, oid, meta, written)
+}
+
+// recordMeta fills in the server-derived fields of meta for a stored object
+// and writes it to ms, then queues the object for the extractors.
+func (a *App) recordMeta(ms MetaStore, oid string, meta *MetaData, written int64) (*ResponseData, error) {
+	meta.Length = written
+	meta.ContentType, meta.ContentTypeFrom = a.sniffer.DetectObject(a.objectStore, oid, meta.FileName)
+	meta.Created = time.Now().Unix()
+	err := ms.Put(oid, meta)
+	if err != nil {
+		return nil, err
 	}
-	writeError(w, r, 400, errors.New("No file parts found in request"))
+	a.queueExtract(oid, meta.ContentType)
+	return &ResponseData{code: 201, Status: "Created", Oid: oid, Meta: meta}, nil
 }
@@ -1,18 +1,38 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/context"
 )
 
 func TestGetAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	res, err := api("GET", "/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -29,10 +49,14 @@ func TestGetAuthed(t *testing.T) {
 	if string(by) != content {
 		t.Fatalf("expected content to be `content`, got: %s", string(by))
 	}
+
+	if nosniff := res.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+		t.Fatalf("expected X-Content-Type-Options of nosniff, got %q", nosniff)
+	}
 }
 
 func TestGetAuthedWithRange(t *testing.T) {
-	req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+	req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -50,7 +74,7 @@ func TestGetAuthedWithRange(t *testing.T) {
 		t.Fatalf("expected status 206, got %d", res.StatusCode)
 	}
 	if cr := res.Header.Get("Content-Range"); len(cr) > 0 {
-		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content)-fromByte)
+		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content))
 		if cr != expected {
 			t.Fatalf("expected Content-Range header of %q, got %q", expected, cr)
 		}
@@ -69,7 +93,7 @@ func TestGetAuthedWithRange(t *testing.T) {
 }
 
 func TestGetUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
+	res, err := api("GET", "/objects/"+contentOid, contentMediaType, "", "", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -80,7 +104,7 @@ func TestGetUnAuthed(t *testing.T) {
 }
 
 func TestGetBadAuth(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
+	res, err := api("GET", "/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -91,7 +115,7 @@ func TestGetBadAuth(t *testing.T) {
 }
 
 func TestGetMetaAuthed(t *testing.T) {
-	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
+	res, err := api("GET", "/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -100,26 +124,20 @@ func TestGetMetaAuthed(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
-
-	if meta.Oid != contentOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
-	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
 
-	if meta.Size != contentSize {
-		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+	if d.Oid != contentOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, d.Oid)
 	}
 
-	download := meta.Actions["download"]
-	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected download link, got %s", download.Href)
+	if d.Meta == nil || d.Meta.Length != contentSize || d.Meta.FileName != "content.txt" {
+		t.Fatalf("expected the object's meta with a size of `%d`, got: %+v", contentSize, d.Meta)
 	}
 }
 
 func TestGetMetaUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/objects/"+contentOid, metaMediaType, "", "", nil)
+	res, err := api("GET", "/objects/"+contentOid, metaMediaType, "", "", nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -129,83 +147,9 @@ func TestGetMetaUnAuthed(t *testing.T) {
 	}
 }
 
-func TestPostAuthedNewObject(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":1234}`, nonExistingOid))
-	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
-	}
-
-	if res.StatusCode != 202 {
-		t.Fatalf("expected status 202, got %d", res.StatusCode)
-	}
-
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
-
-	if meta.Oid != nonExistingOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", nonExistingOid, meta.Oid)
-	}
-
-	if meta.Size != 1234 {
-		t.Fatalf("expected to see a size of `1234`, got: `%d`", meta.Size)
-	}
-
-	if download, ok := meta.Actions["download"]; ok {
-		t.Fatalf("expected POST to not contain a download link, got %s", download.Href)
-	}
-
-	upload, ok := meta.Actions["upload"]
-	if !ok {
-		t.Fatal("expected upload link to be present")
-	}
-
-	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+nonExistingOid {
-		t.Fatalf("expected upload link, got %s", upload.Href)
-	}
-}
-
-func TestPostAuthedExistingObject(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
-	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
-	}
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
-	}
-
-	var meta Representation
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&meta)
-
-	if meta.Oid != contentOid {
-		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
-	}
-
-	if meta.Size != contentSize {
-		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
-	}
-
-	download := meta.Actions["download"]
-	if download.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected download link, got %s", download.Href)
-	}
-
-	upload, ok := meta.Actions["upload"]
-	if !ok {
-		t.Fatalf("expected upload link to be present")
-	}
-
-	if upload.Href != "http://localhost:8080/bilbo/repo/objects/"+contentOid {
-		t.Fatalf("expected upload link, got %s", upload.Href)
-	}
-}
-
 func TestPostUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
-	res, err := api("POST", "/bilbo/readonly/objects", metaMediaType, "", "", buf)
+	res, err := api("POST", "/objects", metaMediaType, "", "", buf)
 	if err != nil {
 		t.Fatalf("response error: %s", err)
 	}
@@ -215,282 +159,2474 @@ func TestPostUnAuthed(t *testing.T) {
 	}
 }
 
-func TestPut(t *testing.T) {
-	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+func TestReadOnlyToken(t *testing.T) {
+	_, secret, err := testMetaStore.CreateToken("reader", testUser, []string{scopeRead}, nil)
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("error creating token: %s", err)
 	}
-	req.SetBasicAuth(testUser, testPass)
-	req.Header.Set("Accept", contentMediaType)
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(content)))
 
+	req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("response error: %s", err)
 	}
-
 	if res.StatusCode != 200 {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 
-	r, err := testContentStore.Get(&MetaObject{Oid: contentOid}, 0)
+	req, err = http.NewRequest("PUT", lfsServer.URL+"/objects/"+nonExistingOid, bytes.NewBufferString("content"))
 	if err != nil {
-		t.Fatalf("error retreiving from content store: %s", err)
-	} else {
-		defer r.Close()
+		t.Fatalf("request error: %s", err)
 	}
-	c, err := ioutil.ReadAll(r)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	res, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("error reading content: %s", err)
-	}
-	if string(c) != content {
-		t.Fatalf("expected content, got `%s`", string(c))
+		t.Fatalf("response error: %s", err)
 	}
-}
-
-func TestMediaTypesRequired(t *testing.T) {
-	m := []string{"GET", "PUT", "POST", "HEAD"}
-	for _, method := range m {
-		res, err := api(method, "/user/repo/objects/"+contentOid, "", testUser, testPass, nil)
-		if err != nil {
-			t.Fatalf("request error: %s", err)
-		}
-		if res.StatusCode != 404 {
-			t.Fatalf("expected status 404, got %d", res.StatusCode)
-		}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
 	}
 }
 
-func TestMediaTypesParsed(t *testing.T) {
-	accept := contentMediaType + "; charset=utf-8"
-	res, err := api("GET", "/user/repo/objects/"+contentOid, accept, testUser, testPass, nil)
+func TestTokens(t *testing.T) {
+	buf := bytes.NewBufferString(`{"name":"etl", "scopes":["write"]}`)
+	res, err := api("POST", "/tokens", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
-	}
-}
-
-func TestLocksList(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, testUser, testPass, nil)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
 	}
 
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Token == nil || d.Token.Secret == "" {
+		t.Fatalf("expected the new token secret in the response, got %+v", d)
 	}
+	id, secret := d.Token.ID, d.Token.Secret
 
-	body, err := ioutil.ReadAll(res.Body)
+	// A write token can't manage tokens
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/tokens", nil)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	res, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
-	}
-
-	var list LockList
-	if err := json.Unmarshal(body, &list); err != nil {
-		t.Fatalf("expected response body to be LockList, got error: %s", err)
-	}
-	if len(list.Locks) != 1 {
-		t.Errorf("expected returned lock count to match, got: %d", len(list.Locks))
+		t.Fatalf("response error: %s", err)
 	}
-	if list.Locks[0].Id != lockId {
-		t.Errorf("expected lockId to match, got: %s", list.Locks[0].Id)
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
 	}
-}
 
-func TestLocksListUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, "", "", nil)
+	res, err = api("GET", "/tokens", metaMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
-
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	found := false
+	for _, tok := range d.Tokens {
+		if tok.Secret != "" {
+			t.Fatalf("expected token list to not include secrets")
+		}
+		found = found || tok.ID == id
+	}
+	if !found {
+		t.Fatalf("expected new token %s to be listed", id)
 	}
-}
 
-func TestLocksVerify(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
-	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, testUser, testPass, buf)
+	res, err = api("DELETE", "/tokens/"+id, metaMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
-
 	if res.StatusCode != 200 {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	req, _ = http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	res, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
+		t.Fatalf("response error: %s", err)
 	}
-
-	var list VerifiableLockList
-	if err := json.Unmarshal(body, &list); err != nil {
-		t.Fatalf("expected response body to be VerifiableLockList, got error: %s", err)
+	if res.StatusCode != 401 {
+		t.Fatalf("expected revoked token to give status 401, got %d", res.StatusCode)
 	}
 }
 
-func TestLocksVerifyUnAuthed(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
-	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, "", "", buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+func TestNamespaces(t *testing.T) {
+	data := "namespaced content"
+	oid := sha256Hex([]byte(data))
+
+	res := bearer(t, "PUT", "/ns/alpha/objects/"+oid, "", data)
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
 	}
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	for path, code := range map[string]int{
+		"/ns/alpha/objects/" + oid: 200,
+		"/ns/beta/objects/" + oid:  404,
+		"/objects/" + oid:          404,
+	} {
+		res = bearer(t, "GET", path, "", "")
+		if res.StatusCode != code {
+			t.Fatalf("expected status %d for %s, got %d", code, path, res.StatusCode)
+		}
 	}
-}
 
-func TestLock(t *testing.T) {
-	path := "TestLock"
-	lock, err := createLock(testUser, testPass, path)
-	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+	res = bearer(t, "GET", "/ns/alpha/objects", "", "")
+	var list struct{ Objects []string }
+	json.NewDecoder(res.Body).Decode(&list)
+	if len(list.Objects) != 1 || list.Objects[0] != oid {
+		t.Fatalf("expected namespace listing to hold only %s, got %v", oid, list.Objects)
 	}
-	if lock == nil {
-		t.Errorf("expected lock to be created, got: %s", lock)
+
+	// Content that is already stored still has to be sent in full to add
+	// it to another namespace.
+	res = bearer(t, "PUT", "/ns/beta/objects/"+oid, "", "not the content")
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
 	}
-	if lock.Owner.Name != testUser {
-		t.Errorf("expected lock owner to be match, got: %s", lock.Owner.Name)
+	res = bearer(t, "PUT", "/ns/beta/objects/"+oid, "", data)
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
 	}
-	if lock.Path != path {
-		t.Errorf("expected lock path to be match, got: %s", lock.Path)
+	res = bearer(t, "GET", "/ns/beta/objects/"+oid, "", "")
+	by, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(by) != data {
+		t.Fatalf("expected content from the second namespace, got %d %q", res.StatusCode, by)
 	}
 }
 
-func TestLockExists(t *testing.T) {
-	l, err := createLock(testUser, testPass, "TestLockExists")
+func TestNamespaceToken(t *testing.T) {
+	_, secret, err := testMetaStore.CreateToken("alpha", testUser, []string{scopeRead, scopeWrite}, []string{"alpha"})
 	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+		t.Fatalf("error creating token: %s", err)
 	}
 
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, l.Path))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, testUser, testPass, buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+	res := bearer(t, "POST", "/ns/alpha/objects", secret, "token content")
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+	if loc := res.Header.Get("Location"); loc != "/ns/alpha/objects/"+sha256Hex([]byte("token content")) {
+		t.Fatalf("expected Location within the namespace, got %q", loc)
 	}
 
-	if res.StatusCode != 409 {
-		t.Fatalf("expected status 409, got %d", res.StatusCode)
+	for _, path := range []string{"/ns/beta/objects", "/objects", "/objects/" + contentOid} {
+		res = bearer(t, "GET", path, secret, "")
+		if res.StatusCode != 403 {
+			t.Fatalf("expected status 403 for %s, got %d", path, res.StatusCode)
+		}
 	}
-}
 
-func TestLockUnAuthed(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, "TestLockUnAuthed"))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, "", "", buf)
+	buf := bytes.NewBufferString(`{"name":"bad", "scopes":["read"], "namespaces":["../x"]}`)
+	res, err = api("POST", "/tokens", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
-
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an invalid namespace, got %d", res.StatusCode)
 	}
 }
 
-func TestUnlock(t *testing.T) {
-	l, err := createLock(testUser, testPass, "TestUnlock")
-	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+func TestListPages(t *testing.T) {
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		data := fmt.Sprintf("page content %d", i)
+		res := bearer(t, "POST", "/ns/pages/objects", "", data)
+		if res.StatusCode != 201 {
+			t.Fatalf("expected status 201, got %d", res.StatusCode)
+		}
+		want[sha256Hex([]byte(data))] = true
+	}
+
+	for _, order := range []string{fieldOid, fieldCreated} {
+		var got []string
+		path := "/ns/pages/objects?limit=2&order=" + order
+		for pages := 0; path != ""; pages++ {
+			if pages > 3 {
+				t.Fatalf("expected 3 pages, still going at %s", path)
+			}
+			res := bearer(t, "GET", path, "", "")
+			if res.StatusCode != 200 {
+				t.Fatalf("expected status 200, got %d", res.StatusCode)
+			}
+			var list objectList
+			json.NewDecoder(res.Body).Decode(&list)
+			if len(list.Objects) > 2 {
+				t.Fatalf("expected at most 2 objects per page, got %d", len(list.Objects))
+			}
+			if list.Next != "" && res.Header.Get("Link") != "<"+list.Next+`>; rel="next"` {
+				t.Fatalf("expected Link header for the next page, got %q", res.Header.Get("Link"))
+			}
+			got = append(got, list.Objects...)
+			path = list.Next
+		}
+		if len(got) != len(want) {
+			t.Fatalf("expected %d objects in %s order, got %v", len(want), order, got)
+		}
+		for i, oid := range got {
+			if !want[oid] {
+				t.Fatalf("unexpected object %s in listing", oid)
+			}
+			if order == fieldOid && i > 0 && got[i-1] >= oid {
+				t.Fatalf("expected listing in OID order, got %v", got)
+			}
+		}
 	}
 
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser, testPass, buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+	for _, query := range []string{"limit=0", "limit=x", "order=colour", "after=!", "size^=1", "colour=red"} {
+		res := bearer(t, "GET", "/ns/pages/objects?"+query, "", "")
+		if res.StatusCode != 400 {
+			t.Fatalf("expected status 400 for %s, got %d", query, res.StatusCode)
+		}
 	}
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+}
+
+func TestListQuery(t *testing.T) {
+	for _, name := range []string{"invoice-1.txt", "invoice-2.txt", "receipt.txt"} {
+		req, _ := http.NewRequest("PUT", lfsServer.URL+"/ns/query-named/objects/"+sha256Hex([]byte(name)), bytes.NewBufferString(name))
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", metaMediaType)
+		req.Header.Set("X-ND-Filename", name)
+		if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 201 {
+			t.Fatalf("expected put of %s to succeed, got %v %v", name, res, err)
+		}
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
+	res := bearer(t, "GET", "/ns/query-named/objects?filename%5E=invoice-&limit=1", "", "")
+	var list objectList
+	json.NewDecoder(res.Body).Decode(&list)
+	if res.StatusCode != 200 || len(list.Objects) != 1 || list.Objects[0] != sha256Hex([]byte("invoice-1.txt")) {
+		t.Fatalf("expected the first invoice, got %d %+v", res.StatusCode, list)
+	}
+	if !strings.HasPrefix(list.Next, "/ns/query-named/objects?filename%5E=invoice-&") {
+		t.Fatalf("expected the next page to keep the filter, got %q", list.Next)
 	}
 
-	var unlockResponse UnlockResponse
-	if err := json.Unmarshal(body, &unlockResponse); err != nil {
-		t.Fatalf("expected response body to be UnlockResponse, got error: %s", err)
+	res = bearer(t, "GET", list.Next, "", "")
+	list = objectList{}
+	json.NewDecoder(res.Body).Decode(&list)
+	if len(list.Objects) != 1 || list.Objects[0] != sha256Hex([]byte("invoice-2.txt")) || list.Next != "" {
+		t.Fatalf("expected the second and last invoice, got %+v", list)
 	}
-	lock := unlockResponse.Lock
-	if lock == nil || lock.Id != l.Id {
-		t.Errorf("expected deleted lock to be returned, got: %s", lock)
+
+	res = bearer(t, "GET", "/ns/query-named/objects?size>=13&filename<receipt", "", "")
+	list = objectList{}
+	json.NewDecoder(res.Body).Decode(&list)
+	if len(list.Objects) != 2 {
+		t.Fatalf("expected both invoices, got %+v", list)
 	}
 }
 
-func TestUnLockUnAuthed(t *testing.T) {
-	l, err := createLock(testUser, testPass, "TestUnLockUnAuthed")
+// bearer sends a raw body request, authenticated with the token secret if one
+// is given and as the admin otherwise. Only GETs of an object ask for its
+// content rather than JSON.
+func bearer(t *testing.T, method, path, secret, body string) *http.Response {
+	req, err := http.NewRequest(method, lfsServer.URL+path, bytes.NewBufferString(body))
 	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+		t.Fatalf("request error: %s", err)
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	} else {
+		req.SetBasicAuth(testUser, testPass)
+	}
+	if method != "GET" || !strings.Contains(path, "/objects/") {
+		req.Header.Set("Accept", metaMediaType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
 	}
+	return res
+}
 
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, "", "", buf)
+func TestGetMultiRange(t *testing.T) {
+	req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Range", "bytes=0-3,-7")
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
 	}
-}
 
-func TestUnlockNotOwner(t *testing.T) {
-	l, err := createLock(testUser, testPass, "TestUnlockNotOwner")
-	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+	if res.StatusCode != 206 {
+		t.Fatalf("expected status 206, got %d", res.StatusCode)
+	}
+	mt, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("expected multipart/byteranges, got %q", res.Header.Get("Content-Type"))
 	}
 
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
-	if err != nil {
-		t.Fatalf("request error: %s", err)
+	expected := []struct{ cr, body string }{
+		{fmt.Sprintf("bytes 0-3/%d", len(content)), content[:4]},
+		{fmt.Sprintf("bytes %d-%d/%d", len(content)-7, len(content)-1, len(content)), content[len(content)-7:]},
 	}
-	if res.StatusCode != 403 {
-		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for i, e := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("expected part %d, got error: %s", i, err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != e.cr {
+			t.Fatalf("expected Content-Range header of %q, got %q", e.cr, cr)
+		}
+		by, _ := ioutil.ReadAll(part)
+		if string(by) != e.body {
+			t.Fatalf("expected part content %q, got %q", e.body, string(by))
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected exactly %d parts", len(expected))
 	}
 }
 
-func TestUnlockNotOwnerForce(t *testing.T) {
-	l, err := createLock(testUser, testPass, "TestUnlockNotOwnerForce")
+func TestGetRangeNotSatisfiable(t *testing.T) {
+	req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
 	if err != nil {
-		t.Fatalf("create lock error: %s", err)
+		t.Fatalf("request error: %s", err)
 	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(content)))
 
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, true))
-	res, err := api("POST", "/user/repo/locks/"+l.Id+"/unlock", metaMediaType, testUser1, testPass1, buf)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("response error: %s", err)
 	}
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+
+	if res.StatusCode != 416 {
+		t.Fatalf("expected status 416, got %d", res.StatusCode)
+	}
+	expected := fmt.Sprintf("bytes */%d", len(content))
+	if cr := res.Header.Get("Content-Range"); cr != expected {
+		t.Fatalf("expected Content-Range header of %q, got %q", expected, cr)
+	}
+}
+
+func TestGetInvalidRange(t *testing.T) {
+	for _, rangeHdr := range []string{"bytes=abc-", "bytes=5-2", "items=0-3", "bytes=0"} {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Range", rangeHdr)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		by, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 200 || string(by) != content {
+			t.Fatalf("%q: expected the Range header to be ignored, got %d %q", rangeHdr, res.StatusCode, by)
+		}
+	}
+}
+
+func TestGetIfRange(t *testing.T) {
+	tests := []struct {
+		ifRange string
+		status  int
+	}{
+		{`"` + contentOid + `"`, 206},
+		{`"` + nonExistingOid + `"`, 200},
+		{time.Unix(contentCreated, 0).UTC().Format(http.TimeFormat), 206},
+		{time.Unix(contentCreated+1, 0).UTC().Format(http.TimeFormat), 200},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Range", "bytes=5-")
+		req.Header.Set("If-Range", tt.ifRange)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Fatalf("If-Range %q: expected status %d, got %d", tt.ifRange, tt.status, res.StatusCode)
+		}
+		if ar := res.Header.Get("Accept-Ranges"); ar != "bytes" {
+			t.Fatalf("expected Accept-Ranges header of bytes, got %q", ar)
+		}
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	etag := `"` + contentOid + `"`
+	created := time.Unix(contentCreated, 0).UTC()
+	tests := []struct {
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"GET", nil, 200},
+		{"HEAD", nil, 200},
+		{"GET", map[string]string{"If-None-Match": etag}, 304},
+		{"HEAD", map[string]string{"If-None-Match": etag}, 304},
+		{"GET", map[string]string{"If-None-Match": `"other", W/` + etag}, 304},
+		{"GET", map[string]string{"If-None-Match": "*"}, 304},
+		{"GET", map[string]string{"If-None-Match": `"` + nonExistingOid + `"`}, 200},
+		{"GET", map[string]string{"If-Modified-Since": created.Format(http.TimeFormat)}, 304},
+		{"GET", map[string]string{"If-Modified-Since": created.Add(-time.Second).Format(http.TimeFormat)}, 200},
+		// If-None-Match takes precedence
+		{"GET", map[string]string{"If-None-Match": `"` + nonExistingOid + `"`, "If-Modified-Since": created.Format(http.TimeFormat)}, 200},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, lfsServer.URL+"/objects/"+contentOid, nil)
+		req.SetBasicAuth(testUser, testPass)
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		by, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s %v: expected status %d, got %d", tt.method, tt.headers, tt.status, res.StatusCode)
+		}
+		if res.Header.Get("ETag") != etag || res.Header.Get("Last-Modified") != created.Format(http.TimeFormat) {
+			t.Fatalf("%s %v: expected validators, got %v", tt.method, tt.headers, res.Header)
+		}
+		if cc := res.Header.Get("Cache-Control"); cc != "private, max-age=31536000, immutable" {
+			t.Fatalf("%s %v: expected private Cache-Control, got %q", tt.method, tt.headers, cc)
+		}
+		if want := tt.status == 200 && tt.method == "GET"; (len(by) > 0) != want {
+			t.Fatalf("%s %v: expected a body only for a full GET, got %q", tt.method, tt.headers, by)
+		}
+	}
+}
+
+func TestImmutableCacheControl(t *testing.T) {
+	// Without auth every request is anonymous, and the response can be shared
+	r, _ := http.NewRequest("GET", "/objects/"+contentOid, nil)
+	context.Set(r, "Identity", anonymous)
+	defer context.Clear(r)
+	if cc := immutableCacheControl(r); cc != "public, max-age=31536000, immutable" {
+		t.Fatalf("expected a public Cache-Control without auth, got %q", cc)
+	}
+	context.Set(r, "Identity", &Identity{Name: testUser, Scopes: []string{scopeAdmin}})
+	if cc := immutableCacheControl(r); cc != "private, max-age=31536000, immutable" {
+		t.Fatalf("expected a private Cache-Control for an authenticated request, got %q", cc)
+	}
+}
+
+func TestConditionalGetMeta(t *testing.T) {
+	get := func(query, ifNoneMatch string) *http.Response {
+		req, _ := http.NewRequest("GET", lfsServer.URL+"/objects/"+contentOid+query, nil)
+		req.Header.Set("Accept", metaMediaType)
+		req.SetBasicAuth(testUser, testPass)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("", "")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != 200 || etag == "" || etag == `"`+contentOid+`"` {
+		t.Fatalf("expected meta to have an ETag of its own, got %d %q", res.StatusCode, etag)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Fatalf("expected the latest meta to be revalidated, got Cache-Control %q", cc)
+	}
+	if res.Header.Get("Vary") != "Accept" {
+		t.Fatalf("expected Vary: Accept, got %q", res.Header.Get("Vary"))
+	}
+	if res = get("", etag); res.StatusCode != 304 {
+		t.Fatalf("expected 304 for a matching ETag, got %d", res.StatusCode)
+	}
+
+	res = get("?revision=0", "")
+	if cc := res.Header.Get("Cache-Control"); res.StatusCode != 200 || cc != "private, max-age=31536000, immutable" {
+		t.Fatalf("expected a numbered revision to be cached for good, got %d %q", res.StatusCode, cc)
+	}
+}
+
+func TestPut(t *testing.T) {
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(content)))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	r, err := testContentStore.Get(contentOid, 0)
+	if err != nil {
+		t.Fatalf("error retreiving from content store: %s", err)
+	} else {
+		defer r.Close()
+	}
+	c, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error reading content: %s", err)
+	}
+	if string(c) != content {
+		t.Fatalf("expected content, got `%s`", string(c))
+	}
+}
+
+func TestPutRaw(t *testing.T) {
+	data := "raw body content"
+	oid := sha256Hex([]byte(data))
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/objects/"+oid, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition", `attachment; filename="raw.txt"`)
+	req.Header.Set("X-ND-Meta-Supplier", "ACME")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Meta == nil || d.Meta.FileName != "raw.txt" || d.Meta.Length != int64(len(data)) {
+		t.Fatalf("expected meta for the new object, got %+v", d.Meta)
+	}
+	if d.Meta.Fields["supplier"] != "ACME" {
+		t.Fatalf("expected supplier field to be kept, got %v", d.Meta.Fields)
+	}
+}
+
+func TestPutMultipartFields(t *testing.T) {
+	data := "multipart content with fields"
+	oid := sha256Hex([]byte(data))
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("sku", "1234")
+	mw.WriteField("Language", "en")
+	fw, _ := mw.CreateFormFile("file", "datasheet.txt")
+	io.WriteString(fw, data)
+	mw.Close()
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/objects/"+oid, body)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	meta, err := testMetaStore.Get(oid)
+	if err != nil {
+		t.Fatalf("expected meta to be stored, got: %s", err)
+	}
+	if meta.FileName != "datasheet.txt" {
+		t.Fatalf("expected filename from the file part, got %q", meta.FileName)
+	}
+	if meta.Fields["sku"] != "1234" || meta.Fields["language"] != "en" {
+		t.Fatalf("expected form values to be kept, got %v", meta.Fields)
+	}
+}
+
+func TestPutFieldsTooLarge(t *testing.T) {
+	data := "content with too many fields"
+	oid := sha256Hex([]byte(data))
+	value := strings.Repeat("v", 60*1024)
+
+	// Each value is small enough, but together they are too much
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for i := 0; i < 5; i++ {
+		mw.WriteField("field"+strconv.Itoa(i), value)
+	}
+	fw, _ := mw.CreateFormFile("file", "fields.txt")
+	io.WriteString(fw, data)
+	mw.Close()
+
+	req, _ := http.NewRequest("PUT", lfsServer.URL+"/objects/"+oid, body)
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for too many form values, got %d", res.StatusCode)
+	}
+
+	req, _ = http.NewRequest("PUT", lfsServer.URL+"/objects/"+oid, strings.NewReader(data))
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	for i := 0; i < 5; i++ {
+		req.Header.Set("X-ND-Meta-Field"+strconv.Itoa(i), value)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for too many X-ND-Meta headers, got %d", res.StatusCode)
+	}
+
+	if _, err := testMetaStore.Get(oid); err == nil {
+		t.Fatalf("expected no meta to be stored")
+	}
+}
+
+func TestPutAttributes(t *testing.T) {
+	data := "content with attributes"
+	oid := sha256Hex([]byte(data))
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("attributes", `{"SKU": "A-1234", "weight": 2.5, "discontinued": false}`)
+	mw.WriteField("tags", "catalogue, 2018,catalogue")
+	fw, _ := mw.CreateFormFile("file", "sheet.txt")
+	io.WriteString(fw, data)
+	mw.Close()
+
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/objects/"+oid, body)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/objects/"+oid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var raw struct {
+		Meta struct {
+			Attributes map[string]interface{}
+			Tags       []string
+		}
+	}
+	json.NewDecoder(res.Body).Decode(&raw)
+	attrs := raw.Meta.Attributes
+	if attrs["sku"] != "A-1234" || attrs["weight"] != 2.5 || attrs["discontinued"] != false {
+		t.Fatalf("expected typed attributes in the meta response, got %v", attrs)
+	}
+	if len(raw.Meta.Tags) != 2 || raw.Meta.Tags[0] != "catalogue" || raw.Meta.Tags[1] != "2018" {
+		t.Fatalf("expected tags in the meta response, got %v", raw.Meta.Tags)
+	}
+
+	data = "raw content with attributes"
+	req, _ = http.NewRequest("PUT", lfsServer.URL+"/objects/"+sha256Hex([]byte(data)), bytes.NewBufferString(data))
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("X-ND-Attributes", `{"supplier": {"name": "ACME"}}`)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for a nested attribute, got %d", res.StatusCode)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	path := "/objects/" + contentOid + "/annotations"
+	res, err := api("POST", path, metaMediaType, testUser, testPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an empty annotation, got %d", res.StatusCode)
+	}
+
+	res, err = api("POST", path, metaMediaType, testUser, testPass, bytes.NewBufferString(`{"set": {"Language": "de"}, "add-tags": ["translated"]}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", path, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if len(d.Annotations) == 0 {
+		t.Fatalf("expected the annotation to be listed, got %+v", d)
+	}
+	an := d.Annotations[len(d.Annotations)-1]
+	if an.Author != testUser || an.Set["language"].String != "de" || len(an.AddTags) != 1 {
+		t.Fatalf("expected the new annotation, got %+v", an)
+	}
+
+	// The uploaded meta is left alone
+	meta, _ := testMetaStore.Get(contentOid)
+	if len(meta.Attributes) != 0 || len(meta.Tags) != 0 {
+		t.Fatalf("expected original meta to be unchanged, got %+v", meta)
+	}
+
+	res, err = api("POST", "/ns/elsewhere"+path, metaMediaType, testUser, testPass, bytes.NewBufferString(`{"add-tags": ["x"]}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 outside the object's namespace, got %d", res.StatusCode)
+	}
+}
+
+func TestMetaRevisions(t *testing.T) {
+	data := "content with revisions"
+	oid := sha256Hex([]byte(data))
+	req, _ := http.NewRequest("PUT", lfsServer.URL+"/ns/revisions/objects/"+oid, bytes.NewBufferString(data))
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("X-ND-Filename", "scna.txt")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != 201 {
+		t.Fatalf("expected put to succeed, got %v %v", res, err)
+	}
+
+	path := "/ns/revisions/objects/" + oid
+	for _, body := range []string{`{"filename": "scan.txt"}`, `{"set": {"pages": 2}}`} {
+		res, err := api("POST", path+"/annotations", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+		if err != nil || res.StatusCode != 201 {
+			t.Fatalf("expected annotation to be created, got %v %v", res, err)
+		}
+	}
+
+	for query, want := range map[string]string{
+		"":            "2 scan.txt 1",
+		"?revision=2": "2 scan.txt 1",
+		"?revision=1": "1 scan.txt 0",
+		"?revision=0": "0 scna.txt 0",
+		"?at=" + strconv.FormatInt(time.Now().Unix()+1, 10): "2 scan.txt 1",
+	} {
+		res, err := api("GET", path+query, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		var d ResponseData
+		json.NewDecoder(res.Body).Decode(&d)
+		if d.Revision == nil || d.Meta == nil {
+			t.Fatalf("expected a revision of the meta for %q, got %+v", query, d)
+		}
+		if got := fmt.Sprintf("%d %s %d", *d.Revision, d.Meta.FileName, len(d.Meta.Attributes)); got != want {
+			t.Fatalf("expected %q for %q, got %q", want, query, got)
+		}
+	}
+
+	for query, code := range map[string]int{"?revision=3": 404, "?at=1000": 404, "?revision=x": 400, "?revision=1&at=1000": 400} {
+		res, err := api("GET", path+query, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != code {
+			t.Fatalf("expected status %d for %q, got %d", code, query, res.StatusCode)
+		}
+	}
+
+	res := bearer(t, "GET", path, "", "")
+	if cd := res.Header.Get("Content-Disposition"); cd != "inline; filename=scan.txt" {
+		t.Fatalf("expected download to use the corrected filename, got %q", cd)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Fatalf("expected download of an annotated object to be revalidated, got Cache-Control %q", cc)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	cases := map[string]string{
+		"":                       "inline",
+		"scan.txt":               "inline; filename=scan.txt",
+		"read me.txt":            `inline; filename="read me.txt"`,
+		`a "b"; c=d.txt`:         `inline; filename="a \"b\"; c=d.txt"`,
+		"x.txt\r\nSet-Cookie: y": `inline; filename*=utf-8''x.txt%0D%0ASet-Cookie%3A%20y`,
+	}
+	for name, want := range cases {
+		if got := contentDisposition("inline", name); got != want {
+			t.Errorf("%q: expected %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	put := func(name, ifMatch, ifNoneMatch string) *http.Response {
+		req, _ := http.NewRequest("PUT", lfsServer.URL+"/refs/"+name, strings.NewReader(`{"oid": "`+contentOid+`"}`))
+		req.Header.Set("Accept", metaMediaType)
+		req.SetBasicAuth(testUser, testPass)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		return res
+	}
+
+	if res := put("docs/manual", "", "*"); res.StatusCode != 201 {
+		t.Fatalf("expected status 201 creating a ref, got %d", res.StatusCode)
+	}
+	if res := put("docs/manual", "", "*"); res.StatusCode != 412 {
+		t.Fatalf("expected status 412 creating an existing ref, got %d", res.StatusCode)
+	}
+	if res := put("docs/manual", objectETag(nonExistingOid), ""); res.StatusCode != 412 {
+		t.Fatalf("expected status 412 for a stale If-Match, got %d", res.StatusCode)
+	}
+	res := put("docs/manual", objectETag(contentOid), "")
+	if res.StatusCode != 200 || res.Header.Get("ETag") != objectETag(contentOid) {
+		t.Fatalf("expected status 200 and the object's ETag, got %d %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+	if res := put("docs/manual!", "", ""); res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for a bad ref name, got %d", res.StatusCode)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, _ := http.NewRequest("GET", lfsServer.URL+"/refs/docs/manual", nil)
+	req.SetBasicAuth(testUser, testPass)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 302 || res.Header.Get("Location") != "/objects/"+contentOid {
+		t.Fatalf("expected a redirect to the object, got %d %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res, err = api("GET", "/refs/docs/manual?proxy=1", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	by, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(by) != content {
+		t.Fatalf("expected the object's content, got %d %q", res.StatusCode, by)
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Fatalf("expected a proxied ref not to be cached, got Cache-Control %q", cc)
+	}
+
+	res, err = api("DELETE", "/refs/docs/manual", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 deleting the ref, got %d", res.StatusCode)
+	}
+	res, err = api("GET", "/refs/docs/manual", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a deleted ref, got %d", res.StatusCode)
+	}
+
+	reflog, err := testMetaStore.RefLog("docs/manual")
+	if err != nil || len(reflog) != 2 || reflog[0].Author != testUser {
+		t.Fatalf("expected the create and delete in the reflog, got %+v, %v", reflog, err)
+	}
+}
+
+func TestManifests(t *testing.T) {
+	body := `[{"path": "docs/content.txt", "oid": "` + contentOid + `"}, {"path": "cad/part.step", "oid": "` + nonExistingOid + `"}]`
+	res, err := api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 400 || len(d.Missing) != 1 || d.Missing[0] != nonExistingOid {
+		t.Fatalf("expected status 400 listing the missing object, got %d %+v", res.StatusCode, d)
+	}
+
+	body = `[{"path": "docs/content.txt", "oid": "` + contentOid + `"}, {"path": "copy.txt", "oid": "` + contentOid + `"}]`
+	res, err = api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 201 || d.Meta == nil || d.Meta.ContentType != manifestMediaType {
+		t.Fatalf("expected status 201 and the manifest's meta, got %d %+v", res.StatusCode, d)
+	}
+	manifestOid := d.Oid
+	if res.Header.Get("Location") != "/objects/"+manifestOid {
+		t.Fatalf("expected Location of the manifest object, got %q", res.Header.Get("Location"))
+	}
+
+	res, err = api("GET", "/objects/"+manifestOid, "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	by, _ := ioutil.ReadAll(res.Body)
+	if !strings.HasPrefix(string(by), `[{"path":"copy.txt"`) {
+		t.Fatalf("expected the manifest's canonical content, got %s", by)
+	}
+
+	res, err = api("GET", "/manifests/"+manifestOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || len(d.Manifest) != 2 || d.Manifest[1].Path != "docs/content.txt" {
+		t.Fatalf("expected the manifest's members, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/manifests/"+contentOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for an object that isn't a manifest, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/objects/"+contentOid+"/manifests", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	found := false
+	for _, m := range d.Manifests {
+		found = found || m == manifestOid
+	}
+	if res.StatusCode != 200 || !found {
+		t.Fatalf("expected the object to be referenced by the manifest, got %d %+v", res.StatusCode, d)
+	}
+}
+
+func TestManifestOverPlainObject(t *testing.T) {
+	// The manifest's canonical bytes, uploaded first as a plain object
+	entries := []ManifestEntry{{Path: "plain/content.txt", Oid: contentOid}}
+	by, _ := canonicalManifest(entries)
+	oid := sha256Hex(by)
+	if _, err := testContentStore.Put(oid, bytes.NewReader(by)); err != nil {
+		t.Fatalf("error seeding content: %s", err)
+	}
+	meta := &MetaData{FileName: "list.json", ContentType: "application/json", Length: int64(len(by)), Created: contentCreated}
+	if err := testMetaStore.Put(oid, meta); err != nil {
+		t.Fatalf("error seeding meta: %s", err)
+	}
+
+	body := `[{"path": "plain/content.txt", "oid": "` + contentOid + `"}]`
+	res, err := api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 201 || d.Oid != oid || d.Meta == nil || d.Meta.ContentType != manifestMediaType || d.Meta.FileName != "list.json" {
+		t.Fatalf("expected the object to become a manifest, got %d %+v", res.StatusCode, d)
+	}
+
+	// The upload record is left as it was
+	if stored, err := testMetaStore.Get(oid); err != nil || stored.ContentType != "application/json" {
+		t.Fatalf("expected the upload record to be unchanged, got %+v %v", stored, err)
+	}
+	res, err = api("GET", "/objects/"+oid+"?revision=0", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || d.Meta == nil || d.Meta.ContentType != "application/json" {
+		t.Fatalf("expected the meta as uploaded at revision 0, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/manifests/"+oid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || len(d.Manifest) != 1 || d.Manifest[0].Oid != contentOid {
+		t.Fatalf("expected the manifest's members, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/objects/"+contentOid+"/manifests", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if !containsString(d.Manifests, oid) {
+		t.Fatalf("expected the object to be referenced by the manifest, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/manifests/"+oid+"/archive?format=zip", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	by, _ = ioutil.ReadAll(res.Body)
+	zr, err := zip.NewReader(bytes.NewReader(by), int64(len(by)))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Name != "plain/content.txt" {
+		t.Fatalf("expected an archive of the manifest's members, got %d: %v", res.StatusCode, err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	// A second object with the same filename as the seeded one
+	other := "another object also called content.txt"
+	otherOid := sha256Hex([]byte(other))
+	if _, err := testContentStore.Put(otherOid, strings.NewReader(other)); err != nil {
+		t.Fatalf("error seeding content: %s", err)
+	}
+	meta := &MetaData{FileName: "content.txt", ContentType: "text/plain; charset=utf-8", Length: int64(len(other)), Created: contentCreated}
+	if err := testMetaStore.Put(otherOid, meta); err != nil {
+		t.Fatalf("error seeding meta: %s", err)
+	}
+
+	res, err := api("GET", "/archive?format=tar&oid="+otherOid+"&oid="+contentOid, "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("expected a tar archive, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(res.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error reading tar: %s", err)
+		}
+		by, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(by)
+	}
+	// The object with the higher OID is the one renamed
+	named := "content-" + otherOid[:8] + ".txt"
+	if contentOid > otherOid {
+		named = "content-" + contentOid[:8] + ".txt"
+	}
+	if len(files) != 2 || files["content.txt"] == "" || files[named] == "" {
+		t.Fatalf("expected both objects with distinct names, got %v", files)
+	}
+
+	res, err = api("GET", "/archive?oid="+nonExistingOid, "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a missing object, got %d", res.StatusCode)
+	}
+
+	// A manifest holding the other object and a nested manifest
+	inner := `[{"path": "content.txt", "oid": "` + contentOid + `"}]`
+	res, err = api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(inner))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	outer := `[{"path": "docs", "oid": "` + d.Oid + `"}, {"path": "readme.txt", "oid": "` + otherOid + `"}]`
+	res, err = api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(outer))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+
+	res, err = api("GET", "/manifests/"+d.Oid+"/archive?format=zip", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	by, _ := ioutil.ReadAll(res.Body)
+	zr, err := zip.NewReader(bytes.NewReader(by), int64(len(by)))
+	if err != nil {
+		t.Fatalf("expected a zip archive, got %d: %s", res.StatusCode, err)
+	}
+	files = map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		by, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(by)
+	}
+	if len(files) != 2 || files["docs/content.txt"] != content || files["readme.txt"] != other {
+		t.Fatalf("expected the manifest's members at their paths, got %v", files)
+	}
+}
+
+func TestManifestArchiveFanOut(t *testing.T) {
+	// Each manifest lists the one before twice, so the last expands to 2^16
+	// copies of the object, though each is small and they aren't deep.
+	oid := contentOid
+	for i := 0; i < 16; i++ {
+		body := `[{"path": "a", "oid": "` + oid + `"}, {"path": "b", "oid": "` + oid + `"}]`
+		res, err := api("POST", "/manifests", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		var d ResponseData
+		json.NewDecoder(res.Body).Decode(&d)
+		if res.StatusCode != 201 {
+			t.Fatalf("expected status 201, got %d %+v", res.StatusCode, d)
+		}
+		oid = d.Oid
+	}
+
+	res, err := api("GET", "/manifests/"+oid+"/archive", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for too many members, got %d", res.StatusCode)
+	}
+}
+
+func TestImport(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, data string }{
+		{"./images/front.png", "not really a png"},
+		{"docs/", ""},
+		{"docs/content.txt", content},
+		{"../evil.sh", "rm -rf /"},
+	} {
+		fw, _ := zw.Create(f.name)
+		io.WriteString(fw, f.data)
+	}
+	zw.Close()
+
+	req, _ := http.NewRequest("PUT", lfsServer.URL+"/import?manifest=1", &buf)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", "application/zip")
+	req.Header.Set("X-ND-Filename", "supplier.zip")
+	req.Header.Set("X-ND-Tags", "supplier")
+	req.SetBasicAuth(testUser, testPass)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || len(d.Imported) != 3 {
+		t.Fatalf("expected a report on each file, got %d %+v", res.StatusCode, d)
+	}
+
+	front, existing, evil := d.Imported[0], d.Imported[1], d.Imported[2]
+	if front.Status != "Created" || front.Existed || front.Oid != sha256Hex([]byte("not really a png")) {
+		t.Errorf("expected the new file to be created, got %+v", front)
+	}
+	if existing.Status != "Already Exists" || !existing.Existed || existing.Oid != contentOid {
+		t.Errorf("expected the existing file to be reported, got %+v", existing)
+	}
+	if evil.Oid != "" || evil.Status != errInvalidManifestPath.Error() {
+		t.Errorf("expected a path outside the archive to be refused, got %+v", evil)
+	}
+
+	meta, err := testMetaStore.Get(front.Oid)
+	if err != nil || meta.FileName != "front.png" || len(meta.Tags) != 1 {
+		t.Errorf("expected the file's meta to be recorded, got %+v, %v", meta, err)
+	}
+
+	if d.Meta == nil || d.Meta.FileName != "supplier.zip" || len(d.Manifest) != 2 || d.Manifest[1].Path != "images/front.png" {
+		t.Fatalf("expected a manifest of the archive, got %+v", d)
+	}
+
+	// A tar.gz, detected without a Content-Type
+	buf.Reset()
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "readme.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	io.WriteString(tw, "hello")
+	tw.Close()
+	gz.Close()
+	res, err = api("PUT", "/import", metaMediaType, testUser, testPass, &buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || len(d.Imported) != 1 || d.Imported[0].Oid != sha256Hex([]byte("hello")) || d.Oid != "" {
+		t.Fatalf("expected the tar.gz to be imported without a manifest, got %d %+v", res.StatusCode, d)
+	}
+
+	// Archives over the limit are refused, and their spool removed
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	fw, _ := zw.Create("large.bin")
+	fw.Write(randomData(1, 128*1024))
+	zw.Close()
+	res, err = api("PUT", "/import", metaMediaType, testUser, testPass, &buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 413 {
+		t.Fatalf("expected status 413 for an archive over the limit, got %d", res.StatusCode)
+	}
+	if names, _ := ioutil.ReadDir("lfs-import-test"); len(names) != 0 {
+		t.Fatalf("expected no spooled archives to be left, got %d", len(names))
+	}
+}
+
+func TestContentTypeDetection(t *testing.T) {
+	docx := zipOf(t, "[Content_Types].xml", "word/document.xml")
+	res := postObject(t, "spec.docx", string(docx), "")
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 201 || d.Meta.ContentType != docxType || d.Meta.ContentTypeFrom != sniffContainer {
+		t.Fatalf("expected status 201 and a detected docx, got %d %+v", res.StatusCode, d.Meta)
+	}
+	if derived := waitForDerived(t, d.Oid, "zip"); derived["zip"]["files"] != "2" {
+		t.Fatalf("expected the docx to be listed as a zip, got %+v", derived)
+	}
+
+	res, err := api("GET", "/objects/"+d.Oid, "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != docxType {
+		t.Fatalf("expected the docx to be served as %s, got %s", docxType, ct)
+	}
+
+	// Text shorter than the sniffed length used to be padded with zeros,
+	// making it look binary.
+	res = postObject(t, "notes", "short notes", "")
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Meta == nil || d.Meta.ContentType != "text/plain; charset=utf-8" || d.Meta.ContentTypeFrom != sniffText {
+		t.Fatalf("expected short text to be detected, got %d %+v", res.StatusCode, d.Meta)
+	}
+}
+
+func TestDerived(t *testing.T) {
+	pdf := "%PDF-1.5\n1 0 obj << /Type /Pages /Count 12 >> endobj\n2 0 obj << /Title (Widget datasheet) >> endobj\n"
+	res := postObject(t, "widget.pdf", pdf, "")
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 201 || d.Derived != nil {
+		t.Fatalf("expected status 201 without waiting for the extractors, got %d %+v", res.StatusCode, d)
+	}
+	if derived := waitForDerived(t, d.Oid, "pdf"); derived["pdf"]["pages"] != "12" || derived["pdf"]["title"] != "Widget datasheet" {
+		t.Fatalf("expected the PDF's details to be extracted, got %+v", derived)
+	}
+
+	res, err := api("GET", "/objects/"+d.Oid+"/derived", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || d.Derived["pdf"]["version"] != "1.5" {
+		t.Fatalf("expected the PDF's details, got %d %+v", res.StatusCode, d)
+	}
+
+	// Objects stored before extraction are inspected when first asked about.
+	res, err = api("GET", "/objects/"+contentOid+"/derived", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || d.Derived["text"]["encoding"] != "us-ascii" {
+		t.Fatalf("expected the text's encoding, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/objects/"+nonExistingOid+"/derived", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+// waitForDerived waits for the extractor name to inspect a new object, which
+// it does after the upload's response, and returns everything derived.
+func waitForDerived(t *testing.T, oid, name string) Derived {
+	for i := 0; i < 100; i++ {
+		if d, err := testMetaStore.Derived(oid); err == nil && d[name] != nil {
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to inspect %s", name, oid)
+	return nil
+}
+
+func TestRenditions(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	data := buf.String()
+	oid := sha256Hex(buf.Bytes())
+
+	res := postObject(t, "front.png", data, "")
+	if res.StatusCode != 201 && res.StatusCode != 200 {
+		t.Fatalf("expected the image to be stored, got %d", res.StatusCode)
+	}
+
+	res, err := api("GET", "/objects/"+oid+"/renditions/w=16,fmt=jpeg", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("expected status 200 and a JPEG, got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	img, err := jpeg.Decode(res.Body)
+	if err != nil {
+		t.Fatalf("expected the rendition to decode, got: %s", err)
+	}
+	if size := img.Bounds().Size(); size.X != 16 || size.Y != 8 {
+		t.Fatalf("expected a 16x8 rendition, got %v", size)
+	}
+	etag := res.Header.Get("ETag")
+
+	rid, err := testMetaStore.Rendition(oid, "w=16,fmt=jpeg,q=85")
+	if err != nil || etag != objectETag(rid) {
+		t.Fatalf("expected the rendition to be stored as %s, got %s, %v", etag, rid, err)
+	}
+	meta, err := testMetaStore.Get(rid)
+	if err != nil || meta.Fields[renditionFieldOf] != oid || meta.FileName != "front-w=16,fmt=jpeg,q=85.jpeg" {
+		t.Fatalf("expected the rendition's meta to name its source, got %+v, %v", meta, err)
+	}
+
+	res, err = api("GET", "/objects/"+oid+"/renditions/fmt=jpeg,q=85,w=16", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 || res.Header.Get("ETag") != etag {
+		t.Fatalf("expected an equivalent spec to be served the cached rendition, got %d %s", res.StatusCode, res.Header.Get("ETag"))
+	}
+
+	for spec, code := range map[string]int{"w=0": 400, "w=16,fmt=webp": 400} {
+		res, err = api("GET", "/objects/"+oid+"/renditions/"+spec, "", testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != code {
+			t.Fatalf("%s: expected status %d, got %d", spec, code, res.StatusCode)
+		}
+	}
+
+	res, err = api("GET", "/objects/"+contentOid+"/renditions/w=16", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 415 {
+		t.Fatalf("expected status 415 for an object that isn't an image, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/objects/"+nonExistingOid+"/renditions/w=16", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a missing object, got %d", res.StatusCode)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	if _, err := NewScrubber(testContentStore, testMetaStore, 0, time.Hour).Pass(nil); err != nil {
+		t.Fatalf("expected the pass to succeed, got: %s", err)
+	}
+
+	res, err := api("GET", "/scrub", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || d.Scrub == nil || d.Scrub.Pass < 1 || d.Scrub.Objects < 1 {
+		t.Fatalf("expected the scrubber's state, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/scrub/"+contentOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if res.StatusCode != 200 || len(d.Scrubbed) != 1 || d.Scrubbed[0].Status != scrubOK || d.Scrubbed[0].Verified == 0 {
+		t.Fatalf("expected the object to have been verified, got %d %+v", res.StatusCode, d)
+	}
+
+	res, err = api("GET", "/scrub/"+nonExistingOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/debug/vars", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var vars map[string]json.RawMessage
+	json.NewDecoder(res.Body).Decode(&vars)
+	if res.StatusCode != 200 || vars["scrub"] == nil {
+		t.Fatalf("expected the scrub metrics, got %d %v", res.StatusCode, vars)
+	}
+}
+
+func TestBatchDownload(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d},{"oid":"%s","size":1}]}`, contentOid, contentSize, nonExistingOid))
+	res, err := api("POST", "/lfs/objects/batch", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch batchResponse
+	json.NewDecoder(res.Body).Decode(&batch)
+	if len(batch.Objects) != 2 {
+		t.Fatalf("expected both objects in the response, got %+v", batch)
+	}
+
+	meta := batch.Objects[0]
+	if meta.Oid != contentOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", contentOid, meta.Oid)
+	}
+	if meta.Size != contentSize {
+		t.Fatalf("expected to see a size of `%d`, got: `%d`", contentSize, meta.Size)
+	}
+	download := meta.Actions["download"]
+	if download == nil || download.Href != "http://localhost:8080/objects/"+contentOid {
+		t.Fatalf("expected download link, got %+v", download)
+	}
+	if download.ExpiresIn == 0 || download.Header["Authorization"] == "" {
+		t.Fatalf("expected the link to expire and carry credentials, got %+v", download)
+	}
+
+	if missing := batch.Objects[1]; missing.Error == nil || missing.Error.Code != 404 || missing.Actions != nil {
+		t.Fatalf("expected a 404 error for a missing object, got %+v", missing)
+	}
+}
+
+func TestBatchUploadNewObject(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","transfers":["basic"],"objects":[{"oid":"%s","size":1234}]}`, nonExistingOid))
+	res, err := api("POST", "/ns/"+testRepo+"/lfs/objects/batch", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch batchResponse
+	json.NewDecoder(res.Body).Decode(&batch)
+	if batch.Transfer != "basic" || len(batch.Objects) != 1 {
+		t.Fatalf("expected a basic transfer of one object, got %+v", batch)
+	}
+	meta := batch.Objects[0]
+	if meta.Oid != nonExistingOid {
+		t.Fatalf("expected to see oid `%s` in meta, got: `%s`", nonExistingOid, meta.Oid)
+	}
+	if meta.Size != 1234 {
+		t.Fatalf("expected to see a size of `1234`, got: `%d`", meta.Size)
+	}
+	if download, ok := meta.Actions["download"]; ok {
+		t.Fatalf("expected upload to not contain a download link, got %s", download.Href)
+	}
+
+	upload, ok := meta.Actions["upload"]
+	if !ok {
+		t.Fatal("expected upload link to be present")
+	}
+	if upload.Href != "http://localhost:8080/ns/"+testRepo+"/objects/"+nonExistingOid {
+		t.Fatalf("expected upload link, got %s", upload.Href)
+	}
+	if verify, ok := meta.Actions["verify"]; !ok || verify.Href != "http://localhost:8080/ns/"+testRepo+"/lfs/verify" {
+		t.Fatalf("expected verify link, got %+v", verify)
+	}
+}
+
+func TestBatchUploadExistingObject(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize))
+	res, err := api("POST", "/lfs/objects/batch", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch batchResponse
+	json.NewDecoder(res.Body).Decode(&batch)
+	meta := batch.Objects[0]
+	if meta.Oid != contentOid || meta.Size != contentSize {
+		t.Fatalf("expected to see the object in meta, got: %+v", meta)
+	}
+	if len(meta.Actions) != 0 || meta.Error != nil {
+		t.Fatalf("expected no actions for an object the server has, got %+v", meta)
+	}
+}
+
+func TestBatchUploadReadOnly(t *testing.T) {
+	_, secret, err := testMetaStore.CreateToken("lfs-reader", testUser, []string{scopeRead}, nil)
+	if err != nil {
+		t.Fatalf("error creating token: %s", err)
+	}
+	res := lfs(t, "POST", "/lfs/objects/batch", secret, fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":1}]}`, nonExistingOid))
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestLFSVerify(t *testing.T) {
+	res := lfs(t, "POST", "/lfs/verify", "", fmt.Sprintf(`{"oid":"%s","size":%d}`, contentOid, contentSize))
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	res = lfs(t, "POST", "/lfs/verify", "", fmt.Sprintf(`{"oid":"%s","size":%d}`, contentOid, contentSize+1))
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422 for the wrong size, got %d", res.StatusCode)
+	}
+	res = lfs(t, "POST", "/lfs/verify", "", fmt.Sprintf(`{"oid":"%s","size":1}`, nonExistingOid))
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a missing object, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksList(t *testing.T) {
+	res, err := api("GET", "/lfs/locks?path="+lockPath, lfsMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	var list LockList
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 {
+		t.Fatalf("expected returned lock count to match, got: %d", len(list.Locks))
+	}
+	if list.Locks[0].Id != lockId {
+		t.Errorf("expected lockId to match, got: %s", list.Locks[0].Id)
+	}
+}
+
+func TestLocksListUnAuthed(t *testing.T) {
+	res, err := api("GET", "/lfs/locks", lfsMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksVerify(t *testing.T) {
+	buf := bytes.NewBufferString(`{"cursor": "", "limit": 0}`)
+	res, err := api("POST", "/lfs/locks/verify", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	var list VerifiableLockList
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("expected response body to be VerifiableLockList, got error: %s", err)
+	}
+	found := false
+	for _, l := range list.Ours {
+		found = found || l.Id == lockId
+	}
+	if !found {
+		t.Errorf("expected the seeded lock to be ours, got: %+v", list)
+	}
+}
+
+func TestLocksVerifyUnAuthed(t *testing.T) {
+	buf := bytes.NewBufferString(`{"cursor": "", "limit": 0}`)
+	res, err := api("POST", "/lfs/locks/verify", lfsMediaType, "", "", buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := "TestLock"
+	lock, err := createLock(testUser, testPass, path)
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+	if lock == nil {
+		t.Fatalf("expected lock to be created, got: %v", lock)
+	}
+	if lock.Owner.Name != testUser {
+		t.Errorf("expected lock owner to be match, got: %s", lock.Owner.Name)
+	}
+	if lock.Path != path {
+		t.Errorf("expected lock path to be match, got: %s", lock.Path)
+	}
+}
+
+func TestLockExists(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestLockExists")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, l.Path))
+	res, err := api("POST", "/lfs/locks", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409, got %d", res.StatusCode)
+	}
+	var lockResponse LockResponse
+	json.NewDecoder(res.Body).Decode(&lockResponse)
+	if lockResponse.Lock == nil || lockResponse.Lock.Id != l.Id {
+		t.Fatalf("expected the existing lock to be returned, got %+v", lockResponse)
+	}
+}
+
+func TestLockUnAuthed(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, "TestLockUnAuthed"))
+	res, err := api("POST", "/lfs/locks", lfsMediaType, "", "", buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestUnlock")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
+	res, err := api("POST", "/lfs/locks/"+l.Id+"/unlock", lfsMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	var unlockResponse UnlockResponse
+	if err := json.Unmarshal(body, &unlockResponse); err != nil {
+		t.Fatalf("expected response body to be UnlockResponse, got error: %s", err)
+	}
+	lock := unlockResponse.Lock
+	if lock == nil || lock.Id != l.Id {
+		t.Errorf("expected deleted lock to be returned, got: %v", lock)
+	}
+
+	res, err = api("POST", "/lfs/locks/"+l.Id+"/unlock", lfsMediaType, testUser, testPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for a released lock, got %d", res.StatusCode)
+	}
+}
+
+func TestUnLockUnAuthed(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestUnLockUnAuthed")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"force": %t}`, false))
+	res, err := api("POST", "/lfs/locks/"+l.Id+"/unlock", lfsMediaType, "", "", buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestUnlockNotOwner(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestUnlockNotOwner")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	res := lfs(t, "POST", "/lfs/locks/"+l.Id+"/unlock", otherUser(t), fmt.Sprintf(`{"force": %t}`, false))
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestUnlockNotOwnerForce(t *testing.T) {
+	l, err := createLock(testUser, testPass, "TestUnlockNotOwnerForce")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	res := lfs(t, "POST", "/lfs/locks/"+l.Id+"/unlock", otherUser(t), fmt.Sprintf(`{"force": %t}`, true))
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
 }
 
 func createLock(username, password, path string) (*Lock, error) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, path))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, username, password, buf)
+	res, err := api("POST", "/lfs/locks", lfsMediaType, username, password, buf)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", err)
+	}
+
+	if res.StatusCode != 201 {
+		return nil, fmt.Errorf("expected status 201, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("expected response to contain content, got error: %s", err)
+	}
+
+	var lockResponse LockResponse
+	if err := json.Unmarshal(body, &lockResponse); err != nil {
+		return nil, fmt.Errorf("expected response body to be LockResponse, got error: %s", err)
+	}
+	return lockResponse.Lock, nil
+}
+
+// otherUser returns the secret of a token for an identity other than the
+// admin user, named after testUser1.
+func otherUser(t *testing.T) string {
+	_, secret, err := testMetaStore.CreateToken(testUser1, testUser, []string{scopeWrite}, nil)
+	if err != nil {
+		t.Fatalf("error creating token: %s", err)
+	}
+	return secret
+}
+
+// lfs makes a Git LFS API request as the admin user or, given a token
+// secret, as the token.
+func lfs(t *testing.T, method, path, secret, body string) *http.Response {
+	req, err := http.NewRequest(method, lfsServer.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	} else {
+		req.SetBasicAuth(testUser, testPass)
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
+
+func TestMediaTypesRequired(t *testing.T) {
+	// GET and HEAD are left out, opening an object URL in a browser must work
+	m := []string{"PUT", "POST"}
+	for _, method := range m {
+		res, err := api(method, "/objects/"+contentOid, "", testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 404 {
+			t.Fatalf("expected status 404, got %d", res.StatusCode)
+		}
+	}
+}
+
+func TestMediaTypesParsed(t *testing.T) {
+	accept := contentMediaType + "; charset=utf-8"
+	res, err := api("GET", "/objects/"+contentOid, accept, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+}
+
+func TestPostObject(t *testing.T) {
+	data := "posted without a hash"
+	oid := sha256Hex([]byte(data))
+
+	res := postObject(t, "posted.txt", data, "")
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+	if loc := res.Header.Get("Location"); loc != "/objects/"+oid {
+		t.Fatalf("expected Location of the new object, got %q", loc)
+	}
+
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Status != "Created" || d.Oid != oid {
+		t.Fatalf("expected object to be created as %s, got %+v", oid, d)
+	}
+	if d.Meta == nil || d.Meta.FileName != "posted.txt" || d.Meta.Length != int64(len(data)) {
+		t.Fatalf("expected meta for the new object, got %+v", d.Meta)
+	}
+
+	res = postObject(t, "again.txt", data, "")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Status != "Already Exists" || d.Meta.FileName != "posted.txt" {
+		t.Fatalf("expected existing object to be reported, got %+v", d)
+	}
+}
+
+func TestPostObjectExpectedOid(t *testing.T) {
+	res := postObject(t, "bogus.txt", "bogus content", nonExistingOid)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
+	}
+	if testContentStore.Exists(nonExistingOid) {
+		t.Fatalf("expected content with the wrong hash to not be stored")
+	}
+
+	data := "posted with a hash"
+	oid := sha256Hex([]byte(data))
+	res = postObject(t, "hashed.txt", data, oid)
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	// Existing content is only checked against the hash, not stored again
+	res = postObject(t, "hashed.txt", data, oid)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if intents, _ := testMetaStore.Intents(); containsString(intents, oid) {
+		t.Fatalf("expected no intent left for existing content")
+	}
+	res = postObject(t, "hashed.txt", "not the content", oid)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for content not matching an existing object, got %d", res.StatusCode)
+	}
+}
+
+func postObject(t *testing.T, filename, data, expected string) *http.Response {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", filename)
 	if err != nil {
-		return nil, fmt.Errorf("request error: %s", err)
+		t.Fatalf("multipart error: %s", err)
+	}
+	io.WriteString(fw, data)
+	mw.Close()
+
+	req, err := http.NewRequest("POST", lfsServer.URL+"/objects", body)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if expected != "" {
+		req.Header.Set("X-ND-Expected-Oid", expected)
 	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
 
+func TestResumableUpload(t *testing.T) {
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":12, "filename":"resume.txt"}`, oid))
+	res, err := api("POST", "/uploads", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
 	if res.StatusCode != 201 {
-		return nil, fmt.Errorf("expected status 201, got %d", res.StatusCode)
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Upload == nil || d.Upload.ID == "" {
+		t.Fatalf("expected an upload session in the response")
+	}
+	id := d.Upload.ID
+
+	res = patchUpload(t, id, 0, "test ")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// Resending the first chunk must be rejected, the session has moved on
+	res = patchUpload(t, id, 0, "test ")
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409, got %d", res.StatusCode)
+	}
+
+	res, err = api("HEAD", "/uploads/"+id, metaMediaType, testUser, testPass, nil)
 	if err != nil {
-		return nil, fmt.Errorf("expected response to contain content, got error: %s", err)
+		t.Fatalf("request error: %s", err)
+	}
+	if off := res.Header.Get("Upload-Offset"); off != "5" {
+		t.Fatalf("expected Upload-Offset of 5, got %q", off)
 	}
 
-	var lockResponse LockResponse
-	if err := json.Unmarshal(body, &lockResponse); err != nil {
-		return nil, fmt.Errorf("expected response body to be LockResponse, got error: %s", err)
+	res = patchUpload(t, id, 5, "content")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("POST", "/uploads/"+id+"/finalize", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+	d = ResponseData{}
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Oid != oid || d.Meta == nil || d.Meta.FileName != "resume.txt" || d.Meta.Length != 12 {
+		t.Fatalf("expected meta for the finalized object, got %+v", d)
+	}
+
+	res, err = api("GET", "/uploads/"+id, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected finalized session to be gone, got status %d", res.StatusCode)
+	}
+
+	r, err := testContentStore.Get(oid, 0)
+	if err != nil {
+		t.Fatalf("error retreiving from content store: %s", err)
+	}
+	defer r.Close()
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected content, got `%s`", string(by))
+	}
+}
+
+func TestResumableUploadHashMismatch(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":4}`, nonExistingOid))
+	res, err := api("POST", "/uploads", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var d ResponseData
+	json.NewDecoder(res.Body).Decode(&d)
+	if d.Upload == nil {
+		t.Fatalf("expected an upload session in the response")
+	}
+	id := d.Upload.ID
+
+	res, err = api("POST", "/uploads/"+id+"/finalize", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 409 {
+		t.Fatalf("expected incomplete upload to give status 409, got %d", res.StatusCode)
+	}
+
+	patchUpload(t, id, 0, "abcd")
+	res, err = api("POST", "/uploads/"+id+"/finalize", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
+	}
+	if testContentStore.Exists(nonExistingOid) {
+		t.Fatalf("expected content with the wrong hash to not be stored")
+	}
+}
+
+func patchUpload(t *testing.T, id string, offset int, data string) *http.Response {
+	req, err := http.NewRequest("PATCH", lfsServer.URL+"/uploads/"+id, bytes.NewBufferString(data))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	return res
+}
+
+func TestS3Auth(t *testing.T) {
+	res := s3(t, "GET", "/nd/"+contentOid, nil, nil)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected a signed request to succeed, got %d", res.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", s3Server.URL+"/nd/"+contentOid, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if code := s3ErrorCode(t, res); res.StatusCode != 403 || code != "AccessDenied" {
+		t.Fatalf("expected an unsigned request to be refused, got %d %s", res.StatusCode, code)
+	}
+
+	for _, tc := range []struct {
+		key, secret string
+		at          time.Time
+		status      int
+		code        string
+	}{
+		{testS3Key, "wrong", time.Now(), 403, "SignatureDoesNotMatch"},
+		{"AKIDOTHER", testS3Secret, time.Now(), 403, "InvalidAccessKeyId"},
+		{testS3Key, testS3Secret, time.Now().Add(-time.Hour), 403, "RequestTimeTooSkewed"},
+	} {
+		req, _ := http.NewRequest("GET", s3Server.URL+"/nd/"+contentOid, nil)
+		signS3(req, tc.key, tc.secret, tc.at, sha256Hex(nil))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if code := s3ErrorCode(t, res); res.StatusCode != tc.status || code != tc.code {
+			t.Fatalf("expected %d %s, got %d %s", tc.status, tc.code, res.StatusCode, code)
+		}
+	}
+}
+
+func TestS3PutGet(t *testing.T) {
+	data := []byte("an S3 object")
+	oid := sha256Hex(data)
+	res := s3(t, "PUT", "/nd/docs/read-me.txt", data, map[string]string{"X-Amz-Meta-Author": "bilbo"})
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if etag := res.Header.Get("ETag"); etag != objectETag(oid) {
+		t.Fatalf("expected the ETag to be the OID, got %s", etag)
+	}
+
+	ref, err := testMetaStore.Ref("docs/read-me.txt")
+	if err != nil || ref.Oid != oid {
+		t.Fatalf("expected the key to be a ref to the object, got %v, %v", ref, err)
+	}
+	meta, err := testMetaStore.Get(oid)
+	if err != nil || meta.FileName != "read-me.txt" || meta.Fields["author"] != "bilbo" {
+		t.Fatalf("expected the filename and fields to be recorded, got %+v, %v", meta, err)
+	}
+
+	for _, key := range []string{"docs/read-me.txt", oid} {
+		res = s3(t, "GET", "/nd/"+key, nil, nil)
+		by, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 200 || !bytes.Equal(by, data) {
+			t.Fatalf("expected to get the object by %s, got %d %q", key, res.StatusCode, by)
+		}
+		if res.Header.Get("X-Amz-Meta-Author") != "bilbo" || res.Header.Get("Last-Modified") == "" {
+			t.Fatalf("expected the object's headers, got %v", res.Header)
+		}
+	}
+
+	res = s3(t, "GET", "/nd/docs/read-me.txt", nil, map[string]string{"Range": "bytes=3-5"})
+	by, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 206 || string(by) != "S3 " || res.Header.Get("Content-Range") != "bytes 3-5/12" {
+		t.Fatalf("expected a partial response, got %d %q %s", res.StatusCode, by, res.Header.Get("Content-Range"))
+	}
+
+	res = s3(t, "GET", "/nd/docs/read-me.txt", nil, map[string]string{"Range": "bytes=20-"})
+	if code := s3ErrorCode(t, res); res.StatusCode != 416 || code != "InvalidRange" {
+		t.Fatalf("expected InvalidRange, got %d %s", res.StatusCode, code)
+	}
+
+	res = s3(t, "HEAD", "/nd/docs/read-me.txt", nil, nil)
+	by, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || res.Header.Get("Content-Length") != "12" || len(by) != 0 {
+		t.Fatalf("expected HEAD to give the length without a body, got %d %s %q", res.StatusCode, res.Header.Get("Content-Length"), by)
+	}
+
+	res = s3(t, "HEAD", "/nd/docs/missing.txt", nil, nil)
+	if res.StatusCode != 404 {
+		t.Fatalf("expected a missing key to be 404, got %d", res.StatusCode)
+	}
+}
+
+func TestS3Immutable(t *testing.T) {
+	data := []byte("immutable S3 object")
+	if res := s3(t, "PUT", "/nd/immutable.txt", data, nil); res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// Putting the same content again, signed or not, changes nothing
+	if res := s3(t, "PUT", "/nd/immutable.txt", data, nil); res.StatusCode != 200 {
+		t.Fatalf("expected putting the same content to succeed, got %d", res.StatusCode)
+	}
+	if res := s3(t, "PUT", "/nd/immutable.txt", data, map[string]string{"X-Amz-Content-Sha256": unsignedPayload}); res.StatusCode != 200 {
+		t.Fatalf("expected putting the same unsigned content to succeed, got %d", res.StatusCode)
+	}
+
+	for _, payload := range []string{"", unsignedPayload} {
+		res := s3(t, "PUT", "/nd/immutable.txt", []byte("other content"), map[string]string{"X-Amz-Content-Sha256": payload})
+		if code := s3ErrorCode(t, res); res.StatusCode != 403 || code != "AccessDenied" {
+			t.Fatalf("expected an overwrite to be denied, got %d %s", res.StatusCode, code)
+		}
+	}
+	if testContentStore.Exists(sha256Hex([]byte("other content"))) {
+		t.Fatalf("expected refused content not to be stored")
+	}
+
+	for _, key := range []string{"immutable.txt", sha256Hex(data)} {
+		res := s3(t, "DELETE", "/nd/"+key, nil, nil)
+		if code := s3ErrorCode(t, res); res.StatusCode != 403 || code != "AccessDenied" {
+			t.Fatalf("expected a delete to be denied, got %d %s", res.StatusCode, code)
+		}
+	}
+
+	res := s3(t, "PUT", "/nd/"+nonExistingOid, []byte("not the content"), map[string]string{"X-Amz-Content-Sha256": unsignedPayload})
+	if code := s3ErrorCode(t, res); res.StatusCode != 400 || code != "BadDigest" {
+		t.Fatalf("expected content not matching its OID key to be refused, got %d %s", res.StatusCode, code)
+	}
+
+	res = s3(t, "PUT", "/nd/bad-payload.txt", data, map[string]string{"X-Amz-Content-Sha256": nonExistingOid})
+	if code := s3ErrorCode(t, res); res.StatusCode != 400 || code != "XAmzContentSHA256Mismatch" {
+		t.Fatalf("expected a wrong payload hash to be refused, got %d %s", res.StatusCode, code)
+	}
+}
+
+func TestS3ContentMD5(t *testing.T) {
+	data := []byte("content sent with a digest")
+	wrong := md5.Sum([]byte("some other content"))
+	res := s3(t, "PUT", "/nd/digest.txt", data, map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(wrong[:])})
+	if code := s3ErrorCode(t, res); res.StatusCode != 400 || code != "BadDigest" {
+		t.Fatalf("expected a bad digest to be refused, got %d %s", res.StatusCode, code)
+	}
+	if testContentStore.Exists(sha256Hex(data)) {
+		t.Fatalf("expected content with a bad digest not to be stored")
+	}
+	if intents, _ := testMetaStore.Intents(); containsString(intents, sha256Hex(data)) {
+		t.Fatalf("expected no intent for content with a bad digest")
+	}
+
+	right := md5.Sum(data)
+	if res := s3(t, "PUT", "/nd/digest.txt", data, map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(right[:])}); res.StatusCode != 200 {
+		t.Fatalf("expected a matching digest to be accepted, got %d", res.StatusCode)
+	}
+	if !testContentStore.Exists(sha256Hex(data)) {
+		t.Fatalf("expected content with a matching digest to be stored")
+	}
+}
+
+func TestS3InvalidRefKey(t *testing.T) {
+	data := []byte("content under a key that can't be a ref")
+	for _, key := range []string{".hidden.txt", "notes/.old.txt", "x~y.txt"} {
+		res := s3(t, "PUT", "/nd/"+key, data, nil)
+		if code := s3ErrorCode(t, res); res.StatusCode != 400 || code != "InvalidArgument" {
+			t.Fatalf("%s: expected the key to be refused, got %d %s", key, res.StatusCode, code)
+		}
+		if _, err := testMetaStore.Ref(key); err != errRefNotFound {
+			t.Fatalf("%s: expected no ref, got %v", key, err)
+		}
+
+		res = s3(t, "POST", "/nd/"+key+"?uploads", nil, nil)
+		if code := s3ErrorCode(t, res); res.StatusCode != 400 || code != "InvalidArgument" {
+			t.Fatalf("%s: expected a multipart upload to the key to be refused, got %d %s", key, res.StatusCode, code)
+		}
+	}
+	if testContentStore.Exists(sha256Hex(data)) {
+		t.Fatalf("expected content under an invalid key not to be stored")
+	}
+}
+
+func TestS3ListObjectsV2(t *testing.T) {
+	keys := []string{"a/1.txt", "a/2.txt", "b.txt", "c/d/3.txt"}
+	for _, key := range keys {
+		if res := s3(t, "PUT", "/s3-list/"+key, []byte("list "+key), nil); res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+	}
+	data := []byte("listed by oid")
+	oid := sha256Hex(data)
+	if res := s3(t, "PUT", "/s3-list/"+oid, data, nil); res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// Every object is listed by its OID, beside the refs
+	all := []string{oid}
+	for _, key := range keys {
+		all = append(all, key, sha256Hex([]byte("list "+key)))
+	}
+	sort.Strings(all)
+	var grouped []string
+	for _, key := range all {
+		if i := strings.Index(key, "/"); i >= 0 {
+			key = key[:i+1]
+		}
+		if len(grouped) == 0 || grouped[len(grouped)-1] != key {
+			grouped = append(grouped, key)
+		}
+	}
+
+	var list s3ListBucketResult
+	s3XML(t, s3(t, "GET", "/s3-list?list-type=2", nil, nil), &list)
+	var got []string
+	for _, o := range list.Contents {
+		got = append(got, o.Key)
+	}
+	if strings.Join(got, ",") != strings.Join(all, ",") {
+		t.Fatalf("expected keys %v, got %v", all, got)
+	}
+	for _, o := range list.Contents {
+		if o.Key == "a/1.txt" && (o.Size != int64(len("list a/1.txt")) || o.ETag != objectETag(sha256Hex([]byte("list a/1.txt")))) {
+			t.Fatalf("expected the size and ETag of the object, got %+v", o)
+		}
+	}
+
+	list = s3ListBucketResult{}
+	s3XML(t, s3(t, "GET", "/s3-list?list-type=2&delimiter=/", nil, nil), &list)
+	if len(list.Contents) != len(grouped)-2 || len(list.CommonPrefixes) != 2 || list.CommonPrefixes[0].Prefix != "a/" || list.CommonPrefixes[1].Prefix != "c/" {
+		t.Fatalf("expected the OIDs, b.txt and prefixes a/ and c/, got %+v", list)
+	}
+
+	// Page through one key or prefix at a time
+	got = nil
+	token := ""
+	for i := 0; i < 20; i++ {
+		list = s3ListBucketResult{}
+		s3XML(t, s3(t, "GET", "/s3-list?list-type=2&delimiter=/&max-keys=1&continuation-token="+token, nil, nil), &list)
+		for _, o := range list.Contents {
+			got = append(got, o.Key)
+		}
+		for _, p := range list.CommonPrefixes {
+			got = append(got, p.Prefix)
+		}
+		if !list.IsTruncated {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	if strings.Join(got, ",") != strings.Join(grouped, ",") {
+		t.Fatalf("expected pages %v, got %v", grouped, got)
+	}
+
+	list = s3ListBucketResult{}
+	s3XML(t, s3(t, "GET", "/s3-list?list-type=2&prefix=a/&start-after=a/1.txt", nil, nil), &list)
+	if len(list.Contents) != 1 || list.Contents[0].Key != "a/2.txt" {
+		t.Fatalf("expected only a/2.txt, got %+v", list.Contents)
+	}
+
+	if res := s3(t, "GET", "/Not_A_Bucket?list-type=2", nil, nil); s3ErrorCode(t, res) != "NoSuchBucket" {
+		t.Fatalf("expected NoSuchBucket, got %d", res.StatusCode)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	var created s3InitiateMultipartUploadResult
+	s3XML(t, s3(t, "POST", "/nd/multi/part.bin?uploads", nil, nil), &created)
+	if created.UploadId == "" || created.Key != "multi/part.bin" {
+		t.Fatalf("expected an upload id, got %+v", created)
+	}
+	upload := "/nd/multi/part.bin?uploadId=" + created.UploadId
+
+	parts := [][]byte{randomData(5, 64*1024), randomData(6, 1000)}
+	etags := make([]string, len(parts))
+	// Parts can arrive in any order
+	for i := len(parts) - 1; i >= 0; i-- {
+		res := s3(t, "PUT", upload+"&partNumber="+strconv.Itoa(i+1), parts[i], nil)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		etags[i] = res.Header.Get("ETag")
+	}
+
+	bogus := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"0123"</ETag></Part></CompleteMultipartUpload>`
+	if res := s3(t, "POST", upload, []byte(bogus), nil); s3ErrorCode(t, res) != "InvalidPart" {
+		t.Fatalf("expected InvalidPart, got %d", res.StatusCode)
+	}
+
+	// An entity tag naming a file outside the upload's directory
+	ioutil.WriteFile("lfs-multipart-test/outside.txt", []byte("not a part"), 0640)
+	defer os.Remove("lfs-multipart-test/outside.txt")
+	traversal := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"/../../outside.txt"</ETag></Part></CompleteMultipartUpload>`
+	if res := s3(t, "POST", upload, []byte(traversal), nil); s3ErrorCode(t, res) != "InvalidPart" {
+		t.Fatalf("expected InvalidPart for a path as an entity tag, got %d", res.StatusCode)
+	}
+	if _, err := testMetaStore.Get(sha256Hex([]byte("not a part"))); err != errObjectNotFound {
+		t.Fatalf("expected the file outside the upload not to be stored, got %v", err)
+	}
+
+	complete := fmt.Sprintf(`<CompleteMultipartUpload xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>`, etags[0], etags[1])
+	var result s3CompleteMultipartUploadResult
+	s3XML(t, s3(t, "POST", upload, []byte(complete), nil), &result)
+	data := append(append([]byte{}, parts[0]...), parts[1]...)
+	if result.ETag != objectETag(sha256Hex(data)) {
+		t.Fatalf("expected the ETag of the joined parts, got %+v", result)
+	}
+
+	res := s3(t, "GET", "/nd/multi/part.bin", nil, nil)
+	by, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Equal(by, data) {
+		t.Fatalf("expected to read back the joined parts")
+	}
+
+	if res := s3(t, "POST", upload, []byte(complete), nil); s3ErrorCode(t, res) != "NoSuchUpload" {
+		t.Fatalf("expected a completed upload to be gone, got %d", res.StatusCode)
+	}
+	if res := s3(t, "POST", "/nd/multi/part.bin?uploads", nil, nil); s3ErrorCode(t, res) != "AccessDenied" {
+		t.Fatalf("expected an upload to an existing key to be denied, got %d", res.StatusCode)
+	}
+
+	created = s3InitiateMultipartUploadResult{}
+	s3XML(t, s3(t, "POST", "/nd/multi/aborted.bin?uploads", nil, nil), &created)
+	if res := s3(t, "DELETE", "/nd/multi/aborted.bin?uploadId="+created.UploadId, nil, nil); res.StatusCode != 204 {
+		t.Fatalf("expected abort to succeed, got %d", res.StatusCode)
+	}
+	if res := s3(t, "PUT", "/nd/multi/aborted.bin?partNumber=1&uploadId="+created.UploadId, []byte("late"), nil); s3ErrorCode(t, res) != "NoSuchUpload" {
+		t.Fatalf("expected an aborted upload to be gone, got %d", res.StatusCode)
+	}
+}
+
+// s3 sends a request to the S3 API signed with the test credentials. The
+// payload hash is the SHA-256 of body unless X-Amz-Content-Sha256 is given.
+func s3(t *testing.T, method, path string, body []byte, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, s3Server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	payload := sha256Hex(body)
+	for name, value := range headers {
+		if name == "X-Amz-Content-Sha256" {
+			if value != "" {
+				payload = value
+			}
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	signS3(req, testS3Key, testS3Secret, time.Now(), payload)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	return res
+}
+
+// signS3 signs a request as an S3 client would, in the Authorization header.
+func signS3(req *http.Request, key, secret string, at time.Time, payload string) {
+	at = at.UTC()
+	v := &sigV4{
+		accessKey:     key,
+		scopeDate:     at.Format("20060102"),
+		region:        "us-east-1",
+		service:       "s3",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		amzDate:       at.Format(amzDateFormat),
+		payloadHash:   payload,
+	}
+	req.Header.Set("X-Amz-Date", v.amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, key, v.scope(), strings.Join(v.signedHeaders, ";"), v.sign(secret, v.canonicalRequest(req))))
+}
+
+// s3XML decodes a successful S3 response.
+func s3XML(t *testing.T, res *http.Response, v interface{}) {
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		by, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, by)
+	}
+	if err := xml.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("error decoding response: %s", err)
 	}
-	return lockResponse.Lock, nil
+}
+
+// s3ErrorCode returns the code of an S3 error response.
+func s3ErrorCode(t *testing.T, res *http.Response) string {
+	defer res.Body.Close()
+	var e s3ErrorResponse
+	if err := xml.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatalf("error decoding error response (status %d): %s", res.StatusCode, err)
+	}
+	return e.Code
 }
 
 // simple http client for making api request
@@ -514,8 +2650,10 @@ func api(method, path, accept, username, password string, body *bytes.Buffer) (*
 
 var (
 	lfsServer        *httptest.Server
-	testMetaStore    *MetaStore
-	testContentStore *ContentStore
+	testMetaStore    *BoltMetaStore
+	testContentStore *FsObjectStore
+	testUploadStore  *UploadStore
+	s3Server         *httptest.Server
 )
 
 const (
@@ -526,29 +2664,38 @@ const (
 	testRepo          = "repo"
 	content           = "this is my content"
 	contentSize       = int64(len(content))
+	contentCreated    = int64(1530000000)
 	contentOid        = "f97e1b2936a56511b3b6efc99011758e4700d60fb1674d31445d1ee40b663f24"
 	nonExistingOid    = "aec070645fe53ee3b3763059376134f058cc337247c978add178b6ccdfb0019f"
 	lockId            = "3cfec93346f7ff337c60f2da50cd86740715e2f6"
 	nonExistingLockId = "f310c1555a2485e2e5229ea015a94c9d590763d3"
 	lockPath          = "this/is/lock/path"
+	testS3Key         = "AKIDNDTEST"
+	testS3Secret      = "nd/s3/secret"
 )
 
 func TestMain(m *testing.M) {
 	os.Remove("lfs-test.db")
 
 	var err error
-	testMetaStore, err = NewMetaStore("lfs-test.db")
+	testMetaStore, err = NewBoltMetaStore("lfs-test.db")
 	if err != nil {
 		fmt.Printf("Error creating meta store: %s", err)
 		os.Exit(1)
 	}
 
-	testContentStore, err = NewContentStore("lfs-content-test")
+	testContentStore, err = NewShardedFsObjectStore("lfs-content-test", []int{2, 2})
 	if err != nil {
 		fmt.Printf("Error creating content store: %s", err)
 		os.Exit(1)
 	}
 
+	testUploadStore, err = NewUploadStore("lfs-upload-test", time.Hour)
+	if err != nil {
+		fmt.Printf("Error creating upload store: %s", err)
+		os.Exit(1)
+	}
+
 	if err := seedMetaStore(); err != nil {
 		fmt.Printf("Error seeding meta store: %s", err)
 		os.Exit(1)
@@ -559,36 +2706,44 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	app := NewApp(testContentStore, testMetaStore)
+	testContentStore.UseIntentLog(testMetaStore)
+	app := NewApp(testContentStore, testMetaStore, testUploadStore, testMetaStore,
+		NewBasicAuthenticator(testUser, testPass), NewTokenAuthenticator(testMetaStore))
+	os.MkdirAll("lfs-import-test", 0750)
+	app.importDir, app.maxImportSize = "lfs-import-test", 64*1024
 	lfsServer = httptest.NewServer(app)
 
+	multipartStore, err := NewMultipartStore("lfs-multipart-test", time.Hour)
+	if err != nil {
+		fmt.Printf("Error creating multipart store: %s", err)
+		os.Exit(1)
+	}
+	s3Server = httptest.NewServer(NewS3Server(app, multipartStore, "nd", testS3Key, testS3Secret))
+
 	logger = NewKVLogger(ioutil.Discard)
 
 	ret := m.Run()
 
 	lfsServer.Close()
+	s3Server.Close()
 	testMetaStore.Close()
 	os.Remove("lfs-test.db")
 	os.RemoveAll("lfs-content-test")
+	os.RemoveAll("lfs-upload-test")
+	os.RemoveAll("lfs-multipart-test")
+	os.RemoveAll("lfs-import-test")
 
 	os.Exit(ret)
 }
 
 func seedMetaStore() error {
-	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
-		return err
-	}
-	if err := testMetaStore.AddUser(testUser1, testPass1); err != nil {
-		return err
-	}
-
-	rv := &RequestVars{Oid: contentOid, Size: contentSize}
-	if _, err := testMetaStore.Put(rv); err != nil {
+	meta := &MetaData{FileName: "content.txt", ContentType: "text/plain; charset=utf-8", Length: contentSize, Created: contentCreated}
+	if err := testMetaStore.Put(contentOid, meta); err != nil {
 		return err
 	}
 
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := testMetaStore.AddLocks(testRepo, lock); err != nil {
+	if err := testMetaStore.AddLocks(lock); err != nil {
 		return err
 	}
 
@@ -596,9 +2751,8 @@ func seedMetaStore() error {
 }
 
 func seedContentStore() error {
-	meta := &MetaObject{Oid: contentOid, Size: contentSize}
 	buf := bytes.NewBuffer([]byte(content))
-	if err := testContentStore.Put(meta, buf); err != nil {
+	if _, err := testContentStore.Put(contentOid, buf); err != nil {
 		return err
 	}
 
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Sniff methods, recorded as MetaData.ContentTypeFrom to say how an
+// object's content type was arrived at.
+const (
+	// sniffMagic: a signature at a fixed offset in the content.
+	sniffMagic = "magic"
+	// sniffContainer: the members of a zip based format, e.g. OOXML.
+	sniffContainer = "container"
+	// sniffExtension: the extension of the filename given by the client,
+	// for content that is text or has no known signature.
+	sniffExtension = "extension"
+	// sniffText: content that looks like text, with nothing more known.
+	sniffText = "text"
+	// sniffDefault: nothing is known, so application/octet-stream.
+	sniffDefault = "default"
+)
+
+// sniffLen is how much of the head of an object is checked for signatures.
+const sniffLen = 512
+
+// Content types that are zip archives underneath. Archives are opened to
+// find out which of these they are.
+const (
+	zipType  = "application/zip"
+	docxType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	xlsxType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	pptxType = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	jarType  = "application/java-archive"
+	mf3Type  = "model/3mf"
+	oleType  = "application/x-ole-storage"
+)
+
+// magicSignature identifies a content type by bytes at fixed offsets, all
+// of which must match.
+type magicSignature struct {
+	contentType string
+	parts       []magicPart
+}
+
+type magicPart struct {
+	offset int
+	magic  string
+}
+
+// magicSignatures is the embedded signature table. It is checked in order
+// before net/http.DetectContentType, which knows the common web formats, so
+// it holds the formats the standard library doesn't know, and those it
+// does know that need to be told apart from them.
+var magicSignatures = []magicSignature{
+	{"application/pdf", []magicPart{{0, "%PDF-"}}},
+	{"model/step", []magicPart{{0, "ISO-10303-21;"}}},
+	{"image/vnd.dwg", []magicPart{{0, "AC10"}}},
+	{"image/vnd.dwg", []magicPart{{0, "AC1.5"}}},
+	{"image/vnd.dwg", []magicPart{{0, "AC2.1"}}},
+	{"image/tiff", []magicPart{{0, "II*\x00"}}},
+	{"image/tiff", []magicPart{{0, "MM\x00*"}}},
+	{"image/vnd.adobe.photoshop", []magicPart{{0, "8BPS"}}},
+	{"image/heic", []magicPart{{4, "ftypheic"}}},
+	{"image/avif", []magicPart{{4, "ftypavif"}}},
+	{"application/x-tar", []magicPart{{257, "ustar"}}},
+	{"application/x-7z-compressed", []magicPart{{0, "7z\xbc\xaf\x27\x1c"}}},
+	{"application/x-bzip2", []magicPart{{0, "BZh"}}},
+	{"application/x-xz", []magicPart{{0, "\xfd7zXZ\x00"}}},
+	{"application/zstd", []magicPart{{0, "\x28\xb5\x2f\xfd"}}},
+	{"application/vnd.sqlite3", []magicPart{{0, "SQLite format 3\x00"}}},
+	{oleType, []magicPart{{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"}}},
+	{zipType, []magicPart{{0, "PK\x03\x04"}}},
+	{zipType, []magicPart{{0, "PK\x05\x06"}}},
+}
+
+// extensionTypes maps filename extensions to content types, ahead of the
+// system's table as read by mime.TypeByExtension, which varies from one
+// machine to the next and rarely knows engineering formats.
+var extensionTypes = map[string]string{
+	".step":   "model/step",
+	".stp":    "model/step",
+	".iges":   "model/iges",
+	".igs":    "model/iges",
+	".stl":    "model/stl",
+	".obj":    "model/obj",
+	".3mf":    mf3Type,
+	".dwg":    "image/vnd.dwg",
+	".dxf":    "image/vnd.dxf",
+	".csv":    "text/csv",
+	".tsv":    "text/tab-separated-values",
+	".md":     "text/markdown",
+	".json":   "application/json",
+	".yaml":   "application/yaml",
+	".yml":    "application/yaml",
+	".doc":    "application/msword",
+	".xls":    "application/vnd.ms-excel",
+	".ppt":    "application/vnd.ms-powerpoint",
+	".msg":    "application/vnd.ms-outlook",
+	".docx":   docxType,
+	".xlsx":   xlsxType,
+	".pptx":   pptxType,
+	".odt":    "application/vnd.oasis.opendocument.text",
+	".ods":    "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":    "application/vnd.oasis.opendocument.presentation",
+	".odg":    "application/vnd.oasis.opendocument.graphics",
+	".epub":   "application/epub+zip",
+	".jar":    jarType,
+	".sldprt": "application/x-solidworks-part",
+	".sldasm": "application/x-solidworks-assembly",
+	".slddrw": "application/x-solidworks-drawing",
+	".ipt":    "application/x-inventor-part",
+	".iam":    "application/x-inventor-assembly",
+}
+
+// activeTypes are content types a browser would run script in. They, and
+// any XML or HTML type (see isActiveType), are only ever given to content
+// that looks like them, never on the strength of a filename alone, as
+// objects are served inline.
+var activeTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"image/svg+xml":            true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"text/xml":                 true,
+	"application/xml":          true,
+}
+
+// Sniffer detects the content type of objects, from a table of magic
+// signatures, the members of zip based formats and, failing those, the
+// filename the client gave.
+type Sniffer struct {
+	signatures []magicSignature
+	extensions map[string]string
+}
+
+// NewSniffer returns a Sniffer using the built in tables.
+func NewSniffer() *Sniffer {
+	return &Sniffer{signatures: magicSignatures, extensions: extensionTypes}
+}
+
+// DetectObject detects the content type of an object in st, returning it
+// and the method used. Read errors give "application/octet-stream".
+func (s *Sniffer) DetectObject(st ObjectStore, oid, filename string) (string, string) {
+	content, size, err := openReaderAt(st, oid)
+	if err != nil {
+		return "application/octet-stream", sniffDefault
+	}
+	defer content.Close()
+	return s.Detect(content, size, filename)
+}
+
+// Detect returns the content type of content of size bytes, named filename
+// by the client, and the method used to find it.
+func (s *Sniffer) Detect(content io.ReaderAt, size int64, filename string) (string, string) {
+	head := make([]byte, sniffLen)
+	n, err := content.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "application/octet-stream", sniffDefault
+	}
+	head = head[:n]
+
+	ct := s.magic(head)
+	switch {
+	case ct == zipType:
+		if inner := sniffZip(content, size); inner != "" {
+			return inner, sniffContainer
+		}
+		return ct, sniffMagic
+	case ct == oleType:
+		// Office 97 documents and many CAD formats are OLE compound
+		// files, told apart only by their extension.
+		if ext := s.extension(filename); ext != "" {
+			return ext, sniffExtension
+		}
+		return ct, sniffMagic
+	case ct != "":
+		return ct, sniffMagic
+	}
+
+	ct = http.DetectContentType(head)
+	if !strings.HasPrefix(ct, "text/plain") && ct != "application/octet-stream" {
+		return ct, sniffMagic
+	}
+	if ext := s.extension(filename); ext != "" {
+		// Text keeps the charset that was detected for it.
+		if strings.HasPrefix(ext, "text/") && strings.HasPrefix(ct, "text/plain") {
+			ext = strings.TrimSpace(strings.Split(ext, ";")[0]) + strings.TrimPrefix(ct, "text/plain")
+		}
+		return ext, sniffExtension
+	}
+	if ct == "application/octet-stream" {
+		return ct, sniffDefault
+	}
+	return ct, sniffText
+}
+
+// magic returns the content type of the first signature head matches, or
+// "" if none do.
+func (s *Sniffer) magic(head []byte) string {
+next:
+	for _, sig := range s.signatures {
+		for _, p := range sig.parts {
+			if p.offset > len(head) || !bytes.HasPrefix(head[p.offset:], []byte(p.magic)) {
+				continue next
+			}
+		}
+		return sig.contentType
+	}
+	return ""
+}
+
+// extension returns the content type of filename's extension, or "" if it
+// has none, or only one that could make a browser run script.
+func (s *Sniffer) extension(filename string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		return ""
+	}
+	ct, ok := s.extensions[ext]
+	if !ok {
+		ct = mime.TypeByExtension(ext)
+	}
+	if ct == "" || isActiveType(ct) {
+		return ""
+	}
+	return ct
+}
+
+// isActiveType reports whether a browser might run script in content of a
+// type. Any XML type can hold XHTML, so all of them are treated as active.
+func isActiveType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return activeTypes[mediaType] || strings.HasSuffix(mediaType, "+xml") ||
+		strings.Contains(mediaType, "xml") || strings.Contains(mediaType, "html")
+}
+
+// isZip reports whether content of a type is a zip archive underneath: a
+// plain zip or any of the formats sniffZip finds.
+func isZip(contentType string) bool {
+	switch contentType {
+	case zipType, docxType, xlsxType, pptxType, jarType, mf3Type:
+		return true
+	}
+	return strings.HasSuffix(contentType, "+zip") || strings.HasPrefix(contentType, "application/vnd.oasis.opendocument.")
+}
+
+// sniffZip returns the format of a zip archive that is the container of
+// another format, or "" if it is just a zip. OpenDocument and EPUB files
+// name their type in a "mimetype" member; Office Open XML ones hold
+// "[Content_Types].xml" and a directory named for the application.
+func sniffZip(content io.ReaderAt, size int64) string {
+	zr, err := zip.NewReader(content, size)
+	if err != nil {
+		return ""
+	}
+	members := make(map[string]bool)
+	for _, f := range zr.File {
+		members[f.Name] = true
+		if i := strings.Index(f.Name, "/"); i > 0 {
+			members[f.Name[:i+1]] = true
+		}
+		if f.Name == "mimetype" && f.UncompressedSize64 < 100 {
+			if ct := readMimetype(f); ct != "" {
+				return ct
+			}
+		}
+	}
+
+	switch {
+	case members["[Content_Types].xml"] && members["word/"]:
+		return docxType
+	case members["[Content_Types].xml"] && members["xl/"]:
+		return xlsxType
+	case members["[Content_Types].xml"] && members["ppt/"]:
+		return pptxType
+	case members["[Content_Types].xml"] && members["3D/"]:
+		return mf3Type
+	case members["META-INF/MANIFEST.MF"]:
+		return jarType
+	}
+	return ""
+}
+
+// readMimetype reads the "mimetype" member of an OpenDocument or EPUB file,
+// returning "" unless it is a valid media type that a browser won't run.
+func readMimetype(f *zip.File) string {
+	r, err := f.Open()
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ""
+	}
+	ct := strings.TrimSpace(string(b))
+	if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != ct || !strings.HasPrefix(ct, "application/") {
+		return ""
+	}
+	if isActiveType(ct) {
+		return ""
+	}
+	return ct
+}
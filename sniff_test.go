@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestSniffer(t *testing.T) {
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 1, 1)))
+	ole := append([]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), make([]byte, 600)...)
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe}
+
+	cases := []struct {
+		name        string
+		content     []byte
+		filename    string
+		contentType string
+		from        string
+	}{
+		{"docx", zipOf(t, "[Content_Types].xml", "word/document.xml"), "report.zip", docxType, sniffContainer},
+		{"xlsx", zipOf(t, "[Content_Types].xml", "xl/workbook.xml"), "", xlsxType, sniffContainer},
+		{"pptx", zipOf(t, "[Content_Types].xml", "ppt/presentation.xml"), "", pptxType, sniffContainer},
+		{"3mf", zipOf(t, "[Content_Types].xml", "3D/3dmodel.model"), "", mf3Type, sniffContainer},
+		{"odt", zipOf(t, "mimetype", "content.xml"), "", "application/vnd.oasis.opendocument.text", sniffContainer},
+		{"zip", zipOf(t, "a.txt"), "a.docx", zipType, sniffMagic},
+		{"pdf", []byte("%PDF-1.7\n"), "", "application/pdf", sniffMagic},
+		{"step", []byte("ISO-10303-21;\nHEADER;\n"), "part.txt", "model/step", sniffMagic},
+		{"dwg", []byte("AC1032\x00\x00\x00\x00\x00"), "", "image/vnd.dwg", sniffMagic},
+		{"png", pngData.Bytes(), "", "image/png", sniffMagic},
+		{"xls", ole, "budget.XLS", "application/vnd.ms-excel", sniffExtension},
+		{"ole", ole, "", oleType, sniffMagic},
+		{"csv", []byte("a,b\n1,2\n"), "data.csv", "text/csv; charset=utf-8", sniffExtension},
+		{"md", []byte("# Notes\n"), "notes.md", "text/markdown; charset=utf-8", sniffExtension},
+		{"stl", binary, "bracket.stl", "model/stl", sniffExtension},
+		{"html", []byte("alert(1)"), "page.html", "text/plain; charset=utf-8", sniffText},
+		{"svg", []byte("alert(1)"), "logo.svg", "text/plain; charset=utf-8", sniffText},
+		{"atom", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.atom", "text/plain; charset=utf-8", sniffText},
+		{"rss", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.rss", "text/plain; charset=utf-8", sniffText},
+		{"xsl", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.xsl", "text/plain; charset=utf-8", sniffText},
+		{"rdf", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.rdf", "text/plain; charset=utf-8", sniffText},
+		{"mathml", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.mathml", "text/plain; charset=utf-8", sniffText},
+		{"xml", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.xml", "text/plain; charset=utf-8", sniffText},
+		{"xhtml", []byte("<x:script xmlns:x=\"http://www.w3.org/1999/xhtml\">alert(1)</x:script>"), "feed.xhtml", "text/plain; charset=utf-8", sniffText},
+		{"text", []byte("short text"), "", "text/plain; charset=utf-8", sniffText},
+		{"binary", binary, "", "application/octet-stream", sniffDefault},
+		{"empty", nil, "", "text/plain; charset=utf-8", sniffText},
+	}
+
+	sn := NewSniffer()
+	for _, c := range cases {
+		ct, from := sn.Detect(bytes.NewReader(c.content), int64(len(c.content)), c.filename)
+		if ct != c.contentType || from != c.from {
+			t.Errorf("%s: expected %s from %s, got: %s from %s", c.name, c.contentType, c.from, ct, from)
+		}
+	}
+}
+
+func TestReadMimetypeActive(t *testing.T) {
+	cases := map[string]string{
+		"application/xhtml+xml":                   "",
+		"application/vnd.oasis.opendocument.text": "application/vnd.oasis.opendocument.text",
+	}
+	for ct, want := range cases {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create("mimetype")
+		w.Write([]byte(ct))
+		zw.Close()
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("zip error: %s", err)
+		}
+		if got := readMimetype(zr.File[0]); got != want {
+			t.Errorf("%s: expected %q, got %q", ct, want, got)
+		}
+	}
+}
+
+// zipOf returns a zip archive of empty files with the given names, except
+// that a "mimetype" member holds the OpenDocument text type.
+func zipOf(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip error: %s", err)
+		}
+		if name == "mimetype" {
+			w.Write([]byte("application/vnd.oasis.opendocument.text"))
+		}
+	}
+	zw.Close()
+	return buf.Bytes()
+}
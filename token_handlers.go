@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// tokenRequest is the body of POST /tokens
+type tokenRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// CreateTokenHandler issues a new API token. The secret is only ever
+// returned in this response. A token given namespaces can only be used
+// within them.
+func (a *App) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if !validScopes(req.Scopes) {
+		writeError(w, r, 400, errInvalidScope)
+		return
+	}
+	if !validNamespaces(req.Namespaces) {
+		writeError(w, r, 400, errInvalidNamespace)
+		return
+	}
+
+	t, secret, err := a.tokenStore.CreateToken(req.Name, requestIdentity(r).Name, req.Scopes, req.Namespaces)
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	t.Secret = secret
+	writeResponseData(w, r, &ResponseData{code: 201, Status: "Created", Token: t})
+}
+
+// ListTokensHandler lists every API token, without their secrets.
+func (a *App) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := a.tokenStore.Tokens()
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	if tokens == nil {
+		tokens = []*Token{}
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "OK", Tokens: tokens})
+}
+
+// RevokeTokenHandler deletes an API token so it can no longer be used.
+func (a *App) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.tokenStore.RevokeToken(mux.Vars(r)["id"])
+	if err == errTokenNotFound {
+		writeError(w, r, 404, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "Revoked"})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidLength = errors.New("Invalid upload size")
+	errMissingOffset = errors.New("Missing or invalid Upload-Offset header")
+)
+
+// uploadRequest is the body of POST /uploads
+type uploadRequest struct {
+	Oid        string               `json:"oid"`
+	FileName   string               `json:"filename"`
+	Length     int64                `json:"size"`
+	Attributes map[string]Attribute `json:"attributes"`
+	Tags       []string             `json:"tags"`
+}
+
+// uploadErrorCode maps UploadStore errors onto HTTP status codes.
+func uploadErrorCode(err error) int {
+	switch err {
+	case errUploadNotFound:
+		return 404
+	case errUploadExpired:
+		return 410
+	case errOffsetMismatch, errUploadIncomplete:
+		return 409
+	case errUploadTooLarge:
+		return 413
+	case errHashMismatch:
+		return 400
+	}
+	return 500
+}
+
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, code int, u *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	d := &ResponseData{code: code, Status: "OK", Oid: u.Oid, Upload: u}
+	writeResponseData(w, r, d)
+}
+
+// CreateUploadHandler starts a resumable upload session. If the object is
+// already in the namespace no session is created and the existing metadata is
+// returned.
+func (a *App) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var req uploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	if !validOid(req.Oid) {
+		writeError(w, r, 400, errInvalidOid)
+		return
+	}
+	if req.Length < 0 {
+		writeError(w, r, 400, errInvalidLength)
+		return
+	}
+	attrs, err := normalizeAttributes(req.Attributes)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		writeError(w, r, 400, err)
+		return
+	}
+
+	if d, err := a.BuildMetaResponse(a.metaStoreFor(r), req.Oid); err == nil {
+		d.Status = "Already Exists"
+		writeResponseData(w, r, d)
+		return
+	}
+
+	u, err := a.uploadStore.Create(requestNamespace(r), req.Oid, req.Length, &MetaData{FileName: req.FileName, Attributes: attrs, Tags: tags})
+	if err != nil {
+		writeError(w, r, 500, err)
+		return
+	}
+	w.Header().Set("Location", namespacePath(r)+"/uploads/"+u.ID)
+	writeUploadResponse(w, r, 201, u)
+}
+
+// getUpload returns the upload session named in the request's URL. Sessions
+// belong to the namespace they were created in and can't be seen from others.
+func (a *App) getUpload(r *http.Request) (*Upload, error) {
+	u, err := a.uploadStore.Get(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+	if u.Namespace != requestNamespace(r) {
+		return nil, errUploadNotFound
+	}
+	return u, nil
+}
+
+// GetUploadHandler reports the current offset of an upload session so a
+// client can work out where to resume from.
+func (a *App) GetUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := a.getUpload(r)
+	if err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	writeUploadResponse(w, r, 200, u)
+}
+
+// PatchUploadHandler appends the request body to an upload session. The
+// Upload-Offset header must match the session's current offset.
+func (a *App) PatchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, 400, errMissingOffset)
+		return
+	}
+
+	if _, err := a.getUpload(r); err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	u, err := a.uploadStore.Write(mux.Vars(r)["id"], offset, r.Body)
+	if err != nil {
+		if u != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		}
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	writeUploadResponse(w, r, 200, u)
+}
+
+// FinalizeUploadHandler commits a completed upload into the ObjectStore and
+// MetaStore exactly as PutHandler would, then removes the session. A session
+// whose content doesn't hash to its OID is discarded.
+func (a *App) FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	io.Copy(ioutil.Discard, r.Body)
+
+	if _, err := a.getUpload(r); err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	u, content, err := a.uploadStore.Open(id)
+	if err != nil {
+		if u != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		}
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	defer content.Close()
+
+	ms := a.metaStoreFor(r)
+	if d, err := a.BuildMetaResponse(ms, u.Oid); err == nil {
+		a.uploadStore.Delete(id)
+		d.Status = "Already Exists"
+		writeResponseData(w, r, d)
+		return
+	}
+
+	meta := MetaData{FileName: u.FileName, Attributes: u.Attributes, Tags: u.Tags}
+	d, err := a.commitObject(ms, u.Oid, &meta, content)
+	if err == nil || err == errHashMismatch {
+		// Either way the session is finished with; other errors leave
+		// it in place so that finalizing can be retried.
+		a.uploadStore.Delete(id)
+	}
+	if err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	writeResponseData(w, r, d)
+}
+
+// DeleteUploadHandler abandons an upload session.
+func (a *App) DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.getUpload(r); err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	if err := a.uploadStore.Delete(mux.Vars(r)["id"]); err != nil {
+		writeError(w, r, uploadErrorCode(err), err)
+		return
+	}
+	writeResponseData(w, r, &ResponseData{code: 200, Status: "Deleted"})
+}
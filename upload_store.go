@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUploadNotFound   = errors.New("Upload not found")
+	errUploadExpired    = errors.New("Upload has expired")
+	errOffsetMismatch   = errors.New("Upload-Offset does not match the current offset")
+	errUploadIncomplete = errors.New("Upload is not complete")
+	errUploadTooLarge   = errors.New("Upload exceeds its declared length")
+)
+
+// Upload describes a resumable upload session. The data received so far is
+// kept in a file beside the session record, so Offset is always the size of
+// that file.
+type Upload struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace,omitempty"`
+	Oid       string `json:"oid"`
+	FileName  string `json:"filename"`
+	Length    int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Created   int64  `json:"created"`
+	Expires   int64  `json:"expires"`
+	// Attributes and Tags are recorded with the object when it is committed
+	Attributes map[string]Attribute `json:"attributes,omitempty"`
+	Tags       []string             `json:"tags,omitempty"`
+}
+
+// UploadStore keeps resumable upload sessions within a filesystem folder.
+// Each session is a <id>.json record plus a <id>.data file that chunks are
+// appended to until the upload is finalized into the ObjectStore.
+type UploadStore struct {
+	path   string
+	expiry time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewUploadStore creates an UploadStore at the base directory. Sessions not
+// finalized within expiry are removed by Expire.
+func NewUploadStore(path string, expiry time.Duration) (*UploadStore, error) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, err
+	}
+	return &UploadStore{path: path, expiry: expiry, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+func (s *UploadStore) infoPath(id string) string {
+	return filepath.Join(s.path, id+".json")
+}
+
+func (s *UploadStore) dataPath(id string) string {
+	return filepath.Join(s.path, id+".data")
+}
+
+// lock serialises access to a single session so that concurrent PATCH
+// requests can't interleave their writes.
+func (s *UploadStore) lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// Create starts a new upload session for an object of the given length, to
+// be committed into namespace ns with the attributes and tags of meta.
+func (s *UploadStore) Create(ns, oid string, length int64, meta *MetaData) (*Upload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	u := &Upload{
+		ID:         hex.EncodeToString(b),
+		Namespace:  ns,
+		Oid:        oid,
+		FileName:   meta.FileName,
+		Length:     length,
+		Created:    now.Unix(),
+		Expires:    now.Add(s.expiry).Unix(),
+		Attributes: meta.Attributes,
+		Tags:       meta.Tags,
+	}
+
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	if err := s.writeInfo(u); err != nil {
+		os.Remove(s.dataPath(u.ID))
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *UploadStore) writeInfo(u *Upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.infoPath(u.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.infoPath(u.ID))
+}
+
+// Get returns the upload session with its current offset.
+func (s *UploadStore) Get(id string) (*Upload, error) {
+	if !validUploadID(id) {
+		return nil, errUploadNotFound
+	}
+
+	b, err := ioutil.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var u Upload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > u.Expires {
+		return nil, errUploadExpired
+	}
+
+	fi, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	return &u, nil
+}
+
+// Write appends r to the upload, which must currently be at offset. The
+// number of bytes written is kept even if r fails part way through, so the
+// client can resume from the new offset.
+func (s *UploadStore) Write(id string, offset int64, r io.Reader) (*Upload, error) {
+	unlock := s.lock(id)
+	defer unlock()
+
+	u, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Offset != offset {
+		return u, errOffsetMismatch
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the declared length to detect oversized uploads
+	written, err := io.Copy(f, io.LimitReader(r, u.Length-u.Offset+1))
+	if err == nil && u.Offset+written > u.Length {
+		written--
+		err = f.Truncate(u.Length)
+		if err == nil {
+			err = errUploadTooLarge
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	u.Offset += written
+
+	// Activity pushes expiry back
+	u.Expires = time.Now().Add(s.expiry).Unix()
+	if werr := s.writeInfo(u); err == nil {
+		err = werr
+	}
+	return u, err
+}
+
+// Open returns the data of a completed upload for committing.
+func (s *UploadStore) Open(id string) (*Upload, io.ReadCloser, error) {
+	u, err := s.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Offset != u.Length {
+		return u, nil, errUploadIncomplete
+	}
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, f, nil
+}
+
+// Delete removes an upload session and its data.
+func (s *UploadStore) Delete(id string) error {
+	if !validUploadID(id) {
+		return errUploadNotFound
+	}
+	unlock := s.lock(id)
+	defer unlock()
+
+	err := os.Remove(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return errUploadNotFound
+	}
+	os.Remove(s.dataPath(id))
+
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+	return err
+}
+
+// Expire removes every session whose expiry time is before now, returning
+// the number removed.
+func (s *UploadStore) Expire(now time.Time) (int, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), ".json")
+		b, err := ioutil.ReadFile(s.infoPath(id))
+		if err != nil {
+			continue
+		}
+		var u Upload
+		if err := json.Unmarshal(b, &u); err != nil || now.Unix() > u.Expires {
+			if s.Delete(id) == nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Reap runs Expire every interval until the process exits.
+func (s *UploadStore) Reap(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.Expire(time.Now())
+		if err != nil {
+			logger.Log(kv{"fn": "UploadStore.Reap", "err": err})
+			continue
+		}
+		if n > 0 {
+			logger.Log(kv{"fn": "UploadStore.Reap", "expired": n})
+		}
+	}
+}
+
+// validUploadID guards against path traversal through the id in the URL.
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
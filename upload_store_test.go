@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var uploadStoreTest *UploadStore
+
+func TestUploadStoreWrite(t *testing.T) {
+	setupUploadStore()
+	defer teardownUploadStore()
+
+	u, err := uploadStoreTest.Create("", contentOid, contentSize, &MetaData{FileName: "content.txt"})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got: %s", err)
+	}
+
+	u, err = uploadStoreTest.Write(u.ID, 0, bytes.NewBufferString(content[:5]))
+	if err != nil {
+		t.Fatalf("expected write to succeed, got: %s", err)
+	}
+	if u.Offset != 5 {
+		t.Fatalf("expected offset 5, got: %d", u.Offset)
+	}
+
+	if _, err := uploadStoreTest.Write(u.ID, 3, bytes.NewBufferString("bogus")); err != errOffsetMismatch {
+		t.Fatalf("expected errOffsetMismatch, got: %v", err)
+	}
+
+	if _, _, err := uploadStoreTest.Open(u.ID); err != errUploadIncomplete {
+		t.Fatalf("expected errUploadIncomplete, got: %v", err)
+	}
+
+	u, err = uploadStoreTest.Write(u.ID, 5, bytes.NewBufferString(content[5:]+"extra"))
+	if err != errUploadTooLarge {
+		t.Fatalf("expected errUploadTooLarge, got: %v", err)
+	}
+	if u.Offset != contentSize {
+		t.Fatalf("expected offset to stop at the declared size, got: %d", u.Offset)
+	}
+
+	_, r, err := uploadStoreTest.Open(u.ID)
+	if err != nil {
+		t.Fatalf("expected open to succeed, got: %s", err)
+	}
+	defer r.Close()
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != content {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestUploadStoreExpire(t *testing.T) {
+	setupUploadStore()
+	defer teardownUploadStore()
+
+	u, err := uploadStoreTest.Create("", contentOid, contentSize, &MetaData{FileName: "content.txt"})
+	if err != nil {
+		t.Fatalf("expected create to succeed, got: %s", err)
+	}
+
+	n, err := uploadStoreTest.Expire(time.Now())
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing to expire yet, got: %d, %v", n, err)
+	}
+
+	n, err = uploadStoreTest.Expire(time.Now().Add(2 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expected one session to expire, got: %d, %v", n, err)
+	}
+
+	if _, err := uploadStoreTest.Get(u.ID); err != errUploadNotFound {
+		t.Fatalf("expected errUploadNotFound, got: %v", err)
+	}
+}
+
+func setupUploadStore() {
+	store, err := NewUploadStore("upload-store-test", time.Hour)
+	if err != nil {
+		fmt.Printf("error initializing upload store: %s\n", err)
+		os.Exit(1)
+	}
+	uploadStoreTest = store
+}
+
+func teardownUploadStore() {
+	os.RemoveAll("upload-store-test")
+}